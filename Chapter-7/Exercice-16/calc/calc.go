@@ -49,12 +49,15 @@ const tmplCalculator = `
 			</table>
 			<input type="submit" value="Calc">
 		</form>
+		<p>Functions: {{range $i, $f := functions}}{{if $i}}, {{end}}{{$f}}{{end}}</p>
 	</body>
 </html>
 `
 
 // formCalculator is the compiled version of the calculator template
-var formCalculator = template.Must(template.New("calculator").Parse(tmplCalculator))
+var formCalculator = template.Must(template.New("calculator").
+	Funcs(template.FuncMap{"functions": eval.Functions}).
+	Parse(tmplCalculator))
 
 // displayError displays an error in the calculator form
 func displayError(w http.ResponseWriter, expression, variables, errorFormat string, errorArgs ...interface{}) {
@@ -3,7 +3,8 @@
 
 package eval
 
-// An Expr is an arithmetic expression.
+// An Expr is an arithmetic or boolean expression.
+// A boolean expression evaluates to 1 if true, 0 if false.
 type Expr interface {
 	// Eval returns the value of this Expr in the environment env.
 	Eval(env Env) float64
@@ -19,7 +20,7 @@ type literal float64
 
 // A unary represents a unary operator expression, e.g., -x.
 type unary struct {
-	op rune // one of '+', '-'
+	op rune // one of '+', '-', '!'
 	x  Expr
 }
 
@@ -29,8 +30,25 @@ type binary struct {
 	x, y Expr
 }
 
+// A comparison represents a comparison expression, e.g., x<y.
+type comparison struct {
+	op   string // one of "<", "<=", "==", "!=", ">=", ">"
+	x, y Expr
+}
+
+// A logical represents a logical operator expression, e.g., x<y && y<z.
+type logical struct {
+	op   string // one of "&&", "||"
+	x, y Expr
+}
+
+// A conditional represents a conditional expression, e.g., x<0 ? -x : x.
+type conditional struct {
+	cond, x, y Expr
+}
+
 // A call represents a function call expression, e.g., sin(x).
 type call struct {
-	fn   string // one of "pow", "sin", "sqrt"
+	fn   string // name of a registered Function
 	args []Expr
 }
@@ -21,40 +21,118 @@ func (literal) Check(vars map[Var]bool) error {
 
 // Check verifies the unitary operator then checks the operand recursively
 func (u unary) Check(vars map[Var]bool) error {
-	if !strings.ContainsRune("+-", u.op) {
+	if !strings.ContainsRune("+-!", u.op) {
 		return fmt.Errorf("unexpected unary op %q", u.op)
 	}
-	return u.x.Check(vars)
+	if err := u.x.Check(vars); err != nil {
+		return err
+	}
+	if u.op == '!' {
+		return expect(u.x, boolean)
+	}
+	return expect(u.x, number)
 }
 
-// Check verifies the binary operator then checks the operands recursively
+// Check verifies the binary operator then checks the numeric operands recursively
 func (b binary) Check(vars map[Var]bool) error {
 	if !strings.ContainsRune("+-*/", b.op) {
 		return fmt.Errorf("unexpected binary op %q", b.op)
 	}
-	if err := b.x.Check(vars); err != nil {
+	return checkOperands(vars, number, b.x, b.y)
+}
+
+// Check verifies the comparison operator then checks the numeric operands recursively
+func (c comparison) Check(vars map[Var]bool) error {
+	switch c.op {
+	case "<", "<=", "==", "!=", ">=", ">":
+	default:
+		return fmt.Errorf("unexpected comparison op %q", c.op)
+	}
+	return checkOperands(vars, number, c.x, c.y)
+}
+
+// Check verifies the logical operator then checks the boolean operands recursively
+func (l logical) Check(vars map[Var]bool) error {
+	if l.op != "&&" && l.op != "||" {
+		return fmt.Errorf("unexpected logical op %q", l.op)
+	}
+	return checkOperands(vars, boolean, l.x, l.y)
+}
+
+// Check verifies that the condition is boolean and that both results have the same kind
+func (c conditional) Check(vars map[Var]bool) error {
+	if err := checkOperands(vars, boolean, c.cond); err != nil {
 		return err
 	}
-	return b.y.Check(vars)
+	if err := c.x.Check(vars); err != nil {
+		return err
+	}
+	if err := c.y.Check(vars); err != nil {
+		return err
+	}
+	return expect(c.y, kindOf(c.x))
 }
 
 // Check verifies the function name and the arguments count then checks the arguments recursively
 func (c call) Check(vars map[Var]bool) error {
-	arity, ok := numParams[c.fn]
+	f, ok := lookup(c.fn)
 	if !ok {
 		return fmt.Errorf("unknown function %q", c.fn)
 	}
-	if len(c.args) != arity {
-		return fmt.Errorf("call to %s has %d args, want %d",
-			c.fn, len(c.args), arity)
+	if err := f.checkArity(len(c.args)); err != nil {
+		return err
 	}
-	for _, arg := range c.args {
-		if err := arg.Check(vars); err != nil {
-			return err
+	return checkOperands(vars, number, c.args...)
+}
+
+// A kind is the type of the value of an expression
+type kind int
+
+const (
+	number kind = iota
+	boolean
+)
+
+// String returns the name of the kind
+func (k kind) String() string {
+	if k == boolean {
+		return "boolean"
+	}
+	return "number"
+}
+
+// kindOf returns the kind of the value of an expression
+func kindOf(e Expr) kind {
+	switch e := e.(type) {
+	case unary:
+		if e.op == '!' {
+			return boolean
 		}
+	case comparison, logical:
+		return boolean
+	case conditional:
+		return kindOf(e.x)
+	}
+	return number
+}
+
+// expect verifies the kind of the value of an expression
+func expect(e Expr, want kind) error {
+	if got := kindOf(e); got != want {
+		return fmt.Errorf("%s is a %s, want a %s", Format(e), got, want)
 	}
 	return nil
 }
 
-// numParams is the number of arguments for each supported function
-var numParams = map[string]int{"pow": 2, "sin": 1, "sqrt": 1}
+// checkOperands checks the operands recursively then verifies their kind
+func checkOperands(vars map[Var]bool, want kind, operands ...Expr) error {
+	for _, x := range operands {
+		if err := x.Check(vars); err != nil {
+			return err
+		}
+		if err := expect(x, want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -17,8 +17,8 @@ func TestCoverage(t *testing.T) {
 		want  string // expected error from Parse/Check or result from Eval
 	}{
 		{"x % 2", nil, "unexpected '%'"},
-		{"!true", nil, "unexpected '!'"},
-		{"log(10)", nil, `unknown function "log"`},
+		{"!true", nil, "true is a number, want a boolean"},
+		{"cot(10)", nil, `unknown function "cot"`},
 		{"sqrt(1, 2)", nil, "call to sqrt has 2 args, want 1"},
 		{"sqrt(A / pi)", Env{"A": 87616, "pi": math.Pi}, "167"},
 		{"pow(x, 3) + pow(y, 3)", Env{"x": 9, "y": 10}, "1729"},
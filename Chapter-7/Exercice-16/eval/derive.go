@@ -0,0 +1,149 @@
+package eval
+
+import "fmt"
+
+// Derive returns the simplified derivative of an expression by the variable v.
+// The boolean expressions are piecewise constant, their derivative is 0, and
+// the derivative of a conditional is the derivative of each result.
+// Derive fails if the expression calls a function without derivative.
+func Derive(e Expr, v Var) (Expr, error) {
+	d, err := derive(e, v)
+	if err != nil {
+		return nil, err
+	}
+	return Simplify(d), nil
+}
+
+// MustDerive is like Derive but panics if the expression has no derivative.
+// It simplifies the derivation of expressions known to be differentiable.
+func MustDerive(e Expr, v Var) Expr {
+	d, err := Derive(e, v)
+	if err != nil {
+		panic(fmt.Sprintf("eval: %v", err))
+	}
+	return d
+}
+
+// derive returns the derivative of an expression by the variable v
+func derive(e Expr, v Var) (Expr, error) {
+	switch e := e.(type) {
+	case literal:
+		return literal(0), nil
+
+	case Var:
+		if e == v {
+			return literal(1), nil
+		}
+		return literal(0), nil
+
+	case unary:
+		if e.op == '!' {
+			return literal(0), nil
+		}
+		dx, err := derive(e.x, v)
+		if err != nil {
+			return nil, err
+		}
+		return unary{e.op, dx}, nil
+
+	case binary:
+		dx, err := derive(e.x, v)
+		if err != nil {
+			return nil, err
+		}
+		dy, err := derive(e.y, v)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case '+', '-':
+			return binary{e.op, dx, dy}, nil
+		case '*':
+			return binary{'+', binary{'*', dx, e.y}, binary{'*', e.x, dy}}, nil
+		case '/':
+			// A constant denominator only divides the derivative of the numerator
+			if isConst(Simplify(dy), 0) {
+				return binary{'/', dx, e.y}, nil
+			}
+			numerator := binary{'-', binary{'*', dx, e.y}, binary{'*', e.x, dy}}
+			return binary{'/', numerator, call{"pow", []Expr{e.y, literal(2)}}}, nil
+		}
+		return nil, fmt.Errorf("unsupported binary operator: %q", e.op)
+
+	case comparison, logical:
+		return literal(0), nil
+
+	case conditional:
+		dx, err := derive(e.x, v)
+		if err != nil {
+			return nil, err
+		}
+		dy, err := derive(e.y, v)
+		if err != nil {
+			return nil, err
+		}
+		return conditional{e.cond, dx, dy}, nil
+
+	case call:
+		f, _ := lookup(e.fn)
+		if f.derive != nil {
+			return f.derive(e.args, v)
+		}
+		if f.partials == nil || len(f.partials) != len(e.args) {
+			return nil, fmt.Errorf("no derivative for function %s", e.fn)
+		}
+		// Chain rule: sum of the partial derivatives by the derivatives of the arguments
+		params := make(map[Var]Expr, len(e.args))
+		for i, arg := range e.args {
+			params[param(i, len(e.args))] = arg
+		}
+		var d Expr = literal(0)
+		for i, arg := range e.args {
+			darg, err := derive(arg, v)
+			if err != nil {
+				return nil, err
+			}
+			d = binary{'+', d, binary{'*', substitute(f.partials[i], params), darg}}
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown Expr: %T", e)
+}
+
+// substitute returns an expression where the variables are replaced by the
+// expressions of params
+func substitute(e Expr, params map[Var]Expr) Expr {
+	switch e := e.(type) {
+	case literal:
+		return e
+
+	case Var:
+		if x, ok := params[e]; ok {
+			return x
+		}
+		return e
+
+	case unary:
+		return unary{e.op, substitute(e.x, params)}
+
+	case binary:
+		return binary{e.op, substitute(e.x, params), substitute(e.y, params)}
+
+	case comparison:
+		return comparison{e.op, substitute(e.x, params), substitute(e.y, params)}
+
+	case logical:
+		return logical{e.op, substitute(e.x, params), substitute(e.y, params)}
+
+	case conditional:
+		return conditional{substitute(e.cond, params), substitute(e.x, params), substitute(e.y, params)}
+
+	case call:
+		args := make([]Expr, len(e.args))
+		for i, arg := range e.args {
+			args[i] = substitute(arg, params)
+		}
+		return call{e.fn, args}
+	}
+	panic(fmt.Sprintf("unknown Expr: %T", e))
+}
@@ -0,0 +1,182 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSimplify(t *testing.T) {
+	for _, test := range []struct{ input, want string }{
+		{"x * 1 + 0", "x"},
+		{"1 * x - 0", "x"},
+		{"0 * x + y / 1", "y"},
+		{"pow(x, 1) + pow(y, 0)", "x + 1"},
+		{"2 * 3 + x", "6 + x"},
+		{"x * 2", "2 * x"},
+		{"2 * (3 * x)", "6 * x"},
+		{"x + x", "2 * x"},
+		{"x * x", "pow(x, 2)"},
+		{"x - x", "0"},
+		{"--x", "x"},
+		{"+x", "x"},
+		{"-1 * x", "-x"},
+		{"x + -y", "x - y"},
+		{"x - -y", "x + y"},
+		{"x + -2", "x - 2"},
+		{"0 - x", "-x"},
+		{"sqrt(4) * x", "2 * x"},
+		{"1 / 0 + x", "1 / 0 + x"},
+		{"!!(x < 1)", "x < 1"},
+		{"1 < 2 ? x : y", "x"},
+		{"!(1 < 2) ? x : y", "y"},
+		{"x < 1 ? y * 1 : y", "y"},
+		{"1 < 2 && x < 1", "x < 1"},
+		{"1 > 2 && x < 1", "1 > 2"},
+		{"x < 1 || 1 > 2", "x < 1"},
+		{"x < 1 && 1 < 2", "x < 1"},
+		{"max(x, 1 + 1)", "max(x, 2)"},
+		{"min(x * 1)", "x"},
+		{"y / pow(y, 2)", "1 / y"},
+		{"x / pow(x, 3)", "1 / pow(x, 2)"},
+		{"(x + 1) / (x + 1)", "1"},
+	} {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if got := Format(Simplify(expr)); got != test.want {
+			t.Errorf("Simplify(%s) = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestDerive(t *testing.T) {
+	for _, test := range []struct{ input, want string }{
+		{"3", "0"},
+		{"y", "0"},
+		{"x", "1"},
+		{"-x", "-1"},
+		{"3 * x * y + y", "3 * y"},
+		{"x * x", "2 * x"},
+		{"pow(x, 3)", "3 * pow(x, 2)"},
+		{"1 / x", "-1 / pow(x, 2)"},
+		{"x / y", "1 / y"},
+		{"sin(x) / 2", "cos(x) / 2"},
+		{"exp(x) / x", "(exp(x) * x - exp(x)) / pow(x, 2)"},
+		{"sin(2 * x)", "2 * cos(2 * x)"},
+		{"cos(x)", "-sin(x)"},
+		{"log(sqrt(x))", "1 / sqrt(x) * (1 / (2 * sqrt(x)))"},
+		{"hypot(x, y)", "x / hypot(x, y)"},
+		{"x < 0 ? -x : x", "x < 0 ? -1 : 1"},
+		{"x < 0 ? y : 2", "0"},
+		{"max(x, y, 2 * x)", "x >= max(y, 2 * x) ? 1 : y >= 2 * x ? 0 : 2"},
+	} {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		d, err := Derive(expr, "x")
+		if err != nil {
+			t.Errorf("Derive(%s): %v", test.input, err)
+			continue
+		}
+		if got := Format(d); got != test.want {
+			t.Errorf("Derive(%s) = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+// TestDeriveFunctions compares the derivatives of the functions with finite differences
+func TestDeriveFunctions(t *testing.T) {
+	// Points in the domain of the functions, from 0.3 by default
+	points := map[string]float64{"acosh": 1.5}
+	const h = 1e-6
+	for _, f := range Functions() {
+		if f.Partials == nil && f.derive == nil {
+			continue
+		}
+		n := f.Arity
+		if f.Variadic {
+			n = 3
+		}
+		env := Env{}
+		args := make([]string, n)
+		for i := range args {
+			v := Var(fmt.Sprintf("x%d", i+1))
+			env[v] = 0.3 + 0.1*float64(i)
+			if p, ok := points[f.Name]; ok {
+				env[v] = p
+			}
+			args[i] = string(v)
+		}
+		input := fmt.Sprintf("%s(%s)", f.Name, strings.Join(args, ", "))
+		expr, err := Parse(input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+
+		for v, x := range env {
+			d, err := Derive(expr, v)
+			if err != nil {
+				t.Errorf("Derive(%s, %s): %v", input, v, err)
+				continue
+			}
+			if err := d.Check(map[Var]bool{}); err != nil {
+				t.Errorf("Derive(%s, %s) = %s: %v", input, v, Format(d), err)
+				continue
+			}
+			got := d.Eval(env)
+			env[v] = x + h
+			want := expr.Eval(env)
+			env[v] = x - h
+			want = (want - expr.Eval(env)) / (2 * h)
+			env[v] = x
+			if math.Abs(got-want) > 1e-4*math.Max(1, math.Abs(want)) {
+				t.Errorf("Derive(%s, %s) = %s = %g, want %g", input, v, Format(d), got, want)
+			}
+		}
+	}
+}
+
+func TestDeriveUnknown(t *testing.T) {
+	Register(Function{Name: "nopartials", Arity: 1, Call: func(args []float64) float64 { return args[0] }})
+	defer unregister("nopartials")
+
+	for _, input := range []string{"gamma(x)", "1 + 2 * gamma(x)", "max(x, nopartials(x))"} {
+		expr, err := Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := Derive(expr, "x")
+		if err == nil {
+			t.Errorf("Derive(%s) = %s, want an error", input, Format(d))
+		} else if !strings.HasPrefix(err.Error(), "no derivative for function ") {
+			t.Errorf("Derive(%s): unexpected error %v", input, err)
+		}
+	}
+}
+
+func TestMustDerive(t *testing.T) {
+	expr, err := Parse("x * x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Format(MustDerive(expr, "x")); got != "2 * x" {
+		t.Errorf("MustDerive(x * x) = %s, want 2 * x", got)
+	}
+
+	expr, err = Parse("gamma(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MustDerive(gamma(x)) did not panic")
+		}
+	}()
+	MustDerive(expr, "x")
+}
@@ -2,12 +2,13 @@
 // License: https://creativecommons.org/licenses/by-nc-sa/4.0/
 
 // Package eval provides an expression evaluator.
+//
+// Derive computes the symbolic derivative of an expression. It returns an
+// error if the expression calls a function which is not differentiable (no
+// partial derivatives are registered for it), and MustDerive panics instead.
 package eval
 
-import (
-	"fmt"
-	"math"
-)
+import "fmt"
 
 // Env is the list of variables (name/value)
 type Env map[Var]float64
@@ -29,6 +30,8 @@ func (u unary) Eval(env Env) float64 {
 		return +u.x.Eval(env)
 	case '-':
 		return -u.x.Eval(env)
+	case '!':
+		return boolValue(u.x.Eval(env) == 0)
 	}
 	panic(fmt.Sprintf("unsupported unary operator: %q", u.op))
 }
@@ -48,15 +51,63 @@ func (b binary) Eval(env Env) float64 {
 	panic(fmt.Sprintf("unsupported binary operator: %q", b.op))
 }
 
+// Eval returns the value of the comparison, 1 if true and 0 if false
+func (c comparison) Eval(env Env) float64 {
+	x, y := c.x.Eval(env), c.y.Eval(env)
+	switch c.op {
+	case "<":
+		return boolValue(x < y)
+	case "<=":
+		return boolValue(x <= y)
+	case "==":
+		return boolValue(x == y)
+	case "!=":
+		return boolValue(x != y)
+	case ">=":
+		return boolValue(x >= y)
+	case ">":
+		return boolValue(x > y)
+	}
+	panic(fmt.Sprintf("unsupported comparison operator: %q", c.op))
+}
+
+// Eval returns the value of the logical expression, evaluating the second
+// operand only if the first one doesn't determine the result
+func (l logical) Eval(env Env) float64 {
+	switch l.op {
+	case "&&":
+		return boolValue(l.x.Eval(env) != 0 && l.y.Eval(env) != 0)
+	case "||":
+		return boolValue(l.x.Eval(env) != 0 || l.y.Eval(env) != 0)
+	}
+	panic(fmt.Sprintf("unsupported logical operator: %q", l.op))
+}
+
+// Eval returns the value of the result selected by the condition
+func (c conditional) Eval(env Env) float64 {
+	if c.cond.Eval(env) != 0 {
+		return c.x.Eval(env)
+	}
+	return c.y.Eval(env)
+}
+
 // Eval returns the value of the function call
 func (c call) Eval(env Env) float64 {
-	switch c.fn {
-	case "pow":
-		return math.Pow(c.args[0].Eval(env), c.args[1].Eval(env))
-	case "sin":
-		return math.Sin(c.args[0].Eval(env))
-	case "sqrt":
-		return math.Sqrt(c.args[0].Eval(env))
-	}
-	panic(fmt.Sprintf("unsupported function call: %s", c.fn))
+	f, ok := lookup(c.fn)
+	if !ok {
+		panic(fmt.Sprintf("unsupported function call: %s", c.fn))
+	}
+	args := make([]float64, len(c.args))
+	for i, arg := range c.args {
+		args[i] = arg.Eval(env)
+	}
+	return f.Call(args)
+}
+
+// boolValue returns the value of a boolean
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -79,9 +79,9 @@ func TestErrors(t *testing.T) {
 	for _, test := range []struct{ expr, wantErr string }{
 		{"x % 2", "unexpected '%'"},
 		{"math.Pi", "unexpected '.'"},
-		{"!true", "unexpected '!'"},
+		{"!true", "true is a number, want a boolean"},
 		{`"hello"`, "unexpected '\"'"},
-		{"log(10)", `unknown function "log"`},
+		{"cot(10)", `unknown function "cot"`},
 		{"sqrt(1, 2)", "call to sqrt has 2 args, want 1"},
 	} {
 		expr, err := Parse(test.expr)
@@ -104,10 +104,11 @@ func TestErrors(t *testing.T) {
 //!+errors
 x % 2               unexpected '%'
 math.Pi             unexpected '.'
-!true               unexpected '!'
 "hello"             unexpected '"'
 
-log(10)             unknown function "log"
+!true               true is a number, want a boolean
+
+cot(10)             unknown function "cot"
 sqrt(1, 2)          call to sqrt has 2 args, want 1
 //!-errors
 */
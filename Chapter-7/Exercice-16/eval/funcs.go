@@ -0,0 +1,265 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"text/scanner"
+)
+
+// A Function is a function which can be called in an expression
+type Function struct {
+	Name     string                       // name of the function in the expressions, e.g., sin
+	Arity    int                          // number of arguments, minimum number if Variadic
+	Variadic bool                         // true if the function accepts more than Arity arguments
+	Call     func(args []float64) float64 // implementation of the function
+
+	// Partials are the partial derivatives of the function by each of its
+	// arguments, written as expressions of the parameters of String, e.g.,
+	// "cos(x)" for sin or "x2 * pow(x1, x2 - 1)" and "log(x1) * pow(x1, x2)"
+	// for pow. Derive fails on the function if Partials is nil.
+	Partials []string
+
+	partials []Expr                                 // parsed Partials
+	derive   func(args []Expr, v Var) (Expr, error) // derivative of the variadic functions
+}
+
+// param returns the name of the i-th parameter of a function of the given arity
+func param(i, arity int) Var {
+	if arity == 1 {
+		return "x"
+	}
+	return Var(fmt.Sprintf("x%d", i+1))
+}
+
+// String returns the signature of the function, e.g., max(x1, ...)
+func (f Function) String() string {
+	args := make([]string, f.Arity)
+	for i := range args {
+		if f.Variadic {
+			args[i] = fmt.Sprintf("x%d", i+1) // numbered, even if there is only one
+		} else {
+			args[i] = string(param(i, f.Arity))
+		}
+	}
+	if f.Variadic {
+		args = append(args, "...")
+	}
+	return fmt.Sprintf("%s(%s)", f.Name, strings.Join(args, ", "))
+}
+
+// checkArity verifies the number of arguments of a call
+func (f Function) checkArity(n int) error {
+	switch {
+	case f.Variadic && n < f.Arity:
+		return fmt.Errorf("call to %s has %d args, want at least %d", f.Name, n, f.Arity)
+	case !f.Variadic && n != f.Arity:
+		return fmt.Errorf("call to %s has %d args, want %d", f.Name, n, f.Arity)
+	}
+	return nil
+}
+
+// functions is the registry of the functions, by name
+var (
+	functionsMutex sync.RWMutex // Protects functions
+	functions      = make(map[string]Function)
+)
+
+// lookup returns the registered function of a name
+func lookup(name string) (Function, bool) {
+	functionsMutex.RLock()
+	defer functionsMutex.RUnlock()
+	f, ok := functions[name]
+	return f, ok
+}
+
+// Register registers a function callable in the expressions, replacing any
+// function of the same name. It must be called before the expressions using
+// the function are checked or evaluated, typically from an init function.
+// It is safe to call concurrently with the other functions of the package.
+func Register(f Function) {
+	if !isIdent(f.Name) {
+		panic(fmt.Sprintf("eval: invalid function name %q", f.Name))
+	}
+	if f.Arity < 0 || f.Call == nil {
+		panic(fmt.Sprintf("eval: invalid function %s", f.Name))
+	}
+	if f.Partials != nil {
+		if f.Variadic || len(f.Partials) != f.Arity {
+			panic(fmt.Sprintf("eval: %s has %d partial derivatives, want %d", f.Name, len(f.Partials), f.Arity))
+		}
+		f.partials = make([]Expr, f.Arity)
+		for i, partial := range f.Partials {
+			e, err := Parse(partial)
+			if err != nil {
+				panic(fmt.Sprintf("eval: partial derivative %q of %s: %v", partial, f.Name, err))
+			}
+			f.partials[i] = e
+		}
+	}
+	functionsMutex.Lock()
+	functions[f.Name] = f
+	functionsMutex.Unlock()
+}
+
+// Functions returns the registered functions, sorted by name
+func Functions() []Function {
+	functionsMutex.RLock()
+	list := make([]Function, 0, len(functions))
+	for _, f := range functions {
+		list = append(list, f)
+	}
+	functionsMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// isIdent reports whether name is scanned as a single identifier by the lexer
+func isIdent(name string) bool {
+	var scan scanner.Scanner
+	scan.Init(strings.NewReader(name))
+	scan.Mode = scanner.ScanIdents
+	return scan.Scan() == scanner.Ident && scan.TokenText() == name && scan.Scan() == scanner.EOF
+}
+
+// unaryFunction returns a function with one argument
+func unaryFunction(name string, fn func(float64) float64, derivative string) Function {
+	return Function{
+		Name:     name,
+		Arity:    1,
+		Call:     func(args []float64) float64 { return fn(args[0]) },
+		Partials: []string{derivative},
+	}
+}
+
+// binaryFunction returns a function with two arguments
+func binaryFunction(name string, fn func(float64, float64) float64, partial1, partial2 string) Function {
+	return Function{
+		Name:     name,
+		Arity:    2,
+		Call:     func(args []float64) float64 { return fn(args[0], args[1]) },
+		Partials: []string{partial1, partial2},
+	}
+}
+
+// extremum returns the variadic function min or max. Its derivative is the
+// derivative of the argument selected by cmp.
+func extremum(name string, fn func(float64, float64) float64, cmp string) Function {
+	return Function{
+		Name:     name,
+		Arity:    1,
+		Variadic: true,
+		Call: func(args []float64) float64 {
+			m := args[0]
+			for _, arg := range args[1:] {
+				m = fn(m, arg)
+			}
+			return m
+		},
+		derive: func(args []Expr, v Var) (Expr, error) {
+			// name(x, rest...) is x if x cmp name(rest...)
+			if len(args) == 1 {
+				return derive(args[0], v)
+			}
+			rest := call{name, args[1:]}
+			return derive(conditional{comparison{cmp, args[0], rest}, args[0], rest}, v)
+		},
+	}
+}
+
+// init registers the functions of the math package.
+// The constants of the derivatives are 2/sqrt(pi), sqrt(pi)/2, log(2) and log(10).
+func init() {
+	for _, f := range []struct {
+		name       string
+		fn         func(float64) float64
+		derivative string
+	}{
+		{"abs", math.Abs, "x < 0 ? -1 : 1"},
+		{"acos", math.Acos, "-1 / sqrt(1 - x * x)"},
+		{"acosh", math.Acosh, "1 / sqrt(x * x - 1)"},
+		{"asin", math.Asin, "1 / sqrt(1 - x * x)"},
+		{"asinh", math.Asinh, "1 / sqrt(x * x + 1)"},
+		{"atan", math.Atan, "1 / (1 + x * x)"},
+		{"atanh", math.Atanh, "1 / (1 - x * x)"},
+		{"cbrt", math.Cbrt, "1 / (3 * pow(cbrt(x), 2))"},
+		{"ceil", math.Ceil, "0"},
+		{"cos", math.Cos, "-sin(x)"},
+		{"cosh", math.Cosh, "sinh(x)"},
+		{"erf", math.Erf, "1.1283791670955126 * exp(-(x * x))"},
+		{"erfc", math.Erfc, "-1.1283791670955126 * exp(-(x * x))"},
+		{"erfcinv", math.Erfcinv, "-0.886226925452758 * exp(pow(erfcinv(x), 2))"},
+		{"erfinv", math.Erfinv, "0.886226925452758 * exp(pow(erfinv(x), 2))"},
+		{"exp", math.Exp, "exp(x)"},
+		{"exp2", math.Exp2, "0.6931471805599453 * exp2(x)"},
+		{"expm1", math.Expm1, "exp(x)"},
+		{"floor", math.Floor, "0"},
+		{"j0", math.J0, "-j1(x)"},
+		{"j1", math.J1, "j0(x) - j1(x) / x"},
+		{"log", math.Log, "1 / x"},
+		{"log10", math.Log10, "1 / (2.302585092994046 * x)"},
+		{"log1p", math.Log1p, "1 / (1 + x)"},
+		{"log2", math.Log2, "1 / (0.6931471805599453 * x)"},
+		{"logb", math.Logb, "0"},
+		{"round", math.Round, "0"},
+		{"roundtoeven", math.RoundToEven, "0"},
+		{"sin", math.Sin, "cos(x)"},
+		{"sinh", math.Sinh, "cosh(x)"},
+		{"sqrt", math.Sqrt, "1 / (2 * sqrt(x))"},
+		{"tan", math.Tan, "1 + pow(tan(x), 2)"},
+		{"tanh", math.Tanh, "1 - pow(tanh(x), 2)"},
+		{"trunc", math.Trunc, "0"},
+		{"y0", math.Y0, "-y1(x)"},
+		{"y1", math.Y1, "y0(x) - y1(x) / x"},
+	} {
+		Register(unaryFunction(f.name, f.fn, f.derivative))
+	}
+	for _, f := range []struct {
+		name               string
+		fn                 func(float64, float64) float64
+		partial1, partial2 string
+	}{
+		{"atan2", math.Atan2, "x2 / (x1 * x1 + x2 * x2)", "-x1 / (x1 * x1 + x2 * x2)"},
+		{"copysign", math.Copysign, "copysign(1, x1) * copysign(1, x2)", "0"},
+		{"dim", math.Dim, "x1 > x2 ? 1 : 0", "x1 > x2 ? -1 : 0"},
+		{"hypot", math.Hypot, "x1 / hypot(x1, x2)", "x2 / hypot(x1, x2)"},
+		{"mod", math.Mod, "1", "-trunc(x1 / x2)"},
+		{"nextafter", math.Nextafter, "1", "0"},
+		{"pow", math.Pow, "x2 * pow(x1, x2 - 1)", "log(x1) * pow(x1, x2)"},
+		{"remainder", math.Remainder, "1", "-roundtoeven(x1 / x2)"},
+	} {
+		Register(binaryFunction(f.name, f.fn, f.partial1, f.partial2))
+	}
+
+	// gamma has no derivative in the math package
+	Register(Function{Name: "gamma", Arity: 1, Call: func(args []float64) float64 {
+		return math.Gamma(args[0])
+	}})
+
+	// Functions with integer arguments truncate them
+	Register(Function{Name: "pow10", Arity: 1, Partials: []string{"0"}, Call: func(args []float64) float64 {
+		return math.Pow10(int(args[0]))
+	}})
+	Register(Function{Name: "jn", Arity: 2, Partials: []string{"0", "(jn(trunc(x1) - 1, x2) - jn(trunc(x1) + 1, x2)) / 2"},
+		Call: func(args []float64) float64 {
+			return math.Jn(int(args[0]), args[1])
+		}})
+	Register(Function{Name: "yn", Arity: 2, Partials: []string{"0", "(yn(trunc(x1) - 1, x2) - yn(trunc(x1) + 1, x2)) / 2"},
+		Call: func(args []float64) float64 {
+			return math.Yn(int(args[0]), args[1])
+		}})
+	Register(Function{Name: "ldexp", Arity: 2, Partials: []string{"ldexp(1, x2)", "0"},
+		Call: func(args []float64) float64 {
+			return math.Ldexp(args[0], int(args[1]))
+		}})
+	Register(Function{Name: "fma", Arity: 3, Partials: []string{"x2", "x1", "1"},
+		Call: func(args []float64) float64 {
+			return math.FMA(args[0], args[1], args[2])
+		}})
+
+	// min and max accept any number of arguments
+	Register(extremum("min", math.Min, "<="))
+	Register(extremum("max", math.Max, ">="))
+}
@@ -0,0 +1,135 @@
+package eval
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// unregister removes a function registered by a test
+func unregister(name string) {
+	functionsMutex.Lock()
+	defer functionsMutex.Unlock()
+	delete(functions, name)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		input string
+		env   Env
+		want  string // expected error from Parse/Check or result from Eval
+	}{
+		{"cos(0) + exp(0) + abs(-1)", nil, "3"},
+		{"log(exp(x))", Env{"x": 2.5}, "2.5"},
+		{"hypot(3, 4)", nil, "5"},
+		{"floor(x) + ceil(x)", Env{"x": 1.5}, "3"},
+		{"min(3, 1, 2)", nil, "1"},
+		{"max(x)", Env{"x": 7}, "7"},
+		{"max(1, x, 3, 2)", Env{"x": 4}, "4"},
+		{"fma(2, 3, 4)", nil, "10"},
+		{"pow10(2.7)", nil, "100"},
+		{"max()", nil, "call to max has 0 args, want at least 1"},
+		{"hypot(1)", nil, "call to hypot has 1 args, want 2"},
+		{"sqrt(1, 2)", nil, "call to sqrt has 2 args, want 1"},
+		{"cot(1)", nil, `unknown function "cot"`},
+	}
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err == nil {
+			err = expr.Check(map[Var]bool{})
+		}
+		if err != nil {
+			if err.Error() != test.want {
+				t.Errorf("%s: got %q, want %q", test.input, err, test.want)
+			}
+			continue
+		}
+		got := fmt.Sprintf("%.6g", expr.Eval(test.env))
+		if got != test.want {
+			t.Errorf("%s: %v => %s, want %s", test.input, test.env, got, test.want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register(Function{Name: "sum", Variadic: true, Call: func(args []float64) float64 {
+		total := 0.0
+		for _, arg := range args {
+			total += arg
+		}
+		return total
+	}})
+	defer unregister("sum")
+
+	for input, want := range map[string]string{"sum()": "0", "sum(1, 2, x)": "6"} {
+		expr, err := Parse(input)
+		if err == nil {
+			err = expr.Check(map[Var]bool{})
+		}
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		if got := fmt.Sprintf("%g", expr.Eval(Env{"x": 3})); got != want {
+			t.Errorf("%s => %s, want %s", input, got, want)
+		}
+	}
+
+	for _, name := range []string{"", "2x", "a.b", "f(x)"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) didn't panic", name)
+				}
+			}()
+			Register(Function{Name: name, Arity: 1, Call: func(args []float64) float64 { return 0 }})
+		}()
+	}
+}
+
+func TestFunctionString(t *testing.T) {
+	found := make(map[string]string)
+	for _, f := range Functions() {
+		found[f.Name] = f.String()
+	}
+	for name, want := range map[string]string{
+		"sin":   "sin(x)",
+		"hypot": "hypot(x1, x2)",
+		"fma":   "fma(x1, x2, x3)",
+		"max":   "max(x1, ...)",
+	} {
+		if found[name] != want {
+			t.Errorf("%s: got %q, want %q", name, found[name], want)
+		}
+	}
+}
+
+func TestRegisterConcurrent(t *testing.T) {
+	defer unregister("twice")
+	expr, err := Parse("sin(x) + max(x, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering while expressions are checked and evaluated is safe
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			Register(Function{Name: "twice", Arity: 1, Call: func(args []float64) float64 { return 2 * args[0] }})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := expr.Check(map[Var]bool{"x": true}); err != nil {
+				t.Error(err)
+				return
+			}
+			expr.Eval(Env{"x": 2})
+			Functions()
+		}
+	}()
+	wg.Wait()
+}
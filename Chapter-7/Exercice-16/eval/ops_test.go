@@ -0,0 +1,136 @@
+package eval
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestOperators(t *testing.T) {
+	tests := []struct {
+		input  string
+		format string // expected Format of the parsed expression
+		env    Env
+		want   string // expected error from Check or result from Eval
+	}{
+		{"x < 0 ? -x : x", "x < 0 ? -x : x", Env{"x": -3}, "3"},
+		{"x < 0 ? -x : x", "x < 0 ? -x : x", Env{"x": 2}, "2"},
+		{"x < 0 ? -1 : x < 1 ? x : 1", "x < 0 ? -1 : x < 1 ? x : 1", Env{"x": 0.5}, "0.5"},
+		{"x < 0 ? -1 : x < 1 ? x : 1", "x < 0 ? -1 : x < 1 ? x : 1", Env{"x": 4}, "1"},
+		{"1 + 2 * 3 == 7", "1 + 2 * 3 == 7", nil, "1"},
+		{"((x)) * ((y) + 1)", "x * (y + 1)", Env{"x": 2, "y": 1}, "4"},
+		{"x <= 1 || x >= 3 && x != 4", "x <= 1 || x >= 3 && x != 4", Env{"x": 4}, "0"},
+		{"(x <= 1 || x >= 3) && x != 4", "(x <= 1 || x >= 3) && x != 4", Env{"x": 0}, "1"},
+		{"!(x > 1) && !!(x == 1)", "!(x > 1) && !!(x == 1)", Env{"x": 1}, "1"},
+		{"max(x > 0 ? x : 0, 1)", "max(x > 0 ? x : 0, 1)", Env{"x": 3}, "3"},
+		{"a < b ? a < c : b < c", "a < b ? a < c : b < c", Env{"a": 1, "b": 2, "c": 3}, "1"},
+		{"x + (x > 1)", "x + (x > 1)", nil, "x > 1 is a boolean, want a number"},
+		{"1 < 2 < 3", "1 < 2 < 3", nil, "1 < 2 is a boolean, want a number"},
+		{"x && y", "x && y", nil, "x is a number, want a boolean"},
+		{"x ? 1 : 2", "x ? 1 : 2", nil, "x is a number, want a boolean"},
+		{"x > 1 ? 1 : x > 2", "x > 1 ? 1 : x > 2", nil, "x > 2 is a boolean, want a number"},
+		{"sin(x == 1)", "sin(x == 1)", nil, "x == 1 is a boolean, want a number"},
+		{"-(x == 1)", "-(x == 1)", nil, "x == 1 is a boolean, want a number"},
+	}
+	for _, test := range tests {
+		expr, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if got := Format(expr); got != test.format {
+			t.Errorf("%s: Format = %s, want %s", test.input, got, test.format)
+		}
+		if err := expr.Check(map[Var]bool{}); err != nil {
+			if err.Error() != test.want {
+				t.Errorf("%s: got %q, want %q", test.input, err, test.want)
+			}
+			continue
+		}
+		got := fmt.Sprintf("%.6g", expr.Eval(test.env))
+		if got != test.want {
+			t.Errorf("%s: %v => %s, want %s", test.input, test.env, got, test.want)
+		}
+	}
+}
+
+func TestOperatorsRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		"x < 0 ? -x : x",
+		"a >= b == c <= d != !e",
+		"!(a || b && c) ? x ? 1 : 2 : 3",
+		"pow(x, 2) > 1 || sqrt(y) < 1",
+		"a - (b - c) / (d * (e + f)) - -g",
+		"(a ? b : c) ? d : (e ? f : g) + 1",
+	} {
+		expr, err := Parse(input)
+		if err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		s := Format(expr)
+		expr2, err := Parse(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(expr, expr2) {
+			t.Errorf("%s: Parse(Format) = %s, want %s", input, Format(expr2), s)
+		}
+	}
+}
+
+func TestShortCircuit(t *testing.T) {
+	calls := 0
+	Register(Function{Name: "visit", Arity: 1, Call: func(args []float64) float64 {
+		calls++
+		return args[0]
+	}})
+	defer unregister("visit")
+
+	for _, test := range []struct {
+		input string
+		want  float64
+		calls int
+	}{
+		{"1 > 2 && visit(1) > 0", 0, 0},
+		{"1 < 2 && visit(1) > 0", 1, 1},
+		{"1 < 2 || visit(1) > 0", 1, 0},
+		{"1 > 2 || visit(-1) > 0", 0, 1},
+		{"1 < 2 ? visit(3) : visit(4)", 3, 1},
+		{"1 > 2 ? visit(3) : 4", 4, 0},
+	} {
+		expr, err := Parse(test.input)
+		if err == nil {
+			err = expr.Check(map[Var]bool{})
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		calls = 0
+		if got := expr.Eval(nil); got != test.want || calls != test.calls {
+			t.Errorf("%s => %g with %d calls, want %g with %d calls",
+				test.input, got, calls, test.want, test.calls)
+		}
+	}
+}
+
+func TestOperatorErrors(t *testing.T) {
+	for _, test := range []struct{ input, wantErr string }{
+		{"x & y", "unexpected '&'"},
+		{"x = 1", "unexpected '='"},
+		{"x ? 1", "got end of file, want ':'"},
+		{"x == == 1", "unexpected '=='"},
+		{"< 1", "unexpected '<'"},
+	} {
+		_, err := Parse(test.input)
+		if err == nil {
+			t.Errorf("unexpected success: %s", test.input)
+			continue
+		}
+		if err.Error() != test.wantErr {
+			t.Errorf("%s: got error %s, want %s", test.input, err, test.wantErr)
+		}
+	}
+}
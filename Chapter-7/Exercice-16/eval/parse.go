@@ -19,10 +19,50 @@ type lexer struct {
 	token rune // current lookahead token
 }
 
-func (lex *lexer) next() { lex.token = lex.scan.Scan() }
+// Tokens of the operators made of two characters
+const (
+	equal        rune = -100 - iota // ==
+	notEqual                        // !=
+	lessEqual                       // <=
+	greaterEqual                    // >=
+	and                             // &&
+	or                              // ||
+)
+
+// twoCharOps is the token of each operator made of two characters
+var twoCharOps = map[string]rune{
+	"==": equal, "!=": notEqual, "<=": lessEqual, ">=": greaterEqual, "&&": and, "||": or,
+}
+
+// next scans the next token, merging the operators made of two characters
+func (lex *lexer) next() {
+	lex.token = lex.scan.Scan()
+	if op, ok := twoCharOps[string([]rune{lex.token, lex.scan.Peek()})]; ok {
+		lex.scan.Next() // consume the second character
+		lex.token = op
+	}
+}
 
 func (lex *lexer) text() string { return lex.scan.TokenText() }
 
+// opText returns the text of an operator token
+func opText(op rune) string {
+	for text, token := range twoCharOps {
+		if token == op {
+			return text
+		}
+	}
+	return string(op)
+}
+
+// opToken returns the token of an operator text
+func opToken(op string) rune {
+	if token, ok := twoCharOps[op]; ok {
+		return token
+	}
+	return rune(op[0])
+}
+
 type lexPanic string
 
 // describe returns a string describing the current token, for use in errors.
@@ -35,6 +75,9 @@ func (lex *lexer) describe() string {
 	case scanner.Int, scanner.Float:
 		return fmt.Sprintf("number %s", lex.text())
 	}
+	if lex.token < 0 {
+		return fmt.Sprintf("'%s'", opText(lex.token)) // operator of two characters
+	}
 	return fmt.Sprintf("%q", rune(lex.token)) // any other rune
 }
 
@@ -42,13 +85,30 @@ func (lex *lexer) describe() string {
 func precedence(op rune) int {
 	switch op {
 	case '*', '/':
-		return 2
+		return 5
 	case '+', '-':
+		return 4
+	case '<', lessEqual, equal, notEqual, greaterEqual, '>':
+		return 3
+	case and:
+		return 2
+	case or:
 		return 1
 	}
 	return 0
 }
 
+// newBinary returns the expression of a binary operator
+func newBinary(op rune, x, y Expr) Expr {
+	switch op {
+	case '+', '-', '*', '/':
+		return binary{op, x, y}
+	case and, or:
+		return logical{opText(op), x, y}
+	}
+	return comparison{opText(op), x, y}
+}
+
 // ---- parser ----
 
 // Parse parses the input string as an arithmetic expression.
@@ -56,9 +116,14 @@ func precedence(op rune) int {
 //   expr = num                         a literal number, e.g., 3.14159
 //        | id                          a variable name, e.g., x
 //        | id '(' expr ',' ... ')'     a function call
-//        | '-' expr                    a unary operator (+-)
+//        | '-' expr                    a unary operator (+-!)
 //        | expr '+' expr               a binary operator (+-*/)
+//        | expr '<' expr               a comparison (< <= == != >= >)
+//        | expr '&&' expr              a logical operator (&& ||)
+//        | expr '?' expr ':' expr      a conditional expression
 //
+// The binary operators have the precedence of Go, and the conditional
+// expression has the lowest precedence.
 func Parse(input string) (_ Expr, err error) {
 	defer func() {
 		switch x := recover().(type) {
@@ -82,7 +147,21 @@ func Parse(input string) (_ Expr, err error) {
 	return e, nil
 }
 
-func parseExpr(lex *lexer) Expr { return parseBinary(lex, 1) }
+// expr = binary ('?' expr ':' expr)?
+func parseExpr(lex *lexer) Expr {
+	cond := parseBinary(lex, 1)
+	if lex.token != '?' {
+		return cond
+	}
+	lex.next() // consume '?'
+	x := parseExpr(lex)
+	if lex.token != ':' {
+		msg := fmt.Sprintf("got %s, want ':'", lex.describe())
+		panic(lexPanic(msg))
+	}
+	lex.next() // consume ':'
+	return conditional{cond, x, parseExpr(lex)}
+}
 
 // binary = unary ('+' binary)*
 // parseBinary stops when it encounters an
@@ -94,7 +173,7 @@ func parseBinary(lex *lexer, prec1 int) Expr {
 			op := lex.token
 			lex.next() // consume operator
 			rhs := parseBinary(lex, prec+1)
-			lhs = binary{op, lhs, rhs}
+			lhs = newBinary(op, lhs, rhs)
 		}
 	}
 	return lhs
@@ -102,9 +181,9 @@ func parseBinary(lex *lexer, prec1 int) Expr {
 
 // unary = '+' expr | primary
 func parseUnary(lex *lexer) Expr {
-	if lex.token == '+' || lex.token == '-' {
+	if lex.token == '+' || lex.token == '-' || lex.token == '!' {
 		op := lex.token
-		lex.next() // consume '+' or '-'
+		lex.next() // consume '+', '-' or '!'
 		return unary{op, parseUnary(lex)}
 	}
 	return parsePrimary(lex)
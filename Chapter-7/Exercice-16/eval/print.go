@@ -9,16 +9,52 @@ import (
 )
 
 // Format formats an expression as a string.
-// It does not attempt to remove unnecessary parens.
+// It only writes the parens required by the precedence of the operators.
 func Format(e Expr) string {
 	var buf bytes.Buffer
-	write(&buf, e)
+	write(&buf, e, conditionalLevel)
 	return buf.String()
 }
 
-// write ormats an expression as a buffer.
-// It does not attempt to remove unnecessary parens.
-func write(buf *bytes.Buffer, e Expr) {
+// Precedence levels of the expressions, the binary operators being
+// between conditionalLevel and unaryLevel
+const (
+	conditionalLevel = 0
+	unaryLevel       = 6
+	primaryLevel     = 7
+)
+
+// level returns the precedence level of an expression
+func level(e Expr) int {
+	switch e := e.(type) {
+	case literal:
+		if e < 0 {
+			return unaryLevel // written with a sign
+		}
+	case unary:
+		return unaryLevel
+	case binary:
+		return precedence(e.op)
+	case comparison:
+		return precedence(opToken(e.op))
+	case logical:
+		return precedence(opToken(e.op))
+	case conditional:
+		return conditionalLevel
+	}
+	return primaryLevel
+}
+
+// write formats an expression as a buffer.
+// The expression is enclosed in parens if its level is lower than min.
+func write(buf *bytes.Buffer, e Expr, min int) {
+	if level(e) < min {
+		buf.WriteByte('(')
+		write(buf, e, conditionalLevel)
+		buf.WriteByte(')')
+		return
+	}
+
 	switch e := e.(type) {
 	case literal:
 		fmt.Fprintf(buf, "%g", e)
@@ -27,16 +63,25 @@ func write(buf *bytes.Buffer, e Expr) {
 		fmt.Fprintf(buf, "%s", e)
 
 	case unary:
-		fmt.Fprintf(buf, "(%c", e.op)
-		write(buf, e.x)
-		buf.WriteByte(')')
+		fmt.Fprintf(buf, "%c", e.op)
+		write(buf, e.x, unaryLevel)
 
 	case binary:
-		buf.WriteByte('(')
-		write(buf, e.x)
-		fmt.Fprintf(buf, " %c ", e.op)
-		write(buf, e.y)
-		buf.WriteByte(')')
+		writeOperator(buf, string(e.op), e.x, e.y)
+
+	case comparison:
+		writeOperator(buf, e.op, e.x, e.y)
+
+	case logical:
+		writeOperator(buf, e.op, e.x, e.y)
+
+	case conditional:
+		// The condition can't be a conditional, the results are right associative
+		write(buf, e.cond, conditionalLevel+1)
+		buf.WriteString(" ? ")
+		write(buf, e.x, conditionalLevel)
+		buf.WriteString(" : ")
+		write(buf, e.y, conditionalLevel)
 
 	case call:
 		fmt.Fprintf(buf, "%s(", e.fn)
@@ -44,7 +89,7 @@ func write(buf *bytes.Buffer, e Expr) {
 			if i > 0 {
 				buf.WriteString(", ")
 			}
-			write(buf, arg)
+			write(buf, arg, conditionalLevel)
 		}
 		buf.WriteByte(')')
 
@@ -52,3 +97,12 @@ func write(buf *bytes.Buffer, e Expr) {
 		panic(fmt.Sprintf("unknown Expr: %T", e))
 	}
 }
+
+// writeOperator formats a binary operator expression as a buffer.
+// The binary operators are left associative.
+func writeOperator(buf *bytes.Buffer, op string, x, y Expr) {
+	prec := precedence(opToken(op))
+	write(buf, x, prec)
+	fmt.Fprintf(buf, " %s ", op)
+	write(buf, y, prec+1)
+}
@@ -0,0 +1,229 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Simplify returns an equivalent expression where the constant expressions
+// are folded and the identities removed, e.g., x*1, x+0, pow(x, 1) or max(x).
+// The identities assume finite values, e.g., 0*x is 0, and non-zero divisors,
+// e.g., x/x is 1. The folding keeps the operations giving an infinite or NaN
+// result.
+func Simplify(e Expr) Expr {
+	switch e := e.(type) {
+	case literal, Var:
+		return e
+
+	case unary:
+		return simplifyUnary(e.op, Simplify(e.x))
+
+	case binary:
+		return simplifyBinary(e.op, Simplify(e.x), Simplify(e.y))
+
+	case comparison:
+		return comparison{e.op, Simplify(e.x), Simplify(e.y)}
+
+	case logical:
+		return simplifyLogical(e.op, Simplify(e.x), Simplify(e.y))
+
+	case conditional:
+		cond, x, y := Simplify(e.cond), Simplify(e.x), Simplify(e.y)
+		if c, ok := constant(cond); ok {
+			if c {
+				return x
+			}
+			return y
+		}
+		if reflect.DeepEqual(x, y) {
+			return x
+		}
+		return conditional{cond, x, y}
+
+	case call:
+		args := make([]Expr, len(e.args))
+		for i, arg := range e.args {
+			args[i] = Simplify(arg)
+		}
+		switch {
+		case e.fn == "pow" && len(args) == 2 && isConst(args[1], 1):
+			return args[0]
+		case e.fn == "pow" && len(args) == 2 && isConst(args[1], 0):
+			return literal(1)
+		case (e.fn == "min" || e.fn == "max") && len(args) == 1:
+			return args[0]
+		}
+		return fold(call{e.fn, args})
+	}
+	panic(fmt.Sprintf("unknown Expr: %T", e))
+}
+
+// simplifyUnary returns the simplified unary expression of simplified operands
+func simplifyUnary(op rune, x Expr) Expr {
+	switch op {
+	case '+':
+		return x
+	case '-', '!':
+		// --x is x, !!x is x
+		if u, ok := x.(unary); ok && u.op == op {
+			return u.x
+		}
+	}
+	return fold(unary{op, x})
+}
+
+// simplifyBinary returns the simplified binary expression of simplified operands
+func simplifyBinary(op rune, x, y Expr) Expr {
+	switch op {
+	case '+':
+		switch {
+		case isConst(x, 0):
+			return y
+		case isConst(y, 0):
+			return x
+		case isNegative(y):
+			return simplifyBinary('-', x, simplifyUnary('-', y))
+		case reflect.DeepEqual(x, y):
+			return simplifyBinary('*', literal(2), x)
+		}
+
+	case '-':
+		switch {
+		case isConst(x, 0):
+			return simplifyUnary('-', y)
+		case isConst(y, 0):
+			return x
+		case isNegative(y):
+			return simplifyBinary('+', x, simplifyUnary('-', y))
+		case reflect.DeepEqual(x, y):
+			return literal(0)
+		}
+
+	case '*':
+		// Constant factors are written first, e.g., 2 * x
+		if _, ok := y.(literal); ok {
+			if _, ok := x.(literal); !ok {
+				x, y = y, x
+			}
+		}
+		switch {
+		case isConst(x, 0):
+			return literal(0)
+		case isConst(x, 1):
+			return y
+		case isConst(x, -1):
+			return simplifyUnary('-', y)
+		case reflect.DeepEqual(x, y):
+			return call{"pow", []Expr{x, literal(2)}}
+		}
+		// 2 * (3 * x) is 6 * x
+		if b, ok := y.(binary); ok && b.op == '*' {
+			if _, ok := x.(literal); ok {
+				if _, ok := b.x.(literal); ok {
+					return simplifyBinary('*', fold(binary{'*', x, b.x}), b.y)
+				}
+			}
+		}
+
+	case '/':
+		switch {
+		case isConst(x, 0) && !isConst(y, 0):
+			return literal(0)
+		case isConst(y, 1):
+			return x
+		case isConst(y, -1):
+			return simplifyUnary('-', x)
+		case reflect.DeepEqual(x, y):
+			return literal(1)
+		}
+		// x / pow(x, n) is 1 / pow(x, n - 1)
+		if c, ok := y.(call); ok && c.fn == "pow" && len(c.args) == 2 && reflect.DeepEqual(x, c.args[0]) {
+			if n, ok := c.args[1].(literal); ok {
+				return simplifyBinary('/', literal(1), Simplify(call{"pow", []Expr{x, n - 1}}))
+			}
+		}
+	}
+	return fold(binary{op, x, y})
+}
+
+// simplifyLogical returns the simplified logical expression of simplified operands
+func simplifyLogical(op string, x, y Expr) Expr {
+	if c, ok := constant(x); ok {
+		if c == (op == "||") {
+			return x // false && y, true || y
+		}
+		return y // true && y, false || y
+	}
+	if c, ok := constant(y); ok && c == (op == "&&") {
+		return x // x && true, x || false
+	}
+	return logical{op, x, y}
+}
+
+// constant returns the value of a constant boolean expression. The boolean
+// expressions are not folded as literals, which would make them numbers.
+func constant(e Expr) (value, ok bool) {
+	switch e := e.(type) {
+	case comparison:
+		_, isLiteralX := e.x.(literal)
+		_, isLiteralY := e.y.(literal)
+		if isLiteralX && isLiteralY {
+			return e.Eval(nil) != 0, true
+		}
+	case unary:
+		if e.op == '!' {
+			if value, ok := constant(e.x); ok {
+				return !value, true
+			}
+		}
+	}
+	return false, false
+}
+
+// fold returns the value of a numeric expression whose operands are
+// literals, or the expression itself
+func fold(e Expr) Expr {
+	var operands []Expr
+	switch e := e.(type) {
+	case unary:
+		if e.op == '!' {
+			return e
+		}
+		operands = []Expr{e.x}
+	case binary:
+		operands = []Expr{e.x, e.y}
+	case call:
+		if _, ok := lookup(e.fn); !ok || len(e.args) == 0 {
+			return e
+		}
+		operands = e.args
+	}
+	for _, x := range operands {
+		if _, ok := x.(literal); !ok {
+			return e
+		}
+	}
+	value := e.Eval(nil)
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return e
+	}
+	return literal(value)
+}
+
+// isConst reports whether an expression is the literal value
+func isConst(e Expr, value float64) bool {
+	l, ok := e.(literal)
+	return ok && float64(l) == value
+}
+
+// isNegative reports whether an expression is a negative literal or a negation
+func isNegative(e Expr) bool {
+	switch e := e.(type) {
+	case literal:
+		return e < 0
+	case unary:
+		return e.op == '-'
+	}
+	return false
+}
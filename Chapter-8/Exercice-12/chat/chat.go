@@ -3,9 +3,13 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
 )
 
 // client data
@@ -15,25 +19,84 @@ type ClientData struct {
 	id       string        // Client's name
 }
 
-var (
-	entering = make(chan ClientData)
-	leaving  = make(chan ClientChannel)
-	messages = make(chan string) // all incoming client messages
-)
+// Server is a chat server listening on a TCP address
+type Server struct {
+	listener net.Listener
+
+	entering chan ClientData
+	leaving  chan ClientChannel
+	messages chan string   // all incoming client messages
+	done     chan struct{} // closed to stop the broadcaster
+	stopped  chan struct{} // closed when the broadcaster is stopped
+
+	mu       sync.Mutex
+	closed   bool
+	conns    map[net.Conn]bool // connections of the clients
+	handlers sync.WaitGroup    // serve and handleConn go routines
+}
+
+// Start listens on address and serves the chat until the server is closed
+func Start(address string) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		entering: make(chan ClientData),
+		leaving:  make(chan ClientChannel),
+		messages: make(chan string),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		conns:    make(map[net.Conn]bool),
+	}
+	go s.broadcaster()
+	s.handlers.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server, disconnecting its clients
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	// The broadcaster is needed by the clients to leave
+	s.handlers.Wait()
+	close(s.done)
+	<-s.stopped
+	return err
+}
 
 // broadcaster sends messages to each connected client
-func broadcaster() {
+func (s *Server) broadcaster() {
+	defer close(s.stopped)
 	clients := make(map[ClientChannel]string) // all connected clients
 	for {
 		select {
-		case msg := <-messages:
+		case msg := <-s.messages:
 			// Broadcast incoming message to all
 			// clients' outgoing message channels.
 			for client := range clients {
 				client <- msg
 			}
 
-		case clientData := <-entering:
+		case clientData := <-s.entering:
 			// Message is sent before adding the new client to the list
 			// So, he/she is not in the online list
 			for _, name := range clients {
@@ -41,31 +104,36 @@ func broadcaster() {
 			}
 			clients[clientData.outgoing] = clientData.id
 
-		case clientChannel := <-leaving:
+		case clientChannel := <-s.leaving:
 			delete(clients, clientChannel)
 			close(clientChannel)
+
+		case <-s.done:
+			return
 		}
 	}
 }
 
 // handleConn manages a connection with a user
-func handleConn(conn net.Conn) {
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.untrack(conn)
+
 	ch := make(chan string) // outgoing client messages
 	go clientWriter(conn, ch)
 
 	who := conn.RemoteAddr().String()
 	ch <- "You are " + who
-	messages <- who + " has arrived"
-	entering <- ClientData{ch, who}
+	s.messages <- who + " has arrived"
+	s.entering <- ClientData{ch, who}
 
 	input := bufio.NewScanner(conn)
 	for input.Scan() {
-		messages <- who + ": " + input.Text()
+		s.messages <- who + ": " + input.Text()
 	}
 	// NOTE: ignoring potential errors from input.Err()
 
-	leaving <- ch
-	messages <- who + " has left"
+	s.leaving <- ch
+	s.messages <- who + " has left"
 	conn.Close()
 }
 
@@ -76,20 +144,56 @@ func clientWriter(conn net.Conn, ch <-chan string) {
 	}
 }
 
-// main is the entry point of the program
-func main() {
-	listener, err := net.Listen("tcp", "localhost:8000")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	go broadcaster()
+// serve accepts the connections of the listener until it is closed
+func (s *Server) serve() {
+	defer s.handlers.Done()
 	for {
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Print(err)
 			continue
 		}
-		go handleConn(conn)
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// track registers the connection of a client, unless the server is closed
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
 	}
+	s.conns[conn] = true
+	s.handlers.Add(1)
+	return true
+}
+
+// untrack forgets the connection of a client which left
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// main is the entry point of the program
+func main() {
+	s, err := Start("localhost:8000")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Serve until interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	<-signals
+	s.Close()
 }
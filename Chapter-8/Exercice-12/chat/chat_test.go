@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"GoExercices/Chapter-8/internal/chattest"
+)
+
+// startServer serves the chat on an ephemeral port until the end of the test
+func startServer(t *testing.T) string {
+	t.Helper()
+	s, err := Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+func TestChat(t *testing.T) {
+	addr := startServer(t)
+
+	// A client receives its own messages once registered
+	alice := chattest.Dial(t, addr)
+	alice.Expect("You are " + alice.Name)
+	alice.Send("hello")
+	alice.Expect(alice.Name + ": hello")
+
+	// The connected clients are listed to the new ones
+	bob := chattest.Dial(t, addr)
+	bob.Expect("You are " + bob.Name)
+	alice.Expect(bob.Name + " has arrived")
+	bob.Expect(alice.Name + " is online")
+
+	bob.Send("hi")
+	alice.Expect(bob.Name + ": hi")
+	bob.Expect(bob.Name + ": hi")
+	alice.Send("bye")
+	alice.Expect(alice.Name + ": bye")
+	bob.Expect(alice.Name + ": bye")
+
+	bob.Close()
+	alice.Expect(bob.Name + " has left")
+}
+
+func TestClose(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := chattest.Dial(t, s.Addr().String())
+	alice.Expect("You are " + alice.Name)
+
+	// Closing the server disconnects its clients and stops listening
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	alice.ExpectClosed(chattest.Timeout)
+	if conn, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("connected to a closed server")
+	}
+}
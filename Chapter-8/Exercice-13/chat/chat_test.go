@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"GoExercices/Chapter-8/internal/chattest"
+)
+
+// startServer serves the chat on an ephemeral port until the end of the test
+func startServer(t *testing.T, idleTimeout time.Duration) string {
+	t.Helper()
+	s, err := Start("127.0.0.1:0", idleTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+func TestChat(t *testing.T) {
+	addr := startServer(t, defaultIdleTimeout)
+
+	// A client receives its own messages once registered
+	alice := chattest.Dial(t, addr)
+	alice.Expect("You are " + alice.Name)
+	alice.Send("hello")
+	alice.Expect(alice.Name + ": hello")
+
+	bob := chattest.Dial(t, addr)
+	bob.Expect("You are " + bob.Name)
+	alice.Expect(bob.Name + " has arrived")
+
+	bob.Send("hi")
+	alice.Expect(bob.Name + ": hi")
+	bob.Expect(bob.Name + ": hi")
+	alice.Send("bye")
+	alice.Expect(alice.Name + ": bye")
+	bob.Expect(alice.Name + ": bye")
+
+	bob.Close()
+	alice.Expect(bob.Name + " has left")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const idleTimeout = 500 * time.Millisecond
+	addr := startServer(t, idleTimeout)
+
+	alice := chattest.Dial(t, addr)
+	alice.Expect("You are " + alice.Name)
+	start := time.Now()
+	alice.Send("hello")
+	alice.Expect(alice.Name + ": hello")
+
+	bob := chattest.Dial(t, addr)
+	bob.Expect("You are " + bob.Name)
+	alice.Expect(bob.Name + " has arrived")
+
+	// Sending a message restarts the idle timer of bob only
+	time.Sleep(idleTimeout / 2)
+	bob.Send("still here")
+	alice.Expect(bob.Name + ": still here")
+	bob.Expect(bob.Name + ": still here")
+
+	alice.ExpectClosed(2 * idleTimeout)
+	if elapsed := time.Since(start); elapsed < idleTimeout {
+		t.Errorf("idle client disconnected after %v", elapsed)
+	}
+	bob.Expect(alice.Name + " has left")
+	bob.ExpectClosed(2 * idleTimeout)
+}
+
+func TestClose(t *testing.T) {
+	s, err := Start("127.0.0.1:0", defaultIdleTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := chattest.Dial(t, s.Addr().String())
+	alice.Expect("You are " + alice.Name)
+
+	// Closing the server disconnects its clients and stops listening
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	alice.ExpectClosed(chattest.Timeout)
+	if conn, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("connected to a closed server")
+	}
+}
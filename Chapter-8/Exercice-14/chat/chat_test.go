@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"GoExercices/Chapter-8/internal/chattest"
+)
+
+// startServer serves the chat on an ephemeral port until the end of the test
+func startServer(t *testing.T) string {
+	t.Helper()
+	s, err := Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+func TestChat(t *testing.T) {
+	addr := startServer(t)
+
+	// Empty names are asked again
+	alice := chattest.Dial(t, addr)
+	alice.Expect("Enter your name")
+	alice.Send("")
+	alice.Send("alice")
+	alice.Expect("You are alice")
+
+	// A client receives its own messages once registered
+	alice.Send("hello")
+	alice.Expect("alice: hello")
+
+	bob := chattest.Dial(t, addr)
+	bob.Expect("Enter your name")
+	bob.Send("bob")
+	bob.Expect("You are bob")
+	alice.Expect("bob has arrived")
+
+	bob.Send("hi")
+	alice.Expect("bob: hi")
+	bob.Expect("bob: hi")
+	alice.Send("bye")
+	alice.Expect("alice: bye")
+	bob.Expect("alice: bye")
+
+	bob.Close()
+	alice.Expect("bob has left")
+}
+
+func TestClose(t *testing.T) {
+	s, err := Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients are disconnected even before giving their name
+	alice := chattest.Dial(t, s.Addr().String())
+	alice.Expect("Enter your name")
+
+	// Closing the server disconnects its clients and stops listening
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	alice.ExpectClosed(chattest.Timeout)
+	if conn, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("connected to a closed server")
+	}
+}
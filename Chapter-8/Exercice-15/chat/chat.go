@@ -2,87 +2,67 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"flag"
 	"log"
-	"net"
-)
-
-type client chan<- string // outgoing message channel
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-var (
-	entering = make(chan client)
-	leaving  = make(chan client)
-	messages = make(chan string) // all incoming client messages
+	"GoExercices/Chapter-8/Exercice-15/chatserver"
 )
 
-// broadcaster sends messages to each connected client
-func broadcaster() {
-	clients := make(map[client]bool) // all connected clients
-	for {
-		select {
-		case msg := <-messages:
-			// Broadcast incoming message to all
-			// clients' outgoing message channels.
-			for client := range clients {
-				select {
-				case client <- msg:
-				default:
-				}
-			}
-
-		case cli := <-entering:
-			clients[cli] = true
-
-		case cli := <-leaving:
-			delete(clients, cli)
-			close(cli)
-		}
-	}
-}
-
-// handleConn manages a connection with a user
-func handleConn(conn net.Conn) {
-	ch := make(chan string, 20) // outgoing client messages
-	go clientWriter(conn, ch)
-
-	who := conn.RemoteAddr().String()
-	ch <- "You are " + who
-	messages <- who + " has arrived"
-	entering <- ch
+// main is the entry point of the program
+func main() {
+	// Get parameters
+	address := flag.String("address", "localhost:8000", "Listen address of the line protocol clients")
+	httpAddress := flag.String("http", "localhost:8080", "Listen address of the web clients and of the metrics (empty to disable them)")
+	ircAddress := flag.String("irc", "localhost:6667", "Listen address of the IRC clients (empty to disable them)")
+	historyFile := flag.String("history", "chat.history", "Messages history file (empty to disable the history)")
+	historySize := flag.Int64("historysize", 1024*1024, "Size of the history file triggering its compaction, in bytes")
+	replay := flag.Int("replay", 10, "Number of messages of the history sent to the clients joining a room")
+	idleTimeout := flag.Duration("idletimeout", 5*time.Minute, "Inactivity disconnecting a client (0 for no limit)")
+	slowClients := flag.String("slowclients", "drop", "Handling of the clients not reading their messages: drop, disconnect or block")
+	maxDrops := flag.Int("maxdrops", 10, "Consecutive messages dropped disconnecting a slow client (disconnect policy)")
+	blockTimeout := flag.Duration("blocktimeout", time.Second, "Maximum wait of a slow client (block policy)")
+	rate := flag.Float64("ratelimit", 5, "Messages per second allowed per client (0 for no limit)")
+	burst := flag.Int("burst", 10, "Messages allowed at once per client")
+	botNames := flag.String("bots", "dice,remind", "Comma separated bots joining the chat: dice, remind, title")
+	flag.Parse()
 
-	input := bufio.NewScanner(conn)
-	for input.Scan() {
-		messages <- who + ": " + input.Text()
+	slow, err := chatserver.ParseSlowAction(*slowClients)
+	if err != nil {
+		log.Fatal(err)
 	}
-	// NOTE: ignoring potential errors from input.Err()
-
-	leaving <- ch
-	messages <- who + " has left"
-	conn.Close()
-}
-
-// clientWriter is a go routine to send message to a user
-func clientWriter(conn net.Conn, ch <-chan string) {
-	for msg := range ch {
-		fmt.Fprintln(conn, msg) // NOTE: ignoring network errors
+	bots, err := chatserver.NewBots(*botNames)
+	if err != nil {
+		log.Fatal(err)
 	}
-}
 
-// main is the entry point of the program
-func main() {
-	listener, err := net.Listen("tcp", "localhost:8000")
+	server, err := chatserver.Start(chatserver.Config{
+		Address:      *address,
+		IRCAddress:   *ircAddress,
+		HTTPAddress:  *httpAddress,
+		HistoryFile:  *historyFile,
+		HistorySize:  *historySize,
+		Replay:       *replay,
+		IdleTimeout:  *idleTimeout,
+		SlowClients:  slow,
+		MaxDrops:     *maxDrops,
+		BlockTimeout: *blockTimeout,
+		RateLimit:    *rate,
+		Burst:        *burst,
+		Bots:         bots,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("Listening on %v", server.Addr())
 
-	go broadcaster()
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		go handleConn(conn)
-	}
+	// Stop on SIGINT or SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Print("Closing the server")
+	server.Close()
 }
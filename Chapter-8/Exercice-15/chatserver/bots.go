@@ -0,0 +1,115 @@
+package chatserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BotMessage is a message received by a bot
+type BotMessage struct {
+	Room    string // room of the message, "" for a private message
+	From    string // nickname of the sender
+	Text    string
+	Action  bool // sent with /me
+	Private bool // sent to the bot only
+}
+
+// Bot is an automated participant of the chat. It is a member of the default
+// room, and receives the messages of this room and the private messages sent
+// to it.
+type Bot interface {
+	// Nick returns the nickname of the bot
+	Nick() string
+
+	// Handle is called for each message received by the bot, one at a time.
+	// The answers are sent by reply, to the room of the message or privately
+	// to its sender. reply can be called later by other go routines.
+	Handle(msg BotMessage, reply func(text string))
+}
+
+// botFactories create the bots available, indexed by name
+var botFactories = map[string]func() Bot{
+	"dice":   func() Bot { return newDiceBot(nil) },
+	"remind": func() Bot { return newRemindBot() },
+	"title":  func() Bot { return newTitleBot(nil) },
+}
+
+// NewBots creates the bots of a comma separated list of names: dice, remind or title
+func NewBots(names string) ([]Bot, error) {
+	var bots []Bot
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := botFactories[name]
+		if !ok {
+			available := make([]string, 0, len(botFactories))
+			for name := range botFactories {
+				available = append(available, name)
+			}
+			sort.Strings(available)
+			return nil, fmt.Errorf("unknown bot: %s (available: %s)", name, strings.Join(available, ", "))
+		}
+		bots = append(bots, factory())
+	}
+	return bots, nil
+}
+
+// runBot registers a bot in the broadcaster, joins the default room and
+// passes it the messages received, up to the server is closed. It returns
+// an error if the nickname of the bot is used.
+func (s *Server) runBot(b Bot) error {
+	ch := make(chan string) // never used, identifies the bot in the broadcaster
+	events := make(chan event, outgoingSize)
+	reply := make(chan error)
+	s.entering <- registration{cli: ch, nick: b.Nick(), close: func() {}, events: events, reply: reply}
+	if err := <-reply; err != nil {
+		return fmt.Errorf("bot %s: %v", b.Nick(), err)
+	}
+	s.joining <- membership{ch, defaultRoom}
+
+	go func() {
+		for ev := range events {
+			if ev.from == b.Nick() {
+				continue
+			}
+			msg := BotMessage{Room: ev.room, From: ev.from, Text: ev.text}
+			switch ev.kind {
+			case said:
+			case acted:
+				msg.Action = true
+			case whispered:
+				msg.Private = true
+			default:
+				continue
+			}
+			b.Handle(msg, func(text string) {
+				// The replies sent once the server is closed are lost
+				if msg.Private {
+					select {
+					case s.privates <- privateMessage{ch, msg.From, text}:
+					case <-s.done:
+					}
+				} else {
+					select {
+					case s.messages <- message{from: ch, room: msg.Room, text: text}:
+					case <-s.done:
+					}
+				}
+			})
+		}
+	}()
+	return nil
+}
+
+// botCommand splits a message of the form "!command arguments", returning
+// false if the message is not a command
+func botCommand(msg BotMessage) (string, string, bool) {
+	if msg.Action || !strings.HasPrefix(msg.Text, "!") {
+		return "", "", false
+	}
+	name, arg, _ := strings.Cut(strings.TrimSpace(msg.Text[1:]), " ")
+	return strings.ToLower(name), strings.TrimSpace(arg), true
+}
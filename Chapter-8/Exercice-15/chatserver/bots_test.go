@@ -0,0 +1,269 @@
+package chatserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeClient is a line protocol client connected through net.Pipe
+type pipeClient struct {
+	conn  net.Conn
+	lines chan string
+}
+
+// dialPipe connects a client to an in-memory connection of a server and
+// chooses its nickname
+func dialPipe(t *testing.T, s *Server, nick string) *pipeClient {
+	t.Helper()
+	server, conn := net.Pipe()
+	go s.handleConn(server)
+
+	c := &pipeClient{conn: conn, lines: make(chan string, 100)}
+	go func() {
+		input := bufio.NewScanner(conn)
+		for input.Scan() {
+			c.lines <- input.Text()
+		}
+		close(c.lines)
+	}()
+	t.Cleanup(func() { conn.Close() })
+
+	c.waitFor(t, "Enter your nickname")
+	c.send(t, nick)
+	c.waitFor(t, "You joined "+defaultRoom)
+	return c
+}
+
+// send sends a line
+func (c *pipeClient) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := fmt.Fprintln(c.conn, line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor reads lines up to one starting with prefix, and returns it
+func (c *pipeClient) waitFor(t *testing.T, prefix string) string {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				t.Fatalf("connection closed waiting for %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %q", prefix)
+		}
+	}
+}
+
+func TestDiceBot(t *testing.T) {
+	s := startTestServer(t, Config{Bots: []Bot{newDiceBot(rand.New(rand.NewSource(1)))}})
+	expected := rand.New(rand.NewSource(1))
+	alice := dialPipe(t, s, "alice")
+
+	alice.send(t, "!roll 2d6+1")
+	a, b := expected.Intn(6)+1, expected.Intn(6)+1
+	want := fmt.Sprintf("dicebot: alice rolls 2d6+1: %d + %d + 1 = %d", a, b, a+b+1)
+	if got := alice.waitFor(t, "dicebot: "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Private messages are answered privately
+	alice.send(t, "/msg dicebot !roll d20")
+	want = fmt.Sprintf("*dicebot* alice rolls d20: %d", expected.Intn(20)+1)
+	if got := alice.waitFor(t, "*dicebot* "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	alice.send(t, "!roll 1000d6")
+	if got := alice.waitFor(t, "dicebot: "); got != "dicebot: alice: between 1 and 100 dice of 2 to 1000 faces please" {
+		t.Errorf("got %q", got)
+	}
+	alice.send(t, "!roll many")
+	if got := alice.waitFor(t, "dicebot: "); !strings.HasPrefix(got, "dicebot: alice: usage: ") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBotsNotRateLimited(t *testing.T) {
+	s := startTestServer(t, Config{
+		HTTPAddress: "127.0.0.1:0",
+		RateLimit:   1,
+		Burst:       2,
+		Bots:        []Bot{newDiceBot(rand.New(rand.NewSource(1)))},
+	})
+	alice := dialPipe(t, s, "alice")
+	bob := dialPipe(t, s, "bob")
+	carol := dialPipe(t, s, "carol")
+
+	// The users stay under their limit, the bot answers more than the burst
+	for _, c := range []*pipeClient{alice, bob, carol} {
+		c.send(t, "!roll d6")
+		c.send(t, "!roll d6")
+	}
+	for i := 0; i < 6; i++ {
+		if got := alice.waitFor(t, "dicebot: "); !strings.Contains(got, " rolls d6: ") {
+			t.Errorf("got %q", got)
+		}
+	}
+
+	// Only the messages of the users are counted
+	resp, err := http.Get("http://" + s.HTTPAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\nchat_messages_total 6\n", "\nchat_rate_limited_messages_total 0\n"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestRemindBot(t *testing.T) {
+	s := startTestServer(t, Config{Bots: []Bot{newRemindBot()}})
+	bob := dialPipe(t, s, "bob")
+
+	start := time.Now()
+	bob.send(t, "!remind 100ms stretch")
+	if got := bob.waitFor(t, "remindbot: "); got != "remindbot: bob: I will remind you in 100ms" {
+		t.Errorf("got %q", got)
+	}
+	if got := bob.waitFor(t, "remindbot: "); got != "remindbot: bob: reminder: stretch" {
+		t.Errorf("got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("reminder sent after %v", elapsed)
+	}
+
+	bob.send(t, "!remind 48h later")
+	if got := bob.waitFor(t, "remindbot: "); got != "remindbot: bob: reminders are limited to 24h" {
+		t.Errorf("got %q", got)
+	}
+
+	// The pending reminders are limited per user
+	for i := 0; i < maxUserReminders; i++ {
+		bob.send(t, "!remind 1h later")
+		if got := bob.waitFor(t, "remindbot: "); got != "remindbot: bob: I will remind you in 1h0m0s" {
+			t.Errorf("got %q", got)
+		}
+	}
+	bob.send(t, "!remind 1h later")
+	if got := bob.waitFor(t, "remindbot: "); got != "remindbot: bob: too many pending reminders, try later" {
+		t.Errorf("got %q", got)
+	}
+	alice := dialPipe(t, s, "alice")
+	alice.send(t, "!remind 1h later")
+	if got := alice.waitFor(t, "remindbot: alice"); got != "remindbot: alice: I will remind you in 1h0m0s" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTitleBot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html><head><title>\n  The Go\n Programming Language </title></head><body>Go</body></html>")
+	}))
+	defer server.Close()
+
+	s := startTestServer(t, Config{Bots: []Bot{newTitleBot(server.Client())}})
+	carol := dialPipe(t, s, "carol")
+	carol.send(t, "look at "+server.URL+"/doc")
+	if got := carol.waitFor(t, "titlebot: "); got != "titlebot: Title: The Go Programming Language" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTitleBotPublicAddresses(t *testing.T) {
+	redirections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			redirections++
+			http.Redirect(w, r, "/loop", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>Internal</title>")
+	}))
+	defer server.Close()
+
+	// The default client doesn't reach the loopback server
+	if title := newTitleBot(nil).fetchTitle(server.URL); title != "" {
+		t.Errorf("fetched %q from a loopback address", title)
+	}
+
+	// The redirections are limited
+	client := server.Client()
+	client.CheckRedirect = checkRedirect
+	if title := newTitleBot(client).fetchTitle(server.URL + "/loop"); title != "" || redirections != maxRedirects+1 {
+		t.Errorf("fetched %q after %d redirections", title, redirections)
+	}
+
+	for _, test := range []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"64:ff9b::a00:1", false},
+	} {
+		if got := isPublic(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("isPublic(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestFindTitle(t *testing.T) {
+	tests := []struct {
+		page, title string
+	}{
+		{"<title>Simple</title>", "Simple"},
+		{"<html><head><title>A &amp; B</title>", "A & B"},
+		{"<html><body>No title</body></html>", ""},
+		{"<title>" + strings.Repeat("x", 300) + "</title>", strings.Repeat("x", maxTitleLength) + "..."},
+	}
+	for _, test := range tests {
+		if got := findTitle(strings.NewReader(test.page)); got != test.title {
+			t.Errorf("findTitle(%q) = %q, want %q", test.page, got, test.title)
+		}
+	}
+}
+
+func TestNewBots(t *testing.T) {
+	bots, err := NewBots("dice, remind,title")
+	if err != nil || len(bots) != 3 {
+		t.Errorf("NewBots returned %v, %v", bots, err)
+	}
+	if _, err := NewBots("dice,chess"); err == nil {
+		t.Error("NewBots(dice,chess) succeeded")
+	}
+}
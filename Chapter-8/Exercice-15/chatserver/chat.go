@@ -0,0 +1,539 @@
+package chatserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type client chan<- string // outgoing message channel
+
+// defaultRoom is the room joined by the clients when they arrive
+const defaultRoom = "lobby"
+
+// outgoingSize is the number of messages buffered for a client
+const outgoingSize = 20
+
+// writerTimeout is the time allowed to send the last messages of a leaving client
+const writerTimeout = time.Second
+
+// registration is a request to use a nickname, answered through reply
+type registration struct {
+	cli    client
+	nick   string
+	format formatter    // protocol of the client (only used when entering)
+	close  func()       // closes the connection of the client (only used when entering)
+	events chan<- event // receives the events instead of cli for the bots (only used when entering)
+	reply  chan<- error // nil if the nickname is granted
+}
+
+// membership is a request to join or leave a room
+type membership struct {
+	cli  client
+	room string
+}
+
+// message is a message sent to the members of a room
+type message struct {
+	from   client
+	room   string
+	text   string
+	action bool // sent with /me
+}
+
+// privateMessage is a message sent to a single user
+type privateMessage struct {
+	from client
+	to   string // nickname of the recipient
+	text string
+}
+
+// ignoring is a request to ignore, or stop ignoring, the messages of a user
+type ignoring struct {
+	cli    client
+	nick   string // nickname of the ignored user, "" to list them
+	ignore bool
+}
+
+// historyRequest is a request of the last n messages of a room
+type historyRequest struct {
+	cli  client
+	room string
+	n    int
+}
+
+// errNickInUse is returned when the nickname is used by another client
+var errNickInUse = errors.New("nickname already in use")
+
+// member is the state of a connected client
+type member struct {
+	nick    string
+	format  formatter
+	close   func()
+	events  chan<- event    // nil unless the client is a bot
+	rooms   map[string]bool // rooms joined by the client
+	ignored map[client]bool // users whose messages are not delivered to the client
+	drops   int             // consecutive messages not delivered
+	kicked  bool            // disconnected as too slow, waiting for its handler to leave
+	bucket  bucket          // rate limit of the messages sent
+}
+
+// broadcaster sends messages to the members of the rooms, up to the server
+// is closed. It owns the nicknames, so that they are unique, the rooms
+// membership and the history (nil if disabled), replaying its last messages
+// to the clients joining a room. The slow clients are handled according to
+// the slow client policy, and the messages of the users rate limited.
+func (s *Server) broadcaster() {
+	defer close(s.stopped)
+	hist, replay, slow, limit := s.history, s.config.Replay, s.slow, s.limit
+
+	clients := make(map[client]*member)       // all connected clients
+	nicks := make(map[string]client)          // clients indexed by lower case nickname
+	rooms := make(map[string]map[client]bool) // members of the non empty rooms
+	var counters stats
+	var rates rateCounter
+
+	// send sends an event, formatted for the client, to its outgoing message
+	// channel. It returns false if the channel is full, applying the slow
+	// client policy.
+	send := func(cli client, ev event) bool {
+		m := clients[cli]
+		if m.events != nil {
+			select {
+			case m.events <- ev:
+				return true
+			default:
+				counters.drops++
+				return false
+			}
+		}
+		msg := m.format(m.nick, ev)
+		if msg == "" || m.kicked {
+			return true
+		}
+		select {
+		case cli <- msg:
+			m.drops = 0
+			return true
+		default:
+		}
+
+		if slow.action == BlockSending {
+			timer := time.NewTimer(slow.timeout)
+			select {
+			case cli <- msg:
+				timer.Stop()
+				m.drops = 0
+				return true
+			case <-timer.C:
+			}
+		}
+		counters.drops++
+		m.drops++
+		if slow.action == Disconnect && m.drops >= slow.maxDrops {
+			// The handler leaves once the connection is closed
+			log.Printf("disconnecting %s: too many messages dropped", m.nick)
+			counters.disconnects++
+			m.kicked = true
+			m.close()
+		}
+		return false
+	}
+
+	// allow applies the rate limit to a message of a user, telling it when
+	// refused. The replies of the bots are neither limited nor counted as
+	// messages received from the clients.
+	allow := func(cli client) bool {
+		if clients[cli].events != nil {
+			return true
+		}
+		now := time.Now()
+		if !limit.allow(&clients[cli].bucket, now) {
+			counters.rateLimited++
+			send(cli, event{kind: notice, text: "You are sending messages too fast, message not sent"})
+			return false
+		}
+		counters.messages++
+		rates.add(now)
+		return true
+	}
+
+	// deliver sends an event caused by a user (nil for the server) to a client,
+	// unless the user is ignored, and reports a full channel to the sender
+	deliver := func(from, to client, ev event) {
+		if from != nil && clients[to].ignored[from] {
+			return
+		}
+		if !send(to, ev) && from != nil && from != to {
+			send(from, event{kind: notice, text: "Message not delivered to " + clients[to].nick + ": too many pending messages"})
+		}
+	}
+
+	// broadcast sends an event to all the members of a room
+	broadcast := func(from client, room string, ev event) {
+		for cli := range rooms[room] {
+			deliver(from, cli, ev)
+		}
+	}
+
+	// broadcastPeers sends an event to a client and to the members of its rooms
+	// (once per client, even if they share several rooms)
+	broadcastPeers := func(cli client, ev event) {
+		peers := map[client]bool{cli: true}
+		for room := range clients[cli].rooms {
+			for peer := range rooms[room] {
+				peers[peer] = true
+			}
+		}
+		for peer := range peers {
+			send(peer, ev)
+		}
+	}
+
+	// sendHistory sends the last n messages of a room to a client, as a
+	// single message so that they don't fill its outgoing channel
+	sendHistory := func(cli client, room string, n int) {
+		entries := hist.last(room, n)
+		if len(entries) == 0 {
+			return
+		}
+		lines := make([]string, len(entries))
+		for i, e := range entries {
+			lines[i] = e.String()
+		}
+		send(cli, event{kind: replayed, room: room, lines: lines})
+	}
+
+	// part removes a client from a room, deleting the room once empty
+	part := func(cli client, room string) {
+		delete(clients[cli].rooms, room)
+		delete(rooms[room], cli)
+		if len(rooms[room]) == 0 {
+			delete(rooms, room)
+		}
+	}
+
+	for {
+		select {
+		case <-s.done:
+			// Stop the bots
+			for _, m := range clients {
+				if m.events != nil {
+					close(m.events)
+				}
+			}
+			return
+
+		case msg := <-s.messages:
+			m := clients[msg.from]
+			if !allow(msg.from) {
+				continue
+			}
+			if !m.rooms[msg.room] {
+				send(msg.from, event{kind: notInRoom, room: msg.room})
+				continue
+			}
+			kind := said
+			if msg.action {
+				kind = acted
+			}
+			text := cleanText(msg.text)
+			broadcast(msg.from, msg.room, event{kind: kind, from: m.nick, room: msg.room, text: text})
+			hist.add(historyEntry{
+				Time:   time.Now().UTC(),
+				Room:   msg.room,
+				From:   m.nick,
+				Text:   text,
+				Action: msg.action,
+			})
+
+		case req := <-s.histories:
+			if hist == nil {
+				send(req.cli, event{kind: notice, text: "History is disabled"})
+				continue
+			}
+			sendHistory(req.cli, req.room, req.n)
+
+		case msg := <-s.privates:
+			if !allow(msg.from) {
+				continue
+			}
+			to, ok := nicks[strings.ToLower(msg.to)]
+			if !ok {
+				send(msg.from, event{kind: noSuchNick, text: msg.to})
+				continue
+			}
+			deliver(msg.from, to, event{kind: whispered, from: clients[msg.from].nick, text: cleanText(msg.text)})
+
+		case req := <-s.ignores:
+			m := clients[req.cli]
+			if req.nick == "" {
+				names := make([]string, 0, len(m.ignored))
+				for cli := range m.ignored {
+					names = append(names, clients[cli].nick)
+				}
+				sort.Strings(names)
+				send(req.cli, event{kind: notice, text: "Ignored users: " + strings.Join(names, ", ")})
+				continue
+			}
+			other, ok := nicks[strings.ToLower(req.nick)]
+			switch {
+			case !ok:
+				send(req.cli, event{kind: noSuchNick, text: req.nick})
+			case other == req.cli:
+				send(req.cli, event{kind: notice, text: "You can't ignore yourself"})
+			case req.ignore:
+				m.ignored[other] = true
+				send(req.cli, event{kind: notice, text: "Ignoring " + clients[other].nick})
+			default:
+				delete(m.ignored, other)
+				send(req.cli, event{kind: notice, text: "No longer ignoring " + clients[other].nick})
+			}
+
+		case reg := <-s.entering:
+			if _, used := nicks[strings.ToLower(reg.nick)]; used {
+				reg.reply <- errNickInUse
+				continue
+			}
+			reg.reply <- nil
+			clients[reg.cli] = &member{
+				nick:    reg.nick,
+				format:  reg.format,
+				close:   reg.close,
+				events:  reg.events,
+				rooms:   make(map[string]bool),
+				ignored: make(map[client]bool),
+			}
+			nicks[strings.ToLower(reg.nick)] = reg.cli
+			send(reg.cli, event{kind: welcomed, text: reg.nick})
+
+		case reg := <-s.renaming:
+			m := clients[reg.cli]
+			if other, used := nicks[strings.ToLower(reg.nick)]; used && other != reg.cli {
+				reg.reply <- errNickInUse
+				continue
+			}
+			reg.reply <- nil
+			oldNick := m.nick
+			delete(nicks, strings.ToLower(oldNick))
+			m.nick = reg.nick
+			nicks[strings.ToLower(reg.nick)] = reg.cli
+			broadcastPeers(reg.cli, event{kind: renamed, from: oldNick, text: reg.nick})
+
+		case cli := <-s.listing:
+			names := make([]string, 0, len(clients))
+			for _, m := range clients {
+				names = append(names, m.nick)
+			}
+			sort.Strings(names)
+			send(cli, event{kind: notice, text: "Connected users: " + strings.Join(names, ", ")})
+
+		case req := <-s.joining:
+			m := clients[req.cli]
+			if m.rooms[req.room] {
+				continue
+			}
+			if rooms[req.room] == nil {
+				rooms[req.room] = make(map[client]bool)
+			}
+			broadcast(nil, req.room, event{kind: joined, from: m.nick, room: req.room})
+			rooms[req.room][req.cli] = true
+			m.rooms[req.room] = true
+
+			names := make([]string, 0, len(rooms[req.room]))
+			for cli := range rooms[req.room] {
+				names = append(names, clients[cli].nick)
+			}
+			sort.Strings(names)
+			send(req.cli, event{kind: joined, from: m.nick, room: req.room, names: names})
+			sendHistory(req.cli, req.room, replay)
+
+		case req := <-s.parting:
+			m := clients[req.cli]
+			if !m.rooms[req.room] {
+				send(req.cli, event{kind: notInRoom, room: req.room})
+				continue
+			}
+			part(req.cli, req.room)
+			ev := event{kind: parted, from: m.nick, room: req.room}
+			send(req.cli, ev)
+			broadcast(nil, req.room, ev)
+
+		case cli := <-s.roomsListing:
+			names := make([]string, 0, len(rooms))
+			for room := range rooms {
+				names = append(names, fmt.Sprintf("%s (%d)", room, len(rooms[room])))
+			}
+			sort.Strings(names)
+			send(cli, event{kind: notice, text: "Rooms: " + strings.Join(names, ", ")})
+
+		case reply := <-s.statsRequests:
+			counters.clients = len(clients)
+			counters.rooms = len(rooms)
+			counters.rate = rates.rate(time.Now())
+			reply <- counters
+
+		case cli := <-s.leaving:
+			m := clients[cli]
+			broadcastPeers(cli, event{kind: quit, from: m.nick})
+			for room := range m.rooms {
+				part(cli, room)
+			}
+			delete(nicks, strings.ToLower(m.nick))
+			delete(clients, cli)
+			for _, other := range clients {
+				delete(other.ignored, cli)
+			}
+			close(cli)
+		}
+	}
+}
+
+// handleConn manages a connection with a user
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	ch := make(chan string, outgoingSize) // outgoing client messages
+	written := make(chan struct{})
+	go clientWriter(conn, ch, written)
+	defer waitWriter(written)
+
+	timer, done := s.startIdleTimer(conn)
+	defer close(done)
+	input := bufio.NewScanner(conn)
+
+	// Get a nickname not used by another client
+	who, ok := s.chooseNick(ch, input, timer, func() { conn.Close() })
+	if !ok {
+		close(ch)
+		return
+	}
+
+	// Enter the default room
+	sess := &session{server: s, ch: ch, nick: who, room: defaultRoom}
+	s.joining <- membership{ch, defaultRoom}
+
+	for input.Scan() {
+		s.resetIdleTimer(timer)
+		line := cleanText(input.Text())
+		if strings.HasPrefix(line, "/") {
+			if !sess.runCommand(line) {
+				break
+			}
+			continue
+		}
+		s.messages <- message{from: ch, room: sess.room, text: line}
+	}
+	// NOTE: ignoring potential errors from input.Err()
+
+	s.leaving <- ch
+}
+
+// session is the state of a line protocol client
+type session struct {
+	server *Server
+	ch     client
+	nick   string
+	room   string // current room, receiving the messages typed by the user
+}
+
+// chooseNick asks the user a nickname up to the broadcaster grants it.
+// It returns false if the connection is closed before.
+func (s *Server) chooseNick(ch client, input *bufio.Scanner, timer *time.Timer, close func()) (string, bool) {
+	for {
+		ch <- "Enter your nickname"
+		if !input.Scan() {
+			return "", false
+		}
+		s.resetIdleTimer(timer)
+		nick := strings.TrimSpace(input.Text())
+		if err := checkNick(nick); err != nil {
+			ch <- "Invalid nickname: " + err.Error()
+			continue
+		}
+
+		reply := make(chan error)
+		s.entering <- registration{cli: ch, nick: nick, format: formatLine, close: close, reply: reply}
+		if err := <-reply; err != nil {
+			ch <- "Nickname " + nick + " is already in use"
+			continue
+		}
+		return nick, true
+	}
+}
+
+// checkNick returns an error if the nickname is not valid
+func checkNick(nick string) error {
+	switch {
+	case nick == "":
+		return errors.New("empty nickname")
+	case len(nick) > 20:
+		return errors.New("more than 20 characters")
+	case strings.HasPrefix(nick, "/"):
+		return errors.New("starting with /")
+	case strings.IndexFunc(nick, unicode.IsControl) >= 0:
+		return errors.New("containing control characters")
+	case strings.IndexFunc(nick, unicode.IsSpace) >= 0 || strings.ContainsAny(nick, ",:"):
+		return errors.New("containing spaces, commas or colons")
+	}
+	return nil
+}
+
+// cleanText removes the control characters of a text sent by a user, so that
+// it can't forge lines of the protocols (the tabs become spaces)
+func cleanText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// roomName normalizes a room name (lower case, without leading '#')
+func roomName(name string) (string, error) {
+	room := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	switch {
+	case room == "":
+		return "", errors.New("empty room name")
+	case len(room) > 30:
+		return "", errors.New("more than 30 characters")
+	case strings.ContainsAny(room, " \t,:#"):
+		return "", errors.New("containing spaces, commas, colons or #")
+	}
+	return room, nil
+}
+
+// clientWriter is a go routine to send message to a user.
+// It closes written once ch is closed and its messages sent.
+func clientWriter(conn net.Conn, ch <-chan string, written chan<- struct{}) {
+	for msg := range ch {
+		fmt.Fprintln(conn, msg) // NOTE: ignoring network errors
+	}
+	close(written)
+}
+
+// waitWriter waits for the writer of a client to send its last messages
+// before closing the connection, up to writerTimeout if the client doesn't
+// read them
+func waitWriter(written <-chan struct{}) {
+	timer := time.NewTimer(writerTimeout)
+	defer timer.Stop()
+	select {
+	case <-written:
+	case <-timer.C:
+	}
+}
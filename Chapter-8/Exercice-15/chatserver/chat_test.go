@@ -0,0 +1,77 @@
+package chatserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckNick(t *testing.T) {
+	for _, test := range []struct {
+		nick  string
+		valid bool
+	}{
+		{"alice", true},
+		{"Bob_2", true},
+		{"élodie", true},
+		{"", false},
+		{strings.Repeat("x", 21), false},
+		{"/nick", false},
+		{"a b", false},
+		{"a\tb", false},
+		{"a b", false},
+		{"a,b", false},
+		{"a:b", false},
+		{"a\rb", false},
+		{"evil\r\n:x", false},
+		{"a\x00b", false},
+		{"a\x1bb", false},
+		{"a\x7fb", false},
+	} {
+		if err := checkNick(test.nick); (err == nil) != test.valid {
+			t.Errorf("checkNick(%q) = %v, want valid %v", test.nick, err, test.valid)
+		}
+	}
+}
+
+func TestCleanText(t *testing.T) {
+	for _, test := range []struct {
+		text, want string
+	}{
+		{"hello", "hello"},
+		{"a\tb", "a b"},
+		{"hi\r:evil PRIVMSG #x :owned", "hi:evil PRIVMSG #x :owned"},
+		{"line\nbreak", "linebreak"},
+		{"\x01ACTION\x01 \x1b[2Jbell\x07\x00\x7f", "ACTION [2Jbell"},
+		{"héllo ☺", "héllo ☺"},
+	} {
+		if got := cleanText(test.text); got != test.want {
+			t.Errorf("cleanText(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestNickControlCharacters(t *testing.T) {
+	s := startTestServer(t, Config{})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	input := bufio.NewScanner(conn)
+
+	// A carriage return can't forge a line of the IRC clients
+	fmt.Fprint(conn, "evil\r:x NICK y\r\n")
+	for _, want := range []string{"Enter your nickname", "Invalid nickname: containing control characters", "Enter your nickname"} {
+		if !input.Scan() {
+			t.Fatalf("connection closed waiting for %q (%v)", want, input.Err())
+		}
+		if got := input.Text(); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
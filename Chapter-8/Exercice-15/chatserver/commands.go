@@ -0,0 +1,107 @@
+package chatserver
+
+import (
+	"strconv"
+	"strings"
+)
+
+// runCommand runs a slash command typed by the user. The replies are only
+// sent to the user. It returns false if the user quits.
+func (sess *session) runCommand(line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	ch := sess.ch
+
+	switch strings.ToLower(name) {
+	case "/nick":
+		// Change the nickname (the broadcaster checks it is unique)
+		if err := checkNick(arg); err != nil {
+			ch <- "Invalid nickname: " + err.Error()
+			break
+		}
+		reply := make(chan error)
+		sess.server.renaming <- registration{cli: ch, nick: arg, reply: reply}
+		if err := <-reply; err != nil {
+			ch <- "Nickname " + arg + " is already in use"
+			break
+		}
+		sess.nick = arg
+
+	case "/who":
+		sess.server.listing <- ch
+
+	case "/me":
+		if arg == "" {
+			ch <- "Usage: /me <action>"
+			break
+		}
+		sess.server.messages <- message{ch, sess.room, arg, true}
+
+	case "/msg":
+		// Send a message to a single user
+		nick, text, _ := strings.Cut(arg, " ")
+		text = strings.TrimSpace(text)
+		if nick == "" || text == "" {
+			ch <- "Usage: /msg <nickname> <text>"
+			break
+		}
+		sess.server.privates <- privateMessage{ch, nick, text}
+
+	case "/ignore":
+		sess.server.ignores <- ignoring{ch, arg, true}
+
+	case "/unignore":
+		if arg == "" {
+			ch <- "Usage: /unignore <nickname>"
+			break
+		}
+		sess.server.ignores <- ignoring{ch, arg, false}
+
+	case "/join":
+		// Leave the current room for another one
+		room, err := roomName(arg)
+		if err != nil {
+			ch <- "Invalid room: " + err.Error()
+			break
+		}
+		if room == sess.room {
+			ch <- "You are already in " + room
+			break
+		}
+		sess.server.parting <- membership{ch, sess.room}
+		sess.server.joining <- membership{ch, room}
+		sess.room = room
+
+	case "/part":
+		// Go back to the default room
+		if sess.room == defaultRoom {
+			ch <- "You can't leave " + defaultRoom
+			break
+		}
+		sess.server.parting <- membership{ch, sess.room}
+		sess.server.joining <- membership{ch, defaultRoom}
+		sess.room = defaultRoom
+
+	case "/history":
+		// Replay the last messages of the current room
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			ch <- "Usage: /history <count>"
+			break
+		}
+		sess.server.histories <- historyRequest{ch, sess.room, n}
+
+	case "/rooms":
+		sess.server.roomsListing <- ch
+
+	case "/quit":
+		return false
+
+	case "/help":
+		ch <- "Commands: /nick <nickname>, /who, /me <action>, /msg <nickname> <text>, /ignore [nickname], /unignore <nickname>, /join <room>, /part, /rooms, /history <count>, /quit"
+
+	default:
+		ch <- "Unknown command: " + name + " (type /help)"
+	}
+	return true
+}
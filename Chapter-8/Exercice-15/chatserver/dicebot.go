@@ -0,0 +1,86 @@
+package chatserver
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diceBot rolls dice: "!roll 2d6", "!roll d20+3"
+type diceBot struct {
+	rand *rand.Rand
+}
+
+// diceExpr matches the dice expressions: count, faces and modifier
+var diceExpr = regexp.MustCompile(`^(\d*)d(\d+)([+-]\d+)?$`)
+
+// newDiceBot returns a dice bot using r, or a time seeded generator if nil
+func newDiceBot(r *rand.Rand) *diceBot {
+	if r == nil {
+		r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &diceBot{rand: r}
+}
+
+// Nick returns the nickname of the bot
+func (b *diceBot) Nick() string {
+	return "dicebot"
+}
+
+// Handle rolls the dice of the !roll commands
+func (b *diceBot) Handle(msg BotMessage, reply func(string)) {
+	name, arg, ok := botCommand(msg)
+	if !ok || name != "roll" {
+		return
+	}
+	result, err := b.roll(strings.ToLower(arg))
+	if err != nil {
+		reply(msg.From + ": " + err.Error())
+		return
+	}
+	reply(msg.From + " rolls " + arg + ": " + result)
+}
+
+// roll rolls the dice of an expression and returns the details of the result
+func (b *diceBot) roll(expr string) (string, error) {
+	match := diceExpr.FindStringSubmatch(expr)
+	if match == nil {
+		return "", fmt.Errorf("usage: !roll [count]d<faces>[+modifier], e.g. !roll 2d6")
+	}
+	count := 1
+	if match[1] != "" {
+		count, _ = strconv.Atoi(match[1])
+	}
+	faces, _ := strconv.Atoi(match[2])
+	modifier, _ := strconv.Atoi(match[3])
+	if count < 1 || count > 100 || faces < 2 || faces > 1000 {
+		return "", fmt.Errorf("between 1 and 100 dice of 2 to 1000 faces please")
+	}
+
+	total := modifier
+	rolls := make([]string, count)
+	for i := range rolls {
+		n := b.rand.Intn(faces) + 1
+		total += n
+		rolls[i] = strconv.Itoa(n)
+	}
+	result := strings.Join(rolls, " + ")
+	if modifier != 0 {
+		result += fmt.Sprintf(" %s %d", match[3][:1], abs(modifier))
+	}
+	if count > 1 || modifier != 0 {
+		result += " = " + strconv.Itoa(total)
+	}
+	return result, nil
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,71 @@
+package chatserver
+
+import "strings"
+
+// eventKind is the kind of an event sent by the broadcaster to a client
+type eventKind int
+
+const (
+	welcomed   eventKind = iota // the nickname (text) is granted
+	said                        // from said text in room
+	acted                       // from did text in room (/me)
+	whispered                   // from sent text to the client only
+	joined                      // from joined room, with the members names
+	parted                      // from left room
+	quit                        // from disconnected
+	renamed                     // from is now known as text
+	replayed                    // lines are the last entries of the history of room
+	noSuchNick                  // no user is named text
+	notInRoom                   // the client is not a member of room
+	notice                      // text is a message of the server
+)
+
+// event is something happening to a client, such as a message of another user.
+// The clients format the events according to their protocol.
+type event struct {
+	kind  eventKind
+	from  string // nickname of the user originating the event
+	room  string
+	text  string
+	names []string // members of the room joined
+	lines []string // entries of the history replayed
+}
+
+// formatter formats an event for the protocol of a client, nick being the
+// nickname of the client. It returns "" if the event is not sent to the client.
+type formatter func(nick string, ev event) string
+
+// formatLine formats an event for the line protocol
+func formatLine(nick string, ev event) string {
+	switch ev.kind {
+	case welcomed:
+		return "You are " + ev.text
+	case said:
+		return ev.from + ": " + ev.text
+	case acted:
+		return "* " + ev.from + " " + ev.text
+	case whispered:
+		return "*" + ev.from + "* " + ev.text
+	case joined:
+		if ev.from == nick {
+			return "You joined " + ev.room + " with " + strings.Join(ev.names, ", ")
+		}
+		return ev.from + " has joined " + ev.room
+	case parted:
+		if ev.from == nick {
+			return "" // the client has already switched to another room
+		}
+		return ev.from + " has left " + ev.room
+	case quit:
+		return ev.from + " has left"
+	case renamed:
+		return ev.from + " is now known as " + ev.text
+	case noSuchNick:
+		return "No such user: " + ev.text
+	case notInRoom:
+		return "You are not in " + ev.room
+	case replayed:
+		return strings.Join(ev.lines, "\n")
+	}
+	return ev.text
+}
@@ -0,0 +1,197 @@
+package chatserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// historyEntry is a message sent to a room, stored as a JSON line in the history file
+type historyEntry struct {
+	Time   time.Time `json:"time"`
+	Room   string    `json:"room"`
+	From   string    `json:"from"` // nickname of the sender
+	Text   string    `json:"text"`
+	Action bool      `json:"action,omitempty"` // sent with /me
+	size   int64     // length of the line in the file
+}
+
+// String formats an entry as sent to the clients
+func (e historyEntry) String() string {
+	prefix := "[" + e.Time.Local().Format("Jan 2 15:04") + "] "
+	if e.Action {
+		return prefix + "* " + e.From + " " + e.Text
+	}
+	return prefix + e.From + ": " + e.Text
+}
+
+// history is an append-only log of the messages sent to the rooms. Once the
+// log is larger than maxSize, it is compacted to the most recent half.
+// It is owned by the broadcaster, so it is not safe for concurrent use.
+type history struct {
+	fileName string
+	file     *os.File // opened in append mode
+	size     int64    // size of the file
+	maxSize  int64
+	entries  []historyEntry // all the entries of the file, the most recent last
+}
+
+// openHistory loads the history file, creating it if needed
+func openHistory(fileName string, maxSize int64) (*history, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("invalid history size")
+	}
+	h := &history{fileName: fileName, maxSize: maxSize}
+
+	file, err := os.Open(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	invalid := false
+	if err == nil {
+		input := bufio.NewScanner(file)
+		input.Buffer(nil, 1024*1024)
+		for input.Scan() {
+			var e historyEntry
+			if err := json.Unmarshal(input.Bytes(), &e); err != nil {
+				log.Printf("history: skipping invalid line: %v", err)
+				invalid = true
+				continue
+			}
+			e.size = int64(len(input.Bytes()) + 1)
+			h.entries = append(h.entries, e)
+			h.size += e.size
+		}
+		err = input.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Rewrite the file if it is too large, or without its invalid lines
+	if h.size > maxSize || invalid {
+		limit := maxSize
+		if h.size > maxSize {
+			limit = maxSize / 2
+		}
+		if err := h.compact(limit); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	h.file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// add appends an entry to the log. A nil history stores nothing.
+func (h *history) add(e historyEntry) {
+	if h == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	if _, err := h.file.Write(line); err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	e.size = int64(len(line))
+	h.entries = append(h.entries, e)
+	h.size += e.size
+
+	if h.size > h.maxSize {
+		if err := h.compact(h.maxSize / 2); err != nil {
+			log.Printf("history: compaction failed: %v", err)
+		}
+	}
+}
+
+// compact rewrites the log with the most recent entries, up to limit bytes.
+// The new file replaces the old one atomically.
+func (h *history) compact(limit int64) error {
+	var size int64
+	first := len(h.entries)
+	for first > 0 && size+h.entries[first-1].size <= limit {
+		first--
+		size += h.entries[first].size
+	}
+	entries := append([]historyEntry(nil), h.entries[first:]...)
+
+	// Write the entries to a temporary file
+	tmpName := h.fileName + ".tmp"
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	output := bufio.NewWriter(tmp)
+	size = 0
+	for i, e := range entries {
+		line, _ := json.Marshal(e)
+		output.Write(line)
+		output.WriteByte('\n')
+		entries[i].size = int64(len(line) + 1) // the line may differ from the loaded one
+		size += entries[i].size
+	}
+	if err := output.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	// Replace the log
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+	if err := os.Rename(tmpName, h.fileName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	file, err := os.OpenFile(h.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	h.file = file
+	h.entries = entries
+	h.size = size
+	return nil
+}
+
+// last returns up to n most recent entries of a room, the oldest first
+func (h *history) last(room string, n int) []historyEntry {
+	if h == nil || n <= 0 {
+		return nil
+	}
+	var found []historyEntry
+	for i := len(h.entries) - 1; i >= 0 && len(found) < n; i-- {
+		if h.entries[i].Room == room {
+			found = append(found, h.entries[i])
+		}
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+// Close closes the history file
+func (h *history) Close() error {
+	if h == nil || h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
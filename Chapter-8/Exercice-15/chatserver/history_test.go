@@ -0,0 +1,121 @@
+package chatserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "chat.history")
+	h, err := openHistory(fileName, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		h.add(historyEntry{Time: now, Room: "lobby", From: "alice", Text: fmt.Sprintf("message %d", i)})
+		h.add(historyEntry{Time: now, Room: "go", From: "bob", Text: fmt.Sprintf("message %d", i)})
+	}
+	h.Close()
+
+	// The history survives a restart
+	h, err = openHistory(fileName, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	last := h.last("lobby", 3)
+	if len(last) != 3 {
+		t.Fatalf("last(lobby, 3) returned %d entries", len(last))
+	}
+	for i, e := range last {
+		if want := fmt.Sprintf("message %d", i+2); e.Text != want || e.From != "alice" || !e.Time.Equal(now) {
+			t.Errorf("entry %d = %+v, want %q", i, e, want)
+		}
+	}
+	if last := h.last("go", 10); len(last) != 5 {
+		t.Errorf("last(go, 10) returned %d entries, want 5", len(last))
+	}
+	if last := h.last("empty", 10); len(last) != 0 {
+		t.Errorf("last(empty, 10) returned %d entries", len(last))
+	}
+
+	var nilHistory *history
+	nilHistory.add(historyEntry{Room: "lobby"})
+	if last := nilHistory.last("lobby", 10); last != nil {
+		t.Errorf("nil history returned %v", last)
+	}
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "chat.history")
+	const maxSize = 2000
+	h, err := openHistory(fileName, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 100; i++ {
+		h.add(historyEntry{Time: time.Now().UTC(), Room: "lobby", From: "alice", Text: fmt.Sprintf("message %d", i)})
+
+		info, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize || info.Size() != h.size {
+			t.Fatalf("file size %d, history size %d, maximum size %d", info.Size(), h.size, maxSize)
+		}
+	}
+
+	// The most recent entries are kept
+	last := h.last("lobby", 1000)
+	if len(last) == 0 || len(last) == 100 {
+		t.Fatalf("%d entries after compaction", len(last))
+	}
+	if got := last[len(last)-1].Text; got != "message 99" {
+		t.Errorf("last entry is %q", got)
+	}
+
+	// A compacted file is reloaded
+	reloaded, err := openHistory(fileName, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if len(reloaded.entries) != len(h.entries) {
+		t.Errorf("%d entries reloaded, want %d", len(reloaded.entries), len(h.entries))
+	}
+}
+
+func TestHistoryInvalidLines(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "chat.history")
+	content := `{"room":"lobby","from":"alice","text":"hello"}
+not json
+{"room":"lobby","from":"bob","text":"hi"}
+`
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := openHistory(fileName, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if len(h.entries) != 2 {
+		t.Fatalf("%d entries loaded, want 2", len(h.entries))
+	}
+
+	// The file is rewritten without the invalid line
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "not json") || int64(len(data)) != h.size {
+		t.Errorf("history file not rewritten: %q", data)
+	}
+}
@@ -0,0 +1,326 @@
+package chatserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+)
+
+// ircServerName is the prefix of the messages sent by the server to the IRC clients
+const ircServerName = "chat"
+
+// ircSession is the state of an IRC client (RFC 1459 and 2812 subset)
+type ircSession struct {
+	server     *Server
+	ch         client
+	close      func() // closes the connection
+	nick       string // "*" until a nickname is chosen
+	user       string // user name given by USER
+	registered bool   // true once the broadcaster has granted the nickname
+}
+
+// parseIRC splits an IRC message into its command (in upper case) and its
+// parameters, ignoring the prefix. The CR and NUL characters, not allowed in
+// a message, are removed.
+func parseIRC(line string) (string, []string) {
+	line = strings.Map(func(r rune) rune {
+		if r == '\r' || r == 0 {
+			return -1
+		}
+		return r
+	}, line)
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var params []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+		param, rest, _ := strings.Cut(line, " ")
+		params = append(params, param)
+		line = rest
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// formatIRC formats an event for the IRC protocol
+func formatIRC(nick string, ev event) string {
+	channel := "#" + ev.room
+	switch ev.kind {
+	case welcomed:
+		return strings.Join([]string{
+			reply("001", nick, ":Welcome to the chat, "+nick),
+			reply("002", nick, ":Your host is "+ircServerName),
+			reply("003", nick, ":This server speaks a subset of IRC"),
+			reply("004", nick, ircServerName+" 1.0 o o"),
+			reply("422", nick, ":MOTD File is missing"),
+		}, "\r\n")
+	case said:
+		if ev.from == nick {
+			return "" // the IRC clients display their own messages
+		}
+		return ":" + ev.from + " PRIVMSG " + channel + " :" + ev.text
+	case acted:
+		if ev.from == nick {
+			return ""
+		}
+		return ":" + ev.from + " PRIVMSG " + channel + " :\x01ACTION " + ev.text + "\x01"
+	case whispered:
+		return ":" + ev.from + " PRIVMSG " + nick + " :" + ev.text
+	case joined:
+		msg := ":" + ev.from + " JOIN " + channel
+		if ev.from == nick {
+			msg += "\r\n" + reply("353", nick, "= "+channel+" :"+strings.Join(ev.names, " "))
+			msg += "\r\n" + reply("366", nick, channel+" :End of /NAMES list.")
+		}
+		return msg
+	case parted:
+		return ":" + ev.from + " PART " + channel
+	case quit:
+		if ev.from == nick {
+			return ""
+		}
+		return ":" + ev.from + " QUIT :Quit"
+	case renamed:
+		return ":" + ev.from + " NICK :" + ev.text
+	case replayed:
+		notices := make([]string, len(ev.lines))
+		for i, line := range ev.lines {
+			notices[i] = ":" + ircServerName + " NOTICE " + channel + " :" + line
+		}
+		return strings.Join(notices, "\r\n")
+	case noSuchNick:
+		return reply("401", nick, ev.text+" :No such nick/channel")
+	case notInRoom:
+		return reply("442", nick, channel+" :You're not on that channel")
+	}
+	return ":" + ircServerName + " NOTICE " + nick + " :" + ev.text
+}
+
+// reply formats a numeric reply of the server
+func reply(code, nick, params string) string {
+	return ":" + ircServerName + " " + code + " " + nick + " " + params
+}
+
+// reply sends a numeric reply to the client
+func (sess *ircSession) reply(code, params string) {
+	sess.ch <- reply(code, sess.nick, params)
+}
+
+// handleIRC manages a connection with an IRC client
+func (s *Server) handleIRC(conn net.Conn) {
+	defer conn.Close()
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	ch := make(chan string, outgoingSize) // outgoing client messages
+	written := make(chan struct{})
+	go ircWriter(conn, ch, written)
+	defer waitWriter(written)
+
+	timer, done := s.startIdleTimer(conn)
+	defer close(done)
+
+	sess := &ircSession{server: s, ch: ch, close: func() { conn.Close() }, nick: "*"}
+	input := bufio.NewScanner(conn)
+	for input.Scan() {
+		s.resetIdleTimer(timer)
+		command, params := parseIRC(input.Text())
+		if command == "" {
+			continue
+		}
+		if !sess.runCommand(command, params) {
+			break
+		}
+	}
+	// NOTE: ignoring potential errors from input.Err()
+
+	if sess.registered {
+		s.leaving <- ch
+	} else {
+		close(ch)
+	}
+}
+
+// runCommand runs an IRC command. It returns false if the client quits.
+func (sess *ircSession) runCommand(command string, params []string) bool {
+	ch := sess.ch
+
+	// Commands allowed before the registration
+	switch command {
+	case "NICK":
+		if len(params) < 1 {
+			sess.reply("431", ":No nickname given")
+			return true
+		}
+		sess.changeNick(params[0])
+		return true
+
+	case "USER":
+		if sess.registered {
+			sess.reply("462", ":You may not reregister")
+			return true
+		}
+		if len(params) < 4 {
+			sess.reply("461", "USER :Not enough parameters")
+			return true
+		}
+		sess.user = params[0]
+		sess.register()
+		return true
+
+	case "PING":
+		token := ircServerName
+		if len(params) > 0 {
+			token = params[0]
+		}
+		ch <- ":" + ircServerName + " PONG " + ircServerName + " :" + token
+		return true
+
+	case "PONG":
+		return true
+
+	case "CAP":
+		// No capability is supported
+		if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+			ch <- ":" + ircServerName + " CAP * LS :"
+		}
+		return true
+
+	case "QUIT":
+		ch <- "ERROR :Closing link"
+		return false
+	}
+
+	if !sess.registered {
+		sess.reply("451", ":You have not registered")
+		return true
+	}
+
+	switch command {
+	case "JOIN":
+		if len(params) < 1 {
+			sess.reply("461", "JOIN :Not enough parameters")
+			break
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			room, err := roomName(name)
+			if err != nil {
+				sess.reply("403", name+" :No such channel")
+				continue
+			}
+			sess.server.joining <- membership{ch, room}
+		}
+
+	case "PART":
+		if len(params) < 1 {
+			sess.reply("461", "PART :Not enough parameters")
+			break
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			room, err := roomName(name)
+			if err != nil {
+				sess.reply("403", name+" :No such channel")
+				continue
+			}
+			sess.server.parting <- membership{ch, room}
+		}
+
+	case "PRIVMSG":
+		if len(params) < 1 {
+			sess.reply("411", ":No recipient given (PRIVMSG)")
+			break
+		}
+		if len(params) < 2 || params[1] == "" {
+			sess.reply("412", ":No text to send")
+			break
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			sess.privmsg(target, params[1])
+		}
+
+	default:
+		sess.reply("421", command+" :Unknown command")
+	}
+	return true
+}
+
+// privmsg sends a message to a channel or to a user
+func (sess *ircSession) privmsg(target, text string) {
+	if !strings.HasPrefix(target, "#") {
+		sess.server.privates <- privateMessage{sess.ch, target, text}
+		return
+	}
+	room, err := roomName(target)
+	if err != nil {
+		sess.reply("403", target+" :No such channel")
+		return
+	}
+	// CTCP ACTION is the IRC equivalent of /me
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		action := strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+		sess.server.messages <- message{sess.ch, room, action, true}
+		return
+	}
+	sess.server.messages <- message{sess.ch, room, text, false}
+}
+
+// changeNick changes the nickname, registering the client if USER was received
+func (sess *ircSession) changeNick(nick string) {
+	if err := checkNick(nick); err != nil || strings.HasPrefix(nick, "#") {
+		sess.reply("432", nick+" :Erroneous nickname")
+		return
+	}
+	if !sess.registered {
+		sess.nick = nick
+		sess.register()
+		return
+	}
+
+	reply := make(chan error)
+	sess.server.renaming <- registration{cli: sess.ch, nick: nick, reply: reply}
+	if err := <-reply; err != nil {
+		sess.reply("433", nick+" :Nickname is already in use")
+		return
+	}
+	sess.nick = nick
+}
+
+// register asks the broadcaster to grant the nickname, once NICK and USER
+// have been received
+func (sess *ircSession) register() {
+	if sess.registered || sess.nick == "*" || sess.user == "" {
+		return
+	}
+	reply := make(chan error)
+	sess.server.entering <- registration{cli: sess.ch, nick: sess.nick, format: formatIRC, close: sess.close, reply: reply}
+	if err := <-reply; err != nil {
+		nick := sess.nick
+		sess.nick = "*"
+		sess.reply("433", nick+" :Nickname is already in use")
+		return
+	}
+	sess.registered = true
+}
+
+// ircWriter is a go routine to send messages to an IRC client.
+// It closes written once ch is closed and its messages sent.
+func ircWriter(conn net.Conn, ch <-chan string, written chan<- struct{}) {
+	for msg := range ch {
+		io.WriteString(conn, msg+"\r\n") // NOTE: ignoring network errors
+	}
+	close(written)
+}
@@ -0,0 +1,60 @@
+package chatserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIRC(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"NICK alice\r", "NICK", []string{"alice"}},
+		{"user alice 0 * :Alice Liddell", "USER", []string{"alice", "0", "*", "Alice Liddell"}},
+		{":alice!a@host PRIVMSG #lobby :hello  world", "PRIVMSG", []string{"#lobby", "hello  world"}},
+		{"PRIVMSG #lobby ::-)", "PRIVMSG", []string{"#lobby", ":-)"}},
+		{"PRIVMSG #lobby :hi\r:evil PRIVMSG #x :owned\x00", "PRIVMSG", []string{"#lobby", "hi:evil PRIVMSG #x :owned"}},
+		{"JOIN  #a,#b", "JOIN", []string{"#a,#b"}},
+		{"PING :", "PING", []string{""}},
+		{"QUIT", "QUIT", []string{}},
+		{"", "", nil},
+		{":prefix", "", nil},
+	}
+	for _, test := range tests {
+		command, params := parseIRC(test.line)
+		if command != test.command || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("parseIRC(%q) = %q, %q, want %q, %q", test.line, command, params, test.command, test.params)
+		}
+	}
+}
+
+func TestFormatIRC(t *testing.T) {
+	tests := []struct {
+		nick string
+		ev   event
+		want string
+	}{
+		{"bob", event{kind: said, from: "alice", room: "lobby", text: "hi"}, ":alice PRIVMSG #lobby :hi"},
+		{"alice", event{kind: said, from: "alice", room: "lobby", text: "hi"}, ""},
+		{"bob", event{kind: acted, from: "alice", room: "go", text: "waves"}, ":alice PRIVMSG #go :\x01ACTION waves\x01"},
+		{"bob", event{kind: whispered, from: "alice", text: "psst"}, ":alice PRIVMSG bob :psst"},
+		{"bob", event{kind: joined, from: "alice", room: "go"}, ":alice JOIN #go"},
+		{"alice", event{kind: joined, from: "alice", room: "go", names: []string{"alice", "bob"}},
+			":alice JOIN #go\r\n:chat 353 alice = #go :alice bob\r\n:chat 366 alice #go :End of /NAMES list."},
+		{"bob", event{kind: parted, from: "alice", room: "go"}, ":alice PART #go"},
+		{"bob", event{kind: quit, from: "alice"}, ":alice QUIT :Quit"},
+		{"bob", event{kind: renamed, from: "alice", text: "alicia"}, ":alice NICK :alicia"},
+		{"bob", event{kind: noSuchNick, text: "carol"}, ":chat 401 bob carol :No such nick/channel"},
+		{"bob", event{kind: notInRoom, room: "go"}, ":chat 442 bob #go :You're not on that channel"},
+		{"bob", event{kind: notice, text: "Ignoring alice"}, ":chat NOTICE bob :Ignoring alice"},
+		{"bob", event{kind: replayed, room: "go", lines: []string{"[Jan 2 15:04] alice: hi", "[Jan 2 15:05] bob: hello"}},
+			":chat NOTICE #go :[Jan 2 15:04] alice: hi\r\n:chat NOTICE #go :[Jan 2 15:05] bob: hello"},
+	}
+	for _, test := range tests {
+		if got := formatIRC(test.nick, test.ev); got != test.want {
+			t.Errorf("formatIRC(%q, %+v) = %q, want %q", test.nick, test.ev, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package chatserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// rateWindow is the period over which the messages per second are computed, in seconds
+const rateWindow = 10
+
+// rateCounter counts events per second over the last rateWindow seconds
+type rateCounter struct {
+	counts  [rateWindow]int64
+	seconds [rateWindow]int64 // Unix time of the counts
+}
+
+// add counts an event at now
+func (r *rateCounter) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % rateWindow
+	if r.seconds[i] != sec {
+		r.seconds[i] = sec
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+}
+
+// rate returns the average events per second over the window ending at now
+func (r *rateCounter) rate(now time.Time) float64 {
+	sec := now.Unix()
+	var total int64
+	for i := range r.counts {
+		if sec-r.seconds[i] < rateWindow {
+			total += r.counts[i]
+		}
+	}
+	return float64(total) / rateWindow
+}
+
+// stats are the counters of the broadcaster
+type stats struct {
+	clients     int
+	rooms       int
+	messages    int64   // messages received from the users
+	rate        float64 // messages received per second
+	drops       int64   // messages not delivered to slow clients
+	disconnects int64   // slow clients disconnected
+	rateLimited int64   // messages refused by the rate limit
+}
+
+// metric is a Prometheus metric
+type metric struct {
+	name  string
+	kind  string // counter or gauge
+	help  string
+	value interface{}
+}
+
+// writeMetrics writes the counters in the Prometheus text format
+func writeMetrics(w io.Writer, s stats) {
+	for _, m := range []metric{
+		{"chat_clients", "gauge", "Number of connected clients.", s.clients},
+		{"chat_rooms", "gauge", "Number of non empty rooms.", s.rooms},
+		{"chat_messages_total", "counter", "Messages received from the clients.", s.messages},
+		{"chat_messages_per_second", "gauge", fmt.Sprintf("Messages received per second over the last %d seconds.", rateWindow), s.rate},
+		{"chat_dropped_messages_total", "counter", "Messages not delivered to slow clients.", s.drops},
+		{"chat_slow_disconnects_total", "counter", "Slow clients disconnected.", s.disconnects},
+		{"chat_rate_limited_messages_total", "counter", "Messages refused by the rate limit.", s.rateLimited},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// serveMetrics sends the counters of the broadcaster
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	reply := make(chan stats)
+	select {
+	case s.statsRequests <- reply:
+	case <-s.done:
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, <-reply)
+}
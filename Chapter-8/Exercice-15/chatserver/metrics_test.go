@@ -0,0 +1,41 @@
+package chatserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateCounter(t *testing.T) {
+	var r rateCounter
+	now := time.Unix(1000, 0)
+	for i := 0; i < 20; i++ {
+		r.add(now.Add(time.Duration(i%5) * time.Second))
+	}
+	if got := r.rate(now.Add(5 * time.Second)); got != 2 {
+		t.Errorf("rate = %v, want 2", got)
+	}
+	// The old counts are forgotten
+	if got := r.rate(now.Add(12 * time.Second)); got != 0.8 {
+		t.Errorf("rate after 12s = %v, want 0.8", got)
+	}
+	if got := r.rate(now.Add(time.Minute)); got != 0 {
+		t.Errorf("rate after a minute = %v, want 0", got)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	var b strings.Builder
+	writeMetrics(&b, stats{clients: 3, messages: 42, rate: 1.5, drops: 7})
+	for _, want := range []string{
+		"# TYPE chat_clients gauge\nchat_clients 3\n",
+		"# TYPE chat_messages_total counter\nchat_messages_total 42\n",
+		"chat_messages_per_second 1.5\n",
+		"chat_dropped_messages_total 7\n",
+		"chat_slow_disconnects_total 0\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package chatserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// SlowAction is what the server does when the outgoing channel of a client is full
+type SlowAction int
+
+const (
+	DropMessage  SlowAction = iota // The message is lost
+	Disconnect                     // The message is lost, and the client disconnected after too many losses
+	BlockSending                   // The server waits for the client, up to a deadline
+)
+
+// slowPolicy is the handling of the clients not reading their messages fast enough
+type slowPolicy struct {
+	action   SlowAction
+	maxDrops int           // consecutive drops disconnecting a client
+	timeout  time.Duration // maximum wait of blockSending
+}
+
+// ParseSlowAction parses the name of a slow client action: drop, disconnect or block
+func ParseSlowAction(name string) (SlowAction, error) {
+	switch name {
+	case "drop":
+		return DropMessage, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "block":
+		return BlockSending, nil
+	}
+	return 0, fmt.Errorf("invalid slow client policy: %s (drop, disconnect or block)", name)
+}
+
+// rateLimit limits the messages sent by each client (token bucket)
+type rateLimit struct {
+	rate  float64 // messages per second, 0 for no limit
+	burst int     // messages allowed at once
+}
+
+// bucket is the state of the rate limit of a client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow returns true if a message sent at now complies with the limit,
+// consuming a token
+func (l rateLimit) allow(b *bucket, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(l.burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > float64(l.burst) {
+			b.tokens = float64(l.burst)
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,54 @@
+package chatserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	limit := rateLimit{rate: 2, burst: 3}
+	var b bucket
+	now := time.Now()
+
+	// The burst is allowed at once
+	for i := 0; i < 3; i++ {
+		if !limit.allow(&b, now) {
+			t.Fatalf("message %d of the burst refused", i)
+		}
+	}
+	if limit.allow(&b, now) {
+		t.Fatal("message over the burst allowed")
+	}
+
+	// A token is added every 1/rate second
+	if !limit.allow(&b, now.Add(500*time.Millisecond)) {
+		t.Error("message refused after 1/rate second")
+	}
+	if limit.allow(&b, now.Add(600*time.Millisecond)) {
+		t.Error("message allowed before 1/rate second")
+	}
+
+	// The tokens don't accumulate over the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		limit.allow(&b, later)
+	}
+	if limit.allow(&b, later) {
+		t.Error("message over the burst allowed after an idle period")
+	}
+
+	if !(rateLimit{}).allow(&bucket{}, now) {
+		t.Error("message refused without limit")
+	}
+}
+
+func TestParseSlowAction(t *testing.T) {
+	for name, want := range map[string]SlowAction{"drop": DropMessage, "disconnect": Disconnect, "block": BlockSending} {
+		if got, err := ParseSlowAction(name); err != nil || got != want {
+			t.Errorf("ParseSlowAction(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseSlowAction("ignore"); err == nil {
+		t.Error("ParseSlowAction(ignore) succeeded")
+	}
+}
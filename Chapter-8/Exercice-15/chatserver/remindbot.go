@@ -0,0 +1,73 @@
+package chatserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReminders is the number of pending reminders of the bot
+const maxReminders = 100
+
+// maxUserReminders is the number of pending reminders of a user
+const maxUserReminders = 5
+
+// remindBot sends reminders: "!remind 10m take a break"
+type remindBot struct {
+	mu      sync.Mutex
+	pending int            // reminders not sent yet
+	users   map[string]int // reminders not sent yet by nickname of the sender
+}
+
+// newRemindBot returns a reminder bot
+func newRemindBot() *remindBot {
+	return &remindBot{users: make(map[string]int)}
+}
+
+// Nick returns the nickname of the bot
+func (b *remindBot) Nick() string {
+	return "remindbot"
+}
+
+// Handle schedules the reminders of the !remind commands
+func (b *remindBot) Handle(msg BotMessage, reply func(string)) {
+	name, arg, ok := botCommand(msg)
+	if !ok || name != "remind" {
+		return
+	}
+	delay, text, _ := strings.Cut(arg, " ")
+	d, err := time.ParseDuration(delay)
+	text = strings.TrimSpace(text)
+	if err != nil || d <= 0 || text == "" {
+		reply(msg.From + ": usage: !remind <delay> <text>, e.g. !remind 10m take a break")
+		return
+	}
+	if d > 24*time.Hour {
+		reply(msg.From + ": reminders are limited to 24h")
+		return
+	}
+
+	b.mu.Lock()
+	full := b.pending >= maxReminders || b.users[msg.From] >= maxUserReminders
+	if !full {
+		b.pending++
+		b.users[msg.From]++
+	}
+	b.mu.Unlock()
+	if full {
+		reply(msg.From + ": too many pending reminders, try later")
+		return
+	}
+
+	time.AfterFunc(d, func() {
+		b.mu.Lock()
+		b.pending--
+		if b.users[msg.From]--; b.users[msg.From] == 0 {
+			delete(b.users, msg.From)
+		}
+		b.mu.Unlock()
+		reply(msg.From + ": reminder: " + text)
+	})
+	reply(fmt.Sprintf("%s: I will remind you in %v", msg.From, d))
+}
@@ -0,0 +1,269 @@
+// Package chatserver is a server that lets clients chat with each other,
+// using a line protocol over TCP or WebSocket, or IRC.
+package chatserver
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Config is the configuration of a server
+type Config struct {
+	Address      string        // Listen address of the line protocol clients ("localhost:0" for an ephemeral port)
+	IRCAddress   string        // Listen address of the IRC clients, "" to disable them
+	HTTPAddress  string        // Listen address of the web clients and of the metrics, "" to disable them
+	HistoryFile  string        // Messages history file, "" to disable the history
+	HistorySize  int64         // Size of the history file triggering its compaction, in bytes
+	Replay       int           // Number of messages of the history sent to the clients joining a room
+	IdleTimeout  time.Duration // Inactivity disconnecting a client, 0 for no limit
+	SlowClients  SlowAction    // Handling of the clients not reading their messages
+	MaxDrops     int           // Consecutive messages dropped disconnecting a slow client (Disconnect)
+	BlockTimeout time.Duration // Maximum wait of a slow client (BlockSending)
+	RateLimit    float64       // Messages per second allowed per client, 0 for no limit
+	Burst        int           // Messages allowed at once per client
+	Bots         []Bot         // Bots joining the chat
+}
+
+// Server is a running chat server
+type Server struct {
+	config       Config
+	history      *history // nil if disabled
+	slow         slowPolicy
+	limit        rateLimit
+	listener     net.Listener
+	ircListener  net.Listener // nil if disabled
+	httpListener net.Listener // nil if disabled
+	httpServer   *http.Server
+
+	// Requests to the broadcaster
+	entering      chan registration
+	leaving       chan client
+	renaming      chan registration // nickname changes
+	listing       chan client       // requests of the connected users list
+	joining       chan membership
+	parting       chan membership
+	roomsListing  chan client  // requests of the rooms list
+	messages      chan message // all incoming client messages
+	privates      chan privateMessage
+	ignores       chan ignoring
+	histories     chan historyRequest
+	statsRequests chan chan<- stats
+
+	done    chan struct{} // closed to stop the broadcaster
+	stopped chan struct{} // closed once the broadcaster returned
+
+	mu        sync.Mutex
+	closing   bool              // true once Close is called
+	conns     map[net.Conn]bool // connections of the clients
+	active    sync.WaitGroup    // connection handlers and accept loops
+	closeOnce sync.Once
+}
+
+// Start starts a server
+func Start(config Config) (*Server, error) {
+	if config.SlowClients == Disconnect && config.MaxDrops <= 0 {
+		return nil, errors.New("chatserver: MaxDrops must be positive with the Disconnect policy")
+	}
+	s := &Server{
+		config:        config,
+		slow:          slowPolicy{action: config.SlowClients, maxDrops: config.MaxDrops, timeout: config.BlockTimeout},
+		limit:         rateLimit{rate: config.RateLimit, burst: config.Burst},
+		entering:      make(chan registration),
+		leaving:       make(chan client),
+		renaming:      make(chan registration),
+		listing:       make(chan client),
+		joining:       make(chan membership),
+		parting:       make(chan membership),
+		roomsListing:  make(chan client),
+		messages:      make(chan message),
+		privates:      make(chan privateMessage),
+		ignores:       make(chan ignoring),
+		histories:     make(chan historyRequest),
+		statsRequests: make(chan chan<- stats),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		conns:         make(map[net.Conn]bool),
+	}
+
+	var err error
+	if config.HistoryFile != "" {
+		if s.history, err = openHistory(config.HistoryFile, config.HistorySize); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		s.history.Close()
+		return nil, err
+	}
+
+	go s.broadcaster()
+	for _, b := range config.Bots {
+		if err := s.runBot(b); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	s.serve(s.listener, s.handleConn)
+	if s.ircListener != nil {
+		s.serve(s.ircListener, s.handleIRC)
+	}
+	if s.httpListener != nil {
+		s.httpServer = &http.Server{Handler: s.webHandler()}
+		s.active.Add(1)
+		go func() {
+			defer s.active.Done()
+			s.httpServer.Serve(s.httpListener)
+		}()
+	}
+	return s, nil
+}
+
+// listen opens the listeners of the server
+func (s *Server) listen() error {
+	var err error
+	if s.listener, err = net.Listen("tcp", s.config.Address); err != nil {
+		return err
+	}
+	if s.config.IRCAddress != "" {
+		if s.ircListener, err = net.Listen("tcp", s.config.IRCAddress); err != nil {
+			return err
+		}
+	}
+	if s.config.HTTPAddress != "" {
+		if s.httpListener, err = net.Listen("tcp", s.config.HTTPAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeListeners closes the listeners of the server
+func (s *Server) closeListeners() {
+	for _, l := range []net.Listener{s.listener, s.ircListener} {
+		if l != nil {
+			l.Close()
+		}
+	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	} else if s.httpListener != nil {
+		s.httpListener.Close()
+	}
+}
+
+// Addr returns the address of the line protocol listener
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// IRCAddr returns the address of the IRC listener, nil if disabled
+func (s *Server) IRCAddr() net.Addr {
+	if s.ircListener == nil {
+		return nil
+	}
+	return s.ircListener.Addr()
+}
+
+// HTTPAddr returns the address of the HTTP listener, nil if disabled
+func (s *Server) HTTPAddr() net.Addr {
+	if s.httpListener == nil {
+		return nil
+	}
+	return s.httpListener.Addr()
+}
+
+// serve accepts the connections of a listener up to the server is closed
+func (s *Server) serve(listener net.Listener, handle func(net.Conn)) {
+	s.active.Add(1)
+	go func() {
+		defer s.active.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Print(err)
+				continue
+			}
+			go handle(conn)
+		}
+	}()
+}
+
+// track records a client connection, returning false if the server is closing
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = true
+	s.active.Add(1)
+	return true
+}
+
+// untrack forgets a client connection once its handler is done
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// Close stops the server: the listeners and the client connections are
+// closed, and Close returns once the clients have left
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closing = true
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		s.closeListeners()
+
+		// The broadcaster runs up to all the handlers have left
+		s.active.Wait()
+		close(s.done)
+		<-s.stopped
+		s.history.Close()
+	})
+	return nil
+}
+
+// startIdleTimer starts the timer closing a connection after IdleTimeout of
+// inactivity. The timer is nil if there is no limit. Closing the returned
+// channel stops the timer.
+func (s *Server) startIdleTimer(conn net.Conn) (*time.Timer, chan struct{}) {
+	done := make(chan struct{})
+	if s.config.IdleTimeout <= 0 {
+		return nil, done
+	}
+	timer := time.NewTimer(s.config.IdleTimeout)
+	go clientIdle(conn, timer, done)
+	return timer, done
+}
+
+// resetIdleTimer restarts the idle timer after an activity of the client
+func (s *Server) resetIdleTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Reset(s.config.IdleTimeout)
+	}
+}
+
+// clientIdle detects client inactivity
+func clientIdle(conn net.Conn, timer *time.Timer, done <-chan struct{}) {
+	select {
+	case <-timer.C:
+		conn.Close()
+	case <-done:
+		timer.Stop()
+	}
+}
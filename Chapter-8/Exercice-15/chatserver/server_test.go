@@ -0,0 +1,529 @@
+package chatserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// startTestServer starts a server on an ephemeral port, closed at the end of the test
+func startTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	if config.Address == "" {
+		config.Address = "127.0.0.1:0"
+	}
+	s, err := Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// scriptClient is a client driven by a script
+type scriptClient struct {
+	name  string
+	conn  net.Conn
+	input *bufio.Reader
+}
+
+// readLine reads a line, without its end of line, waiting up to timeout
+func (c *scriptClient) readLine(timeout time.Duration) (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := c.input.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// runScript runs a script driving clients of a server. Each line of the
+// script is a step, run once the previous ones are done:
+//
+//	name > text    the client sends a line (connecting on its first step)
+//	name < text    the next line received by the client is text
+//	name closed    the server closes the connection of the client
+//	sleep 100ms    the script waits
+//
+// The clients whose name starts with "irc" connect to the IRC listener, and
+// those whose name starts with "web" connect to the WebSocket endpoint.
+// At the end of the script, the clients must have no unexpected line.
+func runScript(t *testing.T, s *Server, script string) {
+	t.Helper()
+	clients := make(map[string]*scriptClient)
+	var order []*scriptClient
+	defer func() {
+		for _, c := range order {
+			c.conn.Close()
+		}
+	}()
+
+	// client returns the client of a name, connecting it if needed
+	client := func(name string) *scriptClient {
+		if c, ok := clients[name]; ok {
+			return c
+		}
+		var conn net.Conn
+		var err error
+		switch {
+		case strings.HasPrefix(name, "irc"):
+			conn, err = net.Dial("tcp", s.IRCAddr().String())
+		case strings.HasPrefix(name, "web"):
+			addr := s.HTTPAddr().String()
+			conn, err = websocket.Dial("ws://"+addr+"/ws", "", "http://"+addr+"/")
+		default:
+			conn, err = net.Dial("tcp", s.Addr().String())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &scriptClient{name: name, conn: conn, input: bufio.NewReader(conn)}
+		clients[name] = c
+		order = append(order, c)
+		return c
+	}
+
+	for i, step := range strings.Split(script, "\n") {
+		step = strings.TrimSpace(step)
+		if step == "" || strings.HasPrefix(step, "#") {
+			continue
+		}
+		fields := strings.SplitN(step, " ", 3)
+		if fields[0] == "sleep" {
+			d, err := time.ParseDuration(fields[1])
+			if err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+			time.Sleep(d)
+			continue
+		}
+		if len(fields) < 2 {
+			t.Fatalf("step %d: invalid step %q", i, step)
+		}
+
+		c := client(fields[0])
+		text := ""
+		if len(fields) == 3 {
+			text = fields[2]
+		}
+		switch fields[1] {
+		case ">":
+			if _, err := fmt.Fprintf(c.conn, "%s\r\n", text); err != nil {
+				t.Fatalf("step %d (%s): %v", i, step, err)
+			}
+		case "<":
+			line, err := c.readLine(2 * time.Second)
+			if err != nil {
+				t.Fatalf("step %d (%s): %v", i, step, err)
+			}
+			if line != text {
+				t.Fatalf("step %d: %s received %q, want %q", i, c.name, line, text)
+			}
+		case "closed":
+			line, err := c.readLine(2 * time.Second)
+			if err == nil {
+				t.Fatalf("step %d: %s received %q, want the connection closed", i, c.name, line)
+			}
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("step %d: %s: %v, want the connection closed", i, c.name, err)
+			}
+		default:
+			t.Fatalf("step %d: invalid step %q", i, step)
+		}
+	}
+
+	for _, c := range order {
+		if line, err := c.readLine(100 * time.Millisecond); err == nil {
+			t.Errorf("%s received the unexpected line %q", c.name, line)
+		}
+	}
+}
+
+func TestRooms(t *testing.T) {
+	// Without history, nothing is replayed when joining a room
+	s := startTestServer(t, Config{Replay: 10})
+	runScript(t, s, `
+		alice < Enter your nickname
+		alice > alice
+		alice < You are alice
+		alice < You joined lobby with alice
+		bob < Enter your nickname
+		bob > Alice
+		bob < Nickname Alice is already in use
+		bob < Enter your nickname
+		bob > bob
+		bob < You are bob
+		alice < bob has joined lobby
+		bob < You joined lobby with alice, bob
+
+		alice > hello
+		alice < alice: hello
+		bob < alice: hello
+		bob > /me waves
+		alice < * bob waves
+		bob < * bob waves
+
+		# Rooms
+		bob > /join #Go
+		alice < bob has left lobby
+		bob < You joined go with bob
+		alice > /rooms
+		alice < Rooms: go (1), lobby (1)
+		bob > nobody here
+		bob < bob: nobody here
+		alice > /join go
+		bob < alice has joined go
+		alice < You joined go with alice, bob
+		alice > /part
+		bob < alice has left go
+		alice < You joined lobby with alice
+		alice > /part
+		alice < You can't leave lobby
+
+		# Private messages
+		alice > /msg bob psst
+		bob < *alice* psst
+		alice > /msg carol hi
+		alice < No such user: carol
+		bob > /ignore alice
+		bob < Ignoring alice
+		alice > /msg bob are you there?
+		alice > /who
+		alice < Connected users: alice, bob
+		bob > /unignore alice
+		bob < No longer ignoring alice
+
+		# Nickname changes and departures
+		bob > /nick robert
+		bob < bob is now known as robert
+		bob > /who
+		bob < Connected users: alice, robert
+		bob > /join lobby
+		bob < You joined lobby with alice, robert
+		alice < robert has joined lobby
+		bob > /quit
+		bob < robert has left
+		alice < robert has left
+		bob closed
+	`)
+}
+
+func TestIRC(t *testing.T) {
+	s := startTestServer(t, Config{IRCAddress: "127.0.0.1:0"})
+	runScript(t, s, `
+		alice < Enter your nickname
+		alice > alice
+		alice < You are alice
+		alice < You joined lobby with alice
+
+		irc > PRIVMSG #lobby :too early
+		irc < :chat 451 * :You have not registered
+		irc > NICK alice
+		irc > USER bob 0 * :Bob
+		irc < :chat 433 * alice :Nickname is already in use
+		irc > NICK bob
+		irc < :chat 001 bob :Welcome to the chat, bob
+		irc < :chat 002 bob :Your host is chat
+		irc < :chat 003 bob :This server speaks a subset of IRC
+		irc < :chat 004 bob chat 1.0 o o
+		irc < :chat 422 bob :MOTD File is missing
+		irc > PING :12345
+		irc < :chat PONG chat :12345
+
+		irc > JOIN #lobby
+		alice < bob has joined lobby
+		irc < :bob JOIN #lobby
+		irc < :chat 353 bob = #lobby :alice bob
+		irc < :chat 366 bob #lobby :End of /NAMES list.
+		alice > hello bob
+		irc < :alice PRIVMSG #lobby :hello bob
+		alice < alice: hello bob
+		irc > PRIVMSG #lobby :hello alice
+		alice < bob: hello alice
+		irc > PRIVMSG #lobby :`+"\x01ACTION waves\x01"+`
+		alice < * bob waves
+		alice > /msg bob psst
+		irc < :alice PRIVMSG bob :psst
+		irc > PRIVMSG alice :psst too
+		alice < *bob* psst too
+		irc > PRIVMSG #go :hello
+		irc < :chat 442 bob #go :You're not on that channel
+
+		irc > NICK robert
+		irc < :bob NICK :robert
+		alice < bob is now known as robert
+		irc > PART #lobby
+		irc < :robert PART #lobby
+		alice < robert has left lobby
+		irc > QUIT :bye
+		irc < ERROR :Closing link
+		irc closed
+	`)
+}
+
+func TestControlCharacters(t *testing.T) {
+	s := startTestServer(t, Config{IRCAddress: "127.0.0.1:0"})
+	// The script is not a raw string, so that the messages contain control characters
+	runScript(t, s, "\n"+
+		"alice < Enter your nickname\n"+
+		"alice > alice\n"+
+		"alice < You are alice\n"+
+		"alice < You joined lobby with alice\n"+
+		"irc > NICK bob\n"+
+		"irc > USER bob 0 * :Bob\n"+
+		"irc < :chat 001 bob :Welcome to the chat, bob\n"+
+		"irc < :chat 002 bob :Your host is chat\n"+
+		"irc < :chat 003 bob :This server speaks a subset of IRC\n"+
+		"irc < :chat 004 bob chat 1.0 o o\n"+
+		"irc < :chat 422 bob :MOTD File is missing\n"+
+		"irc > JOIN #lobby\n"+
+		"alice < bob has joined lobby\n"+
+		"irc < :bob JOIN #lobby\n"+
+		"irc < :chat 353 bob = #lobby :alice bob\n"+
+		"irc < :chat 366 bob #lobby :End of /NAMES list.\n"+
+
+		// The carriage returns can't forge IRC lines
+		"alice > hi\r:evil PRIVMSG #lobby :owned\n"+
+		"irc < :alice PRIVMSG #lobby :hi:evil PRIVMSG #lobby :owned\n"+
+		"alice < alice: hi:evil PRIVMSG #lobby :owned\n"+
+		"alice > /me waves\r:evil QUIT\n"+
+		"irc < :alice PRIVMSG #lobby :\x01ACTION waves:evil QUIT\x01\n"+
+		"alice < * alice waves:evil QUIT\n"+
+		"alice > /msg bob psst\r:evil KILL bob\n"+
+		"irc < :alice PRIVMSG bob :psst:evil KILL bob\n"+
+
+		// The other control characters don't reach the line protocol clients
+		"irc > PRIVMSG #lobby :\x1b[2Jbeep\x07\x00\r\n"+
+		"alice < bob: [2Jbeep\n"+
+		"irc > PRIVMSG #lobby :\x01ACTION \x1b[1mwaves\x01\n"+
+		"alice < * bob [1mwaves\n"+
+		"irc > PRIVMSG alice :a\tb\n"+
+		"alice < *bob* a b\n")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := startTestServer(t, Config{IdleTimeout: 500 * time.Millisecond})
+	start := time.Now()
+	runScript(t, s, `
+		alice < Enter your nickname
+		alice > alice
+		alice < You are alice
+		alice < You joined lobby with alice
+		sleep 250ms
+		bob < Enter your nickname
+		bob > bob
+		bob < You are bob
+		alice < bob has joined lobby
+		bob < You joined lobby with alice, bob
+
+		# alice is disconnected 500ms after her last line
+		alice closed
+		bob < alice has left
+
+		# The activity of bob delays his disconnection
+		bob > still there
+		bob < bob: still there
+		sleep 300ms
+		bob > /who
+		bob < Connected users: bob
+		sleep 300ms
+		bob > /who
+		bob < Connected users: bob
+		bob closed
+	`)
+	if elapsed := time.Since(start); elapsed < 1600*time.Millisecond {
+		t.Errorf("the clients were disconnected after %v", elapsed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s, err := Start(Config{Address: "127.0.0.1:0", IRCAddress: "127.0.0.1:0", HTTPAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	for _, addr := range []net.Addr{s.Addr(), s.IRCAddr()} {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	fmt.Fprintln(conns[0], "alice")
+	fmt.Fprint(conns[1], "NICK bob\r\nUSER bob 0 * :Bob\r\n")
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close is blocked")
+	}
+
+	// The clients are disconnected and the listeners closed
+	for _, conn := range conns {
+		// The connection may be reset if the server didn't read all the lines
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadAll(conn); errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%v, want the connection closed", err)
+		}
+	}
+	for _, addr := range []net.Addr{s.Addr(), s.IRCAddr(), s.HTTPAddr()} {
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			conn.Close()
+			t.Errorf("%v still accepts connections", addr)
+		}
+	}
+}
+
+func TestHistoryReplay(t *testing.T) {
+	config := Config{
+		HistoryFile: t.TempDir() + "/chat.history",
+		HistorySize: 1024 * 1024,
+		Replay:      2,
+	}
+	s := startTestServer(t, config)
+	runScript(t, s, `
+		alice < Enter your nickname
+		alice > alice
+		alice < You are alice
+		alice < You joined lobby with alice
+		alice > one
+		alice < alice: one
+		alice > two
+		alice < alice: two
+		alice > /me leaves
+		alice < * alice leaves
+	`)
+	s.Close()
+
+	// The history survives a restart
+	h, err := openHistory(config.HistoryFile, config.HistorySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	if len(h.entries) != 3 {
+		t.Fatalf("%d entries in the history, want 3", len(h.entries))
+	}
+	s = startTestServer(t, config)
+	runScript(t, s, fmt.Sprintf(`
+		bob < Enter your nickname
+		bob > bob
+		bob < You are bob
+		bob < You joined lobby with bob
+		bob < %[2]s
+		bob < %[3]s
+		bob > /history 5
+		bob < %[1]s
+		bob < %[2]s
+		bob < %[3]s
+		bob > /history 50
+		bob < %[1]s
+		bob < %[2]s
+		bob < %[3]s
+		bob > /history 0
+		bob < Usage: /history <count>
+	`, h.entries[0], h.entries[1], h.entries[2]))
+}
+
+func TestLongReplay(t *testing.T) {
+	s := startTestServer(t, Config{
+		HistoryFile: t.TempDir() + "/chat.history",
+		HistorySize: 1024 * 1024,
+		Replay:      3 * outgoingSize,
+	})
+	alice := dialPipe(t, s, "alice")
+	for i := 0; i < 2*outgoingSize; i++ {
+		alice.send(t, fmt.Sprintf("message %d", i))
+		alice.waitFor(t, fmt.Sprintf("alice: message %d", i))
+	}
+
+	// The replay on join and /history aren't limited by the outgoing channel
+	bob := dialPipe(t, s, "bob")
+	for i := 0; i < 2*outgoingSize; i++ {
+		if line := bob.waitFor(t, "["); !strings.HasSuffix(line, fmt.Sprintf("] alice: message %d", i)) {
+			t.Fatalf("replayed entry %d = %q", i, line)
+		}
+	}
+	bob.send(t, "/history 1000")
+	for i := 0; i < 2*outgoingSize; i++ {
+		if line := bob.waitFor(t, "["); !strings.HasSuffix(line, fmt.Sprintf("] alice: message %d", i)) {
+			t.Fatalf("/history entry %d = %q", i, line)
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s := startTestServer(t, Config{HTTPAddress: "127.0.0.1:0"})
+	runScript(t, s, `
+		web < Enter your nickname
+		web > alice
+		web < You are alice
+		web < You joined lobby with alice
+		bob < Enter your nickname
+		bob > bob
+		bob < You are bob
+		web < bob has joined lobby
+		bob < You joined lobby with alice, bob
+
+		web > hello from the browser
+		web < alice: hello from the browser
+		bob < alice: hello from the browser
+		bob > hello from the terminal
+		web < bob: hello from the terminal
+		bob < bob: hello from the terminal
+
+		web > /quit
+		web < alice has left
+		bob < alice has left
+		web closed
+	`)
+}
+
+func TestMetrics(t *testing.T) {
+	s := startTestServer(t, Config{HTTPAddress: "127.0.0.1:0", RateLimit: 1, Burst: 2})
+	runScript(t, s, `
+		alice < Enter your nickname
+		alice > alice
+		alice < You are alice
+		alice < You joined lobby with alice
+		alice > one
+		alice < alice: one
+		alice > two
+		alice < alice: two
+		alice > three
+		alice < You are sending messages too fast, message not sent
+	`)
+
+	resp, err := http.Get("http://" + s.HTTPAddr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\nchat_messages_total 2\n",
+		"\nchat_rate_limited_messages_total 1\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+}
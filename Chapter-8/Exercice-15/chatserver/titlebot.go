@@ -0,0 +1,177 @@
+package chatserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// maxTitleLength is the number of characters of the titles sent
+const maxTitleLength = 200
+
+// maxRedirects is the number of redirections followed to fetch a page
+const maxRedirects = 3
+
+// reservedNetworks are the networks which are neither private nor loopback
+// but are not reachable on the internet either (net.IP doesn't know them)
+var reservedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),       // "this" network
+	mustParseCIDR("100.64.0.0/10"),   // carrier-grade NAT
+	mustParseCIDR("192.0.0.0/24"),    // IETF protocol assignments
+	mustParseCIDR("192.0.2.0/24"),    // documentation
+	mustParseCIDR("198.18.0.0/15"),   // benchmarking
+	mustParseCIDR("198.51.100.0/24"), // documentation
+	mustParseCIDR("203.0.113.0/24"),  // documentation
+	mustParseCIDR("240.0.0.0/4"),     // reserved, and the broadcast address
+	mustParseCIDR("64:ff9b::/96"),    // NAT64, which may reach private IPv4 addresses
+	mustParseCIDR("2001:db8::/32"),   // documentation
+}
+
+// mustParseCIDR parses a network, panicking if it is invalid
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// isPublic reports whether an IP address is reachable on the internet
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic refuses the connections to the addresses which are not public,
+// so that the bot can't be used to probe the internal network. It checks the
+// resolved address, a host name can't hide a private address.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// checkRedirect stops after maxRedirects redirections
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		return errors.New("too many redirects")
+	}
+	return nil
+}
+
+// newPublicClient returns a HTTP client reaching only the public addresses
+// (without proxy, whose address would be checked instead of the server one)
+func newPublicClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: dialPublic}
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Minute,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// titleBot sends the title of the web pages whose URLs appear in the messages
+type titleBot struct {
+	client *http.Client
+}
+
+// newTitleBot returns a title bot using client, or a client reaching only the
+// public addresses if nil
+func newTitleBot(client *http.Client) *titleBot {
+	if client == nil {
+		client = newPublicClient()
+	}
+	return &titleBot{client: client}
+}
+
+// Nick returns the nickname of the bot
+func (b *titleBot) Nick() string {
+	return "titlebot"
+}
+
+// Handle fetches the first URL of a message and replies with its title
+func (b *titleBot) Handle(msg BotMessage, reply func(string)) {
+	for _, word := range strings.Fields(msg.Text) {
+		if strings.HasPrefix(word, "http://") || strings.HasPrefix(word, "https://") {
+			// Don't delay the other messages while fetching
+			go func(url string) {
+				if title := b.fetchTitle(url); title != "" {
+					reply("Title: " + title)
+				}
+			}(word)
+			return
+		}
+	}
+}
+
+// fetchTitle returns the title of an HTML page, "" if it can't be read
+func (b *titleBot) fetchTitle(url string) string {
+	resp, err := b.client.Get(url)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+		return ""
+	}
+	return findTitle(io.LimitReader(resp.Body, 1024*1024))
+}
+
+// findTitle returns the content of the title element of an HTML document
+func findTitle(r io.Reader) string {
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+	var title strings.Builder
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return cleanTitle(title.String())
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			inTitle = string(name) == "title"
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "title" {
+				return cleanTitle(title.String())
+			}
+		case html.TextToken:
+			if inTitle {
+				title.Write(tokenizer.Text())
+			}
+		}
+	}
+}
+
+// cleanTitle collapses the spaces of a title and truncates it
+func cleanTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	if runes := []rune(title); len(runes) > maxTitleLength {
+		title = string(runes[:maxTitleLength]) + "..."
+	}
+	return title
+}
@@ -0,0 +1,73 @@
+package chatserver
+
+import (
+	"io"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// page is the web client. It sends each line typed by the user as a text
+// frame terminated by a new line, and displays the frames received.
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chat</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+#log { height: 80vh; overflow-y: auto; border: 1px solid #ccc; padding: 0.5em; white-space: pre-wrap; font-family: monospace; }
+#line { width: 100%; margin-top: 0.5em; box-sizing: border-box; }
+</style>
+</head>
+<body>
+<div id="log"></div>
+<input id="line" autocomplete="off" placeholder="Type a message or /help" autofocus>
+<script>
+const log = document.getElementById("log");
+const line = document.getElementById("line");
+const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+const ws = new WebSocket(scheme + location.host + "/ws");
+
+function append(text) {
+	const div = document.createElement("div");
+	div.textContent = text;
+	log.appendChild(div);
+	log.scrollTop = log.scrollHeight;
+}
+
+ws.onmessage = (event) => append(event.data.replace(/\n$/, ""));
+ws.onclose = () => append("Disconnected");
+line.addEventListener("keydown", (event) => {
+	if (event.key === "Enter" && ws.readyState === WebSocket.OPEN) {
+		ws.send(line.value + "\n");
+		line.value = "";
+	}
+});
+</script>
+</body>
+</html>
+`
+
+// servePage sends the web client
+func servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, page)
+}
+
+// webHandler returns the HTTP handler of the web clients and of the metrics.
+// The WebSocket connections use the line protocol (one line per frame), so
+// that the web clients are handled as the TCP ones.
+func (s *Server) webHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", servePage)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+		s.handleConn(ws)
+	}))
+	return mux
+}
@@ -0,0 +1,294 @@
+// Package ftp is a FTP client (RFC 959) supporting the passive, extended
+// passive and active modes, machine listings (RFC 3659), restarted transfers
+// and explicit TLS (RFC 4217).
+package ftp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DataMode is the way data connections are established
+type DataMode int
+
+const (
+	// ExtendedPassive uses EPSV (RFC 2428), the server listens
+	ExtendedPassive DataMode = iota
+	// Passive uses PASV (IP V4 only), the server listens
+	Passive
+	// Active uses PORT or EPRT, the client listens
+	Active
+)
+
+// String returns the name of the mode
+func (mode DataMode) String() string {
+	switch mode {
+	case ExtendedPassive:
+		return "extended passive"
+	case Passive:
+		return "passive"
+	case Active:
+		return "active"
+	}
+	return fmt.Sprintf("DataMode(%d)", int(mode))
+}
+
+// Client is a FTP session. It is not safe for concurrent use.
+type Client struct {
+	conn      net.Conn
+	text      *textproto.Conn
+	host      string      // Host name of the server (used to verify its certificate)
+	tlsConfig *tls.Config // Configuration of the TLS connections, nil if TLS is not negotiated
+	mode      DataMode
+	binary    bool
+
+	// Timeout limits the establishment of the data connections (0 for no limit)
+	Timeout time.Duration
+}
+
+// Dial connects to a FTP server and reads its greeting
+func Dial(address string) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	c := &Client{
+		conn:    conn,
+		text:    textproto.NewConn(conn),
+		host:    host,
+		Timeout: 30 * time.Second,
+	}
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the control connection without sending QUIT
+func (c *Client) Close() error {
+	return c.text.Close()
+}
+
+// Quit ends the session and closes the control connection
+func (c *Client) Quit() error {
+	_, err := c.Command(221, "QUIT")
+	c.Close()
+	return err
+}
+
+// Command sends a command and reads its reply, checking its code as
+// textproto.Conn.ReadResponse does (e.g. 2 accepts any 2xx code)
+func (c *Client) Command(expectCode int, format string, args ...interface{}) (string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	_, message, err := c.text.ReadResponse(expectCode)
+	return message, err
+}
+
+// AuthTLS secures the control connection (AUTH TLS) and the data
+// connections (PROT P). A nil config verifies the certificate of the host.
+func (c *Client) AuthTLS(config *tls.Config) error {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName = c.host
+	}
+
+	// Negotiate TLS on the control connection
+	if _, err := c.Command(234, "AUTH TLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Close()
+		return err
+	}
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	c.tlsConfig = config
+
+	// Protect the data connections
+	if _, err := c.Command(200, "PBSZ 0"); err != nil {
+		return err
+	}
+	_, err := c.Command(200, "PROT P")
+	return err
+}
+
+// Login authenticates the user
+func (c *Client) Login(user, password string) error {
+	code, _, err := c.commandCode("USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+		return nil
+	case 331:
+		_, err = c.Command(230, "PASS %s", password)
+		return err
+	}
+	return &textproto.Error{Code: code, Msg: "unexpected reply to USER"}
+}
+
+// commandCode sends a command and returns the code of its reply, failing
+// only for 4xx and 5xx codes
+func (c *Client) commandCode(format string, args ...interface{}) (int, string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, message, err := c.text.ReadResponse(0)
+	if err == nil && code >= 400 {
+		err = &textproto.Error{Code: code, Msg: message}
+	}
+	return code, message, err
+}
+
+// SetMode selects the way the next data connections are established
+func (c *Client) SetMode(mode DataMode) {
+	c.mode = mode
+}
+
+// Mode returns the way data connections are established
+func (c *Client) Mode() DataMode {
+	return c.mode
+}
+
+// SetBinary selects the image type (TYPE I) or the ASCII type (TYPE A)
+func (c *Client) SetBinary(binary bool) error {
+	typeCode := "A"
+	if binary {
+		typeCode = "I"
+	}
+	if _, err := c.Command(200, "TYPE %s", typeCode); err != nil {
+		return err
+	}
+	c.binary = binary
+	return nil
+}
+
+// Binary returns true if the image type is selected
+func (c *Client) Binary() bool {
+	return c.binary
+}
+
+// Secured returns true if the session uses TLS
+func (c *Client) Secured() bool {
+	return c.tlsConfig != nil
+}
+
+// CurrentDir returns the working directory
+func (c *Client) CurrentDir() (string, error) {
+	message, err := c.Command(257, "PWD")
+	if err != nil {
+		return "", err
+	}
+	return quotedPath(message)
+}
+
+// quotedPath extracts the path of a 257 reply ("path" with doubled quotes)
+func quotedPath(message string) (string, error) {
+	if !strings.HasPrefix(message, "\"") {
+		return "", fmt.Errorf("ftp: invalid path reply: %s", message)
+	}
+	var b strings.Builder
+	for i := 1; i < len(message); i++ {
+		if message[i] == '"' {
+			if i+1 < len(message) && message[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+				continue
+			}
+			return b.String(), nil
+		}
+		b.WriteByte(message[i])
+	}
+	return "", fmt.Errorf("ftp: invalid path reply: %s", message)
+}
+
+// ChangeDir changes the working directory
+func (c *Client) ChangeDir(dir string) error {
+	_, err := c.Command(250, "CWD %s", dir)
+	return err
+}
+
+// MakeDir creates a directory and returns its path
+func (c *Client) MakeDir(dir string) (string, error) {
+	message, err := c.Command(257, "MKD %s", dir)
+	if err != nil {
+		return "", err
+	}
+	return quotedPath(message)
+}
+
+// RemoveDir removes an empty directory
+func (c *Client) RemoveDir(dir string) error {
+	_, err := c.Command(250, "RMD %s", dir)
+	return err
+}
+
+// Delete removes a file
+func (c *Client) Delete(name string) error {
+	_, err := c.Command(250, "DELE %s", name)
+	return err
+}
+
+// Rename moves a file or a directory
+func (c *Client) Rename(oldName, newName string) error {
+	if _, err := c.Command(350, "RNFR %s", oldName); err != nil {
+		return err
+	}
+	_, err := c.Command(250, "RNTO %s", newName)
+	return err
+}
+
+// Size returns the size of a file (RFC 3659)
+func (c *Client) Size(name string) (int64, error) {
+	message, err := c.Command(213, "SIZE %s", name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(message), 10, 64)
+}
+
+// ModTime returns the modification time of a file (RFC 3659)
+func (c *Client) ModTime(name string) (time.Time, error) {
+	message, err := c.Command(213, "MDTM %s", name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseTimeVal(strings.TrimSpace(message))
+}
+
+// Features returns the features announced by FEAT (RFC 2389)
+func (c *Client) Features() ([]string, error) {
+	message, err := c.Command(211, "FEAT")
+	if err != nil {
+		return nil, err
+	}
+
+	// The first and last lines are not features
+	lines := strings.Split(message, "\n")
+	var features []string
+	for i := 1; i < len(lines)-1; i++ {
+		if feature := strings.TrimSpace(lines[i]); feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return features, nil
+}
@@ -0,0 +1,321 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dataConnection is the data connection of a transfer, completed by the
+// reply of the server once it is closed
+type dataConnection struct {
+	net.Conn
+	client *Client
+	closed bool
+}
+
+// Close closes the data connection and reads the completion reply
+func (dc *dataConnection) Close() error {
+	if dc.closed {
+		return nil
+	}
+	dc.closed = true
+	dc.Conn.Close()
+	_, _, err := dc.client.text.ReadResponse(2)
+	return err
+}
+
+// parsePassive extracts the endpoint of a 227 reply: (h1,h2,h3,h4,p1,p2)
+func parsePassive(message string) (string, error) {
+	start := strings.Index(message, "(")
+	end := strings.LastIndex(message, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("ftp: invalid PASV reply: %s", message)
+	}
+	params := strings.Split(message[start+1:end], ",")
+	if len(params) != 6 {
+		return "", fmt.Errorf("ftp: invalid PASV reply: %s", message)
+	}
+	var b [6]byte
+	for i, param := range params {
+		v, err := strconv.ParseUint(strings.TrimSpace(param), 10, 8)
+		if err != nil {
+			return "", fmt.Errorf("ftp: invalid PASV reply: %s", message)
+		}
+		b[i] = byte(v)
+	}
+	ip := net.IPv4(b[0], b[1], b[2], b[3])
+	port := int(b[4])<<8 | int(b[5])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// parseExtendedPassive extracts the port of a 229 reply: (|||port|)
+func parseExtendedPassive(message string) (string, error) {
+	start := strings.Index(message, "(")
+	end := strings.LastIndex(message, ")")
+	if start < 0 || end < start+2 {
+		return "", fmt.Errorf("ftp: invalid EPSV reply: %s", message)
+	}
+	body := message[start+1 : end]
+	delim := string(body[0])
+	params := strings.Split(body, delim)
+	if len(params) != 5 {
+		return "", fmt.Errorf("ftp: invalid EPSV reply: %s", message)
+	}
+	port, err := strconv.ParseUint(params[3], 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("ftp: invalid EPSV reply: %s", message)
+	}
+	return params[3], nil
+}
+
+// dial establishes a passive data connection
+func (c *Client) dial(address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: c.Timeout}
+	return dialer.Dial("tcp", address)
+}
+
+// passive asks the server to listen and connects to it
+func (c *Client) passive() (net.Conn, error) {
+	if c.mode == Passive {
+		message, err := c.Command(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		address, err := parsePassive(message)
+		if err != nil {
+			return nil, err
+		}
+		return c.dial(address)
+	}
+
+	message, err := c.Command(229, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	port, err := parseExtendedPassive(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// The data connection uses the host of the control connection
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	return c.dial(net.JoinHostPort(host, port))
+}
+
+// listen listens for an active data connection and sends its endpoint to the
+// server, using PORT for IP V4 and EPRT for IP V6
+func (c *Client) listen() (net.Listener, error) {
+	host, _, err := net.SplitHostPort(c.conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+
+	if ipv4 := addr.IP.To4(); ipv4 != nil {
+		_, err = c.Command(200, "PORT %d,%d,%d,%d,%d,%d",
+			ipv4[0], ipv4[1], ipv4[2], ipv4[3], addr.Port>>8, addr.Port&0xFF)
+	} else {
+		_, err = c.Command(200, "EPRT |2|%s|%d|", addr.IP, addr.Port)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// transfer runs a command transferring data and returns its data connection.
+// Closing the data connection reads the completion reply.
+func (c *Client) transfer(format string, args ...interface{}) (*dataConnection, error) {
+	// Prepare the data connection
+	var conn net.Conn
+	var listener net.Listener
+	var err error
+	if c.mode == Active {
+		listener, err = c.listen()
+		if err == nil {
+			defer listener.Close()
+		}
+	} else {
+		conn, err = c.passive()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the command (the server replies 125 or 150 before the transfer)
+	if _, _, err := c.commandCode(format, args...); err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+
+	// Wait for the server in active mode
+	if listener != nil {
+		if tcpListener, ok := listener.(*net.TCPListener); ok && c.Timeout > 0 {
+			tcpListener.SetDeadline(time.Now().Add(c.Timeout))
+		}
+		conn, err = listener.Accept()
+		if err != nil {
+			c.text.ReadResponse(0)
+			return nil, err
+		}
+	}
+
+	// Protect the data connection (the client is always the TLS client)
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			c.text.ReadResponse(0)
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return &dataConnection{Conn: conn, client: c}, nil
+}
+
+// restart sends the offset of a restarted transfer
+func (c *Client) restart(offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	_, err := c.Command(350, "REST %d", offset)
+	return err
+}
+
+// Retrieve downloads a file from the offset and returns the number of bytes received
+func (c *Client) Retrieve(name string, w io.Writer, offset int64) (int64, error) {
+	if err := c.restart(offset); err != nil {
+		return 0, err
+	}
+	data, err := c.transfer("RETR %s", name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, data)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// Store uploads a file, overwriting it from the offset, and returns the number of bytes sent
+func (c *Client) Store(name string, r io.Reader, offset int64) (int64, error) {
+	if err := c.restart(offset); err != nil {
+		return 0, err
+	}
+	return c.send(r, "STOR %s", name)
+}
+
+// Append uploads data at the end of a file and returns the number of bytes sent
+func (c *Client) Append(name string, r io.Reader) (int64, error) {
+	return c.send(r, "APPE %s", name)
+}
+
+// send runs a command uploading data
+func (c *Client) send(r io.Reader, format string, args ...interface{}) (int64, error) {
+	data, err := c.transfer(format, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(data, r)
+	if err != nil {
+		data.Conn.Close()
+		data.Close()
+		return n, err
+	}
+
+	// TLS connections must be properly closed so that the server gets all the data
+	if tlsConn, ok := data.Conn.(*tls.Conn); ok {
+		tlsConn.CloseWrite()
+	}
+	return n, data.Close()
+}
+
+// readLines runs a command returning lines of text
+func (c *Client) readLines(format string, args ...interface{}) ([]string, error) {
+	data, err := c.transfer(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(data)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// List returns the lines of the LIST command (the format depends on the server)
+func (c *Client) List(dir string) ([]string, error) {
+	if dir == "" {
+		return c.readLines("LIST")
+	}
+	return c.readLines("LIST %s", dir)
+}
+
+// MachineList returns the content of a directory (MLSD, RFC 3659).
+// The entries of the directory itself and of its parent are skipped.
+func (c *Client) MachineList(dir string) ([]Entry, error) {
+	var lines []string
+	var err error
+	if dir == "" {
+		lines, err = c.readLines("MLSD")
+	} else {
+		lines, err = c.readLines("MLSD %s", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, line := range lines {
+		entry, err := ParseEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Type != "cdir" && entry.Type != "pdir" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Stat returns the description of a file or a directory (MLST, RFC 3659)
+func (c *Client) Stat(name string) (Entry, error) {
+	message, err := c.Command(250, "MLST %s", name)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	// The entry is the second line of the reply
+	lines := strings.Split(message, "\n")
+	if len(lines) < 2 {
+		return Entry{}, fmt.Errorf("ftp: invalid MLST reply: %s", message)
+	}
+	return ParseEntry(strings.TrimPrefix(lines[1], " "))
+}
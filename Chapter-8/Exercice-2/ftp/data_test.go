@@ -0,0 +1,71 @@
+package ftp
+
+import "testing"
+
+func TestParsePassive(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{"Entering passive mode (127,0,0,1,4,1).", "127.0.0.1:1025"},
+		{"Entering Passive Mode (10, 1, 2, 3, 195, 80)", "10.1.2.3:50000"},
+		{"Entering passive mode (127,0,0,1,4).", ""},
+		{"Entering passive mode (127,0,0,256,4,1).", ""},
+		{"Entering passive mode", ""},
+	}
+	for _, test := range tests {
+		address, err := parsePassive(test.message)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("parsePassive(%q) = %s, want an error", test.message, address)
+			}
+		} else if err != nil || address != test.expected {
+			t.Errorf("parsePassive(%q) = %s, %v, want %s", test.message, address, err, test.expected)
+		}
+	}
+}
+
+func TestParseExtendedPassive(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{"Entering extended passive mode (|||6446|).", "6446"},
+		{"Entering extended passive mode (!!!6446!)", "6446"},
+		{"Entering extended passive mode (|||0|).", ""},
+		{"Entering extended passive mode (||6446|).", ""},
+		{"Entering extended passive mode ()", ""},
+	}
+	for _, test := range tests {
+		port, err := parseExtendedPassive(test.message)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("parseExtendedPassive(%q) = %s, want an error", test.message, port)
+			}
+		} else if err != nil || port != test.expected {
+			t.Errorf("parseExtendedPassive(%q) = %s, %v, want %s", test.message, port, err, test.expected)
+		}
+	}
+}
+
+func TestQuotedPath(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{`"/" is the current directory.`, "/"},
+		{`"/a ""quoted"" dir" directory created.`, `/a "quoted" dir`},
+		{`/ is the current directory.`, ""},
+		{`"/unterminated`, ""},
+	}
+	for _, test := range tests {
+		path, err := quotedPath(test.message)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("quotedPath(%q) = %s, want an error", test.message, path)
+			}
+		} else if err != nil || path != test.expected {
+			t.Errorf("quotedPath(%q) = %s, %v, want %s", test.message, path, err, test.expected)
+		}
+	}
+}
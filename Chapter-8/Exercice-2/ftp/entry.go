@@ -0,0 +1,74 @@
+package ftp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a file or a directory described by MLSD or MLST (RFC 3659)
+type Entry struct {
+	Name    string
+	Type    string // file, dir, cdir or pdir ("" if unknown)
+	Size    int64  // -1 if unknown
+	ModTime time.Time
+	Facts   map[string]string // All the facts, indexed by lower case name
+}
+
+// IsDir returns true if the entry is a directory
+func (e Entry) IsDir() bool {
+	return e.Type == "dir" || e.Type == "cdir" || e.Type == "pdir"
+}
+
+// ParseEntry parses a line formatted as "fact=value;fact=value; name"
+func ParseEntry(line string) (Entry, error) {
+	facts, name, ok := strings.Cut(line, " ")
+	if !ok {
+		return Entry{}, fmt.Errorf("ftp: invalid entry: %s", line)
+	}
+
+	entry := Entry{Name: name, Size: -1, Facts: make(map[string]string)}
+	for _, fact := range strings.Split(facts, ";") {
+		if fact == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(fact, "=")
+		if !ok {
+			return Entry{}, fmt.Errorf("ftp: invalid fact: %s", fact)
+		}
+		key = strings.ToLower(key)
+		entry.Facts[key] = value
+
+		switch key {
+		case "type":
+			entry.Type = strings.ToLower(value)
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return Entry{}, fmt.Errorf("ftp: invalid size: %s", value)
+			}
+			entry.Size = size
+		case "modify":
+			modTime, err := parseTimeVal(value)
+			if err != nil {
+				return Entry{}, err
+			}
+			entry.ModTime = modTime
+		}
+	}
+	return entry, nil
+}
+
+// parseTimeVal parses a time-val (YYYYMMDDHHMMSS[.sss] in UTC)
+func parseTimeVal(value string) (time.Time, error) {
+	layout := "20060102150405"
+	if len(value) > len(layout) {
+		layout += "." + strings.Repeat("0", len(value)-len(layout)-1)
+	}
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ftp: invalid time: %s", value)
+	}
+	return t, nil
+}
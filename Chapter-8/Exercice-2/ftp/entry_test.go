@@ -0,0 +1,36 @@
+package ftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEntry(t *testing.T) {
+	entry, err := ParseEntry("type=file;size=1234;modify=20200102030405;perm=adfrw;unique=1f; my file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "my file.txt" || entry.Type != "file" || entry.Size != 1234 || entry.IsDir() {
+		t.Errorf("got %+v", entry)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !entry.ModTime.Equal(want) {
+		t.Errorf("ModTime = %v, want %v", entry.ModTime, want)
+	}
+	if entry.Facts["perm"] != "adfrw" || entry.Facts["unique"] != "1f" {
+		t.Errorf("Facts = %v", entry.Facts)
+	}
+
+	entry, err = ParseEntry("Type=DIR;Modify=20200102030405.123; dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "dir" || !entry.IsDir() || entry.Size != -1 || entry.ModTime.Nanosecond() != 123000000 {
+		t.Errorf("got %+v", entry)
+	}
+
+	for _, line := range []string{"type=file;", "type;  name", "size=abc; name", "modify=2020; name"} {
+		if _, err := ParseEntry(line); err == nil {
+			t.Errorf("ParseEntry(%q) succeeded", line)
+		}
+	}
+}
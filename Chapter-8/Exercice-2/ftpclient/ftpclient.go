@@ -0,0 +1,487 @@
+// ftpclient is an interactive FTP client
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"GoExercices/Chapter-8/Exercice-2/ftp"
+	"golang.org/x/term"
+)
+
+// session is the state of the interactive client
+type session struct {
+	client   *ftp.Client
+	input    *bufio.Scanner
+	useTLS   bool // Negotiate TLS before login
+	insecure bool // Do not verify the certificate of the server
+}
+
+// command is an interactive command
+type command struct {
+	usage string
+	help  string
+	run   func(s *session, args []string) error
+}
+
+// commands are the interactive commands, indexed by name
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"open":    {"open <host[:port]>", "connect to a server and log in", (*session).open},
+		"close":   {"close", "end the session", (*session).close},
+		"ls":      {"ls [dir]", "list a directory (LIST)", (*session).list},
+		"mls":     {"mls [dir]", "list a directory (MLSD)", (*session).machineList},
+		"cd":      {"cd <dir>", "change the remote directory", (*session).changeDir},
+		"pwd":     {"pwd", "print the remote directory", (*session).printDir},
+		"get":     {"get <remote> [local]", "download a file", (*session).get},
+		"reget":   {"reget <remote> [local]", "resume the download of a file", (*session).reget},
+		"put":     {"put <local> [remote]", "upload a file", (*session).put},
+		"reput":   {"reput <local> [remote]", "resume the upload of a file", (*session).reput},
+		"mkdir":   {"mkdir <dir>", "create a remote directory", (*session).makeDir},
+		"rmdir":   {"rmdir <dir>", "remove a remote directory", (*session).removeDir},
+		"delete":  {"delete <file>", "delete a remote file", (*session).delete},
+		"rename":  {"rename <from> <to>", "rename a remote file", (*session).rename},
+		"size":    {"size <file>", "print the size of a remote file", (*session).size},
+		"binary":  {"binary", "transfer files in image type", (*session).binary},
+		"ascii":   {"ascii", "transfer files in ASCII type", (*session).ascii},
+		"passive": {"passive [epsv|pasv|active]", "select the data connection mode", (*session).passive},
+		"quote":   {"quote <command>", "send a raw command", (*session).quote},
+		"help":    {"help", "print the commands", (*session).help},
+	}
+}
+
+// connected returns an error if no session is open
+func (s *session) connected() error {
+	if s.client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return nil
+}
+
+// prompt reads a line typed by the user
+func (s *session) prompt(format string, args ...interface{}) (string, bool) {
+	fmt.Printf(format, args...)
+	if !s.input.Scan() {
+		return "", false
+	}
+	return strings.TrimSpace(s.input.Text()), true
+}
+
+// promptPassword reads a password typed by the user, without echo when the
+// standard input is a terminal
+func (s *session) promptPassword(format string, args ...interface{}) (string, bool) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return s.prompt(format, args...)
+	}
+	fmt.Printf(format, args...)
+	password, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", false
+	}
+	return string(password), true
+}
+
+// open connects to a server and logs in
+func (s *session) open(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: open <host[:port]>")
+	}
+	if s.client != nil {
+		s.close(nil)
+	}
+
+	address := args[0]
+	if !strings.Contains(address, ":") || strings.HasSuffix(address, "]") {
+		address += ":21"
+	}
+	client, err := ftp.Dial(address)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Connected to %s\n", address)
+
+	if s.useTLS {
+		if err := client.AuthTLS(&tls.Config{InsecureSkipVerify: s.insecure}); err != nil {
+			client.Close()
+			return err
+		}
+		fmt.Println("TLS negotiated")
+	}
+
+	user, _ := s.prompt("Name: ")
+	password, _ := s.promptPassword("Password: ")
+	if err := client.Login(user, password); err != nil {
+		client.Close()
+		return err
+	}
+	if err := client.SetBinary(true); err != nil {
+		client.Close()
+		return err
+	}
+	s.client = client
+	fmt.Println("Logged in, using binary mode")
+	return nil
+}
+
+// close ends the session
+func (s *session) close(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	err := s.client.Quit()
+	s.client = nil
+	return err
+}
+
+// list prints the LIST lines of a directory
+func (s *session) list(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	lines, err := s.client.List(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// machineList prints the MLSD entries of a directory
+func (s *session) machineList(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	entries, err := s.client.MachineList(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for _, entry := range entries {
+		size := "-"
+		if entry.Size >= 0 {
+			size = fmt.Sprint(entry.Size)
+		}
+		fmt.Printf("%-4s %12s %s %s\n", entry.Type, size, entry.ModTime.Format("2006-01-02 15:04"), entry.Name)
+	}
+	return nil
+}
+
+// changeDir changes the remote directory
+func (s *session) changeDir(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("usage: cd <dir>")
+	}
+	return s.client.ChangeDir(strings.Join(args, " "))
+}
+
+// printDir prints the remote directory
+func (s *session) printDir(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	dir, err := s.client.CurrentDir()
+	if err != nil {
+		return err
+	}
+	fmt.Println(dir)
+	return nil
+}
+
+// transferNames returns the source and destination of a transfer
+func transferNames(args []string) (string, string, error) {
+	switch len(args) {
+	case 1:
+		return args[0], path.Base(args[0]), nil
+	case 2:
+		return args[0], args[1], nil
+	}
+	return "", "", fmt.Errorf("invalid arguments count")
+}
+
+// get downloads a file
+func (s *session) get(args []string) error {
+	return s.download(args, false)
+}
+
+// reget resumes the download of a file
+func (s *session) reget(args []string) error {
+	return s.download(args, true)
+}
+
+// download downloads a file, from the size of the local file if resume is true
+func (s *session) download(args []string, resume bool) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	remote, local, err := transferNames(args)
+	if err != nil {
+		return err
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(local, mode, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	n, err := s.client.Retrieve(remote, file, offset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes received\n", n)
+	return nil
+}
+
+// put uploads a file
+func (s *session) put(args []string) error {
+	return s.upload(args, false)
+}
+
+// reput resumes the upload of a file
+func (s *session) reput(args []string) error {
+	return s.upload(args, true)
+}
+
+// upload uploads a file, from the size of the remote file if resume is true
+func (s *session) upload(args []string, resume bool) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	local, remote, err := transferNames(args)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	if resume {
+		if offset, err = s.client.Size(remote); err != nil {
+			return err
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	n, err := s.client.Store(remote, file, offset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d bytes sent\n", n)
+	return nil
+}
+
+// makeDir creates a remote directory
+func (s *session) makeDir(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("usage: mkdir <dir>")
+	}
+	dir, err := s.client.MakeDir(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s created\n", dir)
+	return nil
+}
+
+// removeDir removes a remote directory
+func (s *session) removeDir(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("usage: rmdir <dir>")
+	}
+	return s.client.RemoveDir(strings.Join(args, " "))
+}
+
+// delete deletes a remote file
+func (s *session) delete(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("usage: delete <file>")
+	}
+	return s.client.Delete(strings.Join(args, " "))
+}
+
+// rename renames a remote file
+func (s *session) rename(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: rename <from> <to>")
+	}
+	return s.client.Rename(args[0], args[1])
+}
+
+// size prints the size of a remote file
+func (s *session) size(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("usage: size <file>")
+	}
+	size, err := s.client.Size(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Println(size)
+	return nil
+}
+
+// binary selects the image type
+func (s *session) binary(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	return s.client.SetBinary(true)
+}
+
+// ascii selects the ASCII type
+func (s *session) ascii(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	return s.client.SetBinary(false)
+}
+
+// passive selects the data connection mode
+func (s *session) passive(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		fmt.Printf("Using %s mode\n", s.client.Mode())
+		return nil
+	}
+	switch strings.ToLower(args[0]) {
+	case "epsv":
+		s.client.SetMode(ftp.ExtendedPassive)
+	case "pasv":
+		s.client.SetMode(ftp.Passive)
+	case "active":
+		s.client.SetMode(ftp.Active)
+	default:
+		return fmt.Errorf("usage: passive [epsv|pasv|active]")
+	}
+	return nil
+}
+
+// quote sends a raw command
+func (s *session) quote(args []string) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("usage: quote <command>")
+	}
+	message, err := s.client.Command(0, "%s", strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	fmt.Println(message)
+	return nil
+}
+
+// help prints the commands
+func (s *session) help(args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%-28s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Printf("%-28s %s\n", "quit", "end the session and exit")
+	return nil
+}
+
+// main is the entry point of the program
+func main() {
+	// Get parameters
+	useTLS := flag.Bool("tls", false, "Negotiate TLS (AUTH TLS) before login")
+	insecure := flag.Bool("insecure", false, "Do not verify the certificate of the server")
+	flag.Parse()
+
+	s := &session{
+		input:    bufio.NewScanner(os.Stdin),
+		useTLS:   *useTLS,
+		insecure: *insecure,
+	}
+
+	// Connect to the server given on the command line
+	if flag.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-tls] [-insecure] [host[:port]]\n", os.Args[0])
+		os.Exit(2)
+	}
+	if flag.NArg() == 1 {
+		if err := s.open(flag.Args()); err != nil {
+			log.Printf("open: %v", err)
+		}
+	}
+
+	// Run the commands typed by the user
+	for {
+		line, ok := s.prompt("ftp> ")
+		if !ok {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if name == "quit" || name == "bye" {
+			break
+		}
+		cmd, ok := commands[name]
+		if !ok {
+			fmt.Printf("Unknown command: %s (type help)\n", fields[0])
+			continue
+		}
+		if err := cmd.run(s, fields[1:]); err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+		}
+	}
+
+	if s.client != nil {
+		s.client.Quit()
+	}
+}
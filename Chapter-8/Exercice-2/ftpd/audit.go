@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLog writes the transfer records (xferlog format) and the audit events
+// (one JSON object per line) to their sinks. A nil auditLog writes nothing.
+type auditLog struct {
+	mu     sync.Mutex // Serializes the records of concurrent sessions
+	xfer   io.Writer  // nil if the transfers are not logged
+	events io.Writer  // nil if the audit events are not logged
+}
+
+// transferRecord is a completed (or interrupted) file transfer
+type transferRecord struct {
+	start     time.Time
+	host      string // Remote host
+	size      int64  // Bytes transferred
+	fileName  string // Virtual path
+	binary    bool
+	incoming  bool // true for an upload
+	anonymous bool
+	user      string
+	secured   bool // true if the control connection uses TLS
+	complete  bool
+}
+
+// auditEvent is a security related action of a user
+type auditEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"` // login, delete, rmdir or rename
+	User    string    `json:"user"`
+	Host    string    `json:"host"`
+	Path    string    `json:"path,omitempty"`
+	NewPath string    `json:"newPath,omitempty"` // Target of a rename
+	Success bool      `json:"success"`
+	Reason  string    `json:"reason,omitempty"` // Cause of a failure
+}
+
+// openSink opens the destination of a log: "-" for the standard output,
+// "tcp://host:port" or "udp://host:port" for a network collector,
+// a file name otherwise (the records are appended)
+func openSink(name string) (io.Writer, error) {
+	if name == "-" {
+		return os.Stdout, nil
+	}
+	if network, address, ok := strings.Cut(name, "://"); ok {
+		switch network {
+		case "tcp", "udp":
+			return net.Dial(network, address)
+		default:
+			return nil, fmt.Errorf("unsupported log network: %s", network)
+		}
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// xferlogLine formats a transfer record as a line of the wu-ftpd xferlog file:
+// current-time transfer-time remote-host file-size filename transfer-type
+// special-action-flag direction access-mode username service-name
+// authentication-method authenticated-user-id completion-status
+func xferlogLine(rec transferRecord, now time.Time) string {
+	transferType := "a"
+	if rec.binary {
+		transferType = "b"
+	}
+	direction := "o"
+	if rec.incoming {
+		direction = "i"
+	}
+	accessMode := "r"
+	if rec.anonymous {
+		accessMode = "a"
+	}
+	serviceName := "ftp"
+	if rec.secured {
+		serviceName = "ftps"
+	}
+	status := "i"
+	if rec.complete {
+		status = "c"
+	}
+
+	// The fields are separated by spaces, which can't appear in them
+	fileName := strings.ReplaceAll(rec.fileName, " ", "_")
+
+	return fmt.Sprintf("%s %d %s %d %s %s _ %s %s %s %s 0 * %s\n",
+		now.Format(time.ANSIC), int64(now.Sub(rec.start).Seconds()+0.5), rec.host, rec.size,
+		fileName, transferType, direction, accessMode, rec.user, serviceName, status)
+}
+
+// transfer writes a transfer record
+func (a *auditLog) transfer(rec transferRecord) {
+	if a == nil || a.xfer == nil {
+		return
+	}
+	line := xferlogLine(rec, time.Now())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	io.WriteString(a.xfer, line)
+}
+
+// event writes an audit event
+func (a *auditLog) event(ev auditEvent) {
+	if a == nil || a.events == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events.Write(append(line, '\n'))
+}
+
+// maskPassword hides the password of a PASS command line before logging it
+func maskPassword(line string) string {
+	command, _, _ := strings.Cut(line, " ")
+	if strings.EqualFold(command, "PASS") {
+		return command + " ****"
+	}
+	return line
+}
+
+// logTransfer records a transfer of the session
+func (conn *FtpConnection) logTransfer(start time.Time, fileName string, size int64, incoming, complete bool) {
+	conn.server.audit.transfer(transferRecord{
+		start:     start,
+		host:      remoteHost(conn.tcpConnection),
+		size:      size,
+		fileName:  fileName,
+		binary:    conn.binary,
+		incoming:  incoming,
+		anonymous: isAnonymous(conn.user),
+		user:      conn.user,
+		secured:   conn.secured,
+		complete:  complete,
+	})
+}
+
+// logEvent records an audit event of the session
+func (conn *FtpConnection) logEvent(event, fileName, newName string, err error) {
+	ev := auditEvent{
+		Event:   event,
+		User:    conn.user,
+		Host:    remoteHost(conn.tcpConnection),
+		Path:    fileName,
+		NewPath: newName,
+		Success: err == nil,
+	}
+	if err != nil {
+		ev.Reason = err.Error()
+	}
+	conn.server.audit.event(ev)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestXferlogLine(t *testing.T) {
+	start := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	now := start.Add(2600 * time.Millisecond)
+
+	tests := []struct {
+		rec      transferRecord
+		expected string
+	}{
+		{
+			transferRecord{start: start, host: "10.0.0.1", size: 1234, fileName: "/dir/my file",
+				binary: true, anonymous: true, user: "anonymous", complete: true},
+			"Thu Mar  4 05:06:09 2021 3 10.0.0.1 1234 /dir/my_file b _ o a anonymous ftp 0 * c\n",
+		},
+		{
+			transferRecord{start: start, host: "::1", size: 10, fileName: "/up",
+				incoming: true, user: "alice", secured: true},
+			"Thu Mar  4 05:06:09 2021 3 ::1 10 /up a _ i r alice ftps 0 * i\n",
+		},
+	}
+
+	for _, test := range tests {
+		if line := xferlogLine(test.rec, now); line != test.expected {
+			t.Errorf("got %q, want %q", line, test.expected)
+		}
+	}
+}
+
+func TestMaskPassword(t *testing.T) {
+	tests := map[string]string{
+		"PASS secret":      "PASS ****",
+		"pass two words":   "pass ****",
+		"USER alice":       "USER alice",
+		"PASSIVE argument": "PASSIVE argument",
+	}
+	for line, expected := range tests {
+		if got := maskPassword(line); got != expected {
+			t.Errorf("maskPassword(%q) = %q, want %q", line, got, expected)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator checks the credentials of a user
+type Authenticator interface {
+	// Authenticate returns true if the password is valid for the user
+	Authenticate(user, password string) bool
+}
+
+// HomeProvider is implemented by the authenticators knowing the root directory of users
+type HomeProvider interface {
+	// Home returns the root directory of the user ("" if unknown)
+	Home(user string) string
+}
+
+// userCredentials is the bcrypt hash of a user password
+type userCredentials struct {
+	hash         []byte
+	home         string
+	quota        int64 // -1 if the user has no specific quota
+	uploadRate   int64 // -1 if the user has no specific upload rate
+	downloadRate int64 // -1 if the user has no specific download rate
+}
+
+// FileAuthenticator is an authenticator backed by a credentials file.
+// Each line of the file is formatted as
+// "user:hash[:home[:quota[:uploadrate[:downloadrate]]]]" where hash is the
+// bcrypt hash of the password (salt and cost included), home is the optional
+// root directory of the user, quota its optional disk quota and the rates its
+// optional bandwidths in bytes per second (e.g. 100M or 512K, 0 for no limit,
+// empty for the server settings).
+// Empty lines and lines starting with '#' are ignored.
+type FileAuthenticator struct {
+	users map[string]userCredentials
+}
+
+// NewFileAuthenticator loads the credentials file
+func NewFileAuthenticator(fileName string) (*FileAuthenticator, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	auth := &FileAuthenticator{users: make(map[string]userCredentials)}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		// Skip empty lines and comments
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		// Split the line
+		fields := strings.SplitN(line, ":", 6)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: invalid credentials line", fileName, lineNumber)
+		}
+
+		// Check the hash
+		hash := []byte(fields[1])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid hash: %v", fileName, lineNumber, err)
+		}
+
+		credentials := userCredentials{hash: hash, quota: -1, uploadRate: -1, downloadRate: -1}
+		if len(fields) >= 3 {
+			credentials.home = fields[2]
+		}
+
+		// Parse the optional sizes
+		for i, size := range []*int64{&credentials.quota, &credentials.uploadRate, &credentials.downloadRate} {
+			if len(fields) <= 3+i || fields[3+i] == "" {
+				continue
+			}
+			value, err := parseSize(fields[3+i])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fileName, lineNumber, err)
+			}
+			*size = value
+		}
+		auth.users[fields[0]] = credentials
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
+
+// Authenticate returns true if the password is valid for the user
+func (auth *FileAuthenticator) Authenticate(user, password string) bool {
+	credentials, ok := auth.users[user]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(credentials.hash, []byte(password)) == nil
+}
+
+// Home returns the root directory of the user ("" if unknown)
+func (auth *FileAuthenticator) Home(user string) string {
+	return auth.users[user].home
+}
+
+// Quota returns the disk quota of the user (0 for no limit),
+// ok is false if the user has no specific quota
+func (auth *FileAuthenticator) Quota(user string) (int64, bool) {
+	credentials, found := auth.users[user]
+	if !found || credentials.quota < 0 {
+		return 0, false
+	}
+	return credentials.quota, true
+}
+
+// Rates returns the upload and download bandwidths of the user in bytes per
+// second (0 for no limit, -1 if the user has no specific rate)
+func (auth *FileAuthenticator) Rates(user string) (upload, download int64) {
+	credentials, found := auth.users[user]
+	if !found {
+		return -1, -1
+	}
+	return credentials.uploadRate, credentials.downloadRate
+}
+
+// CredentialsLine builds a credentials file line for a user, hashing the
+// password with bcrypt and a random salt
+func CredentialsLine(user, password string) (string, error) {
+	if user == "" || strings.ContainsAny(user, ": \t") {
+		return "", fmt.Errorf("invalid user name: %q", user)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", user, hash), nil
+}
+
+// isAnonymous returns true if the user name designates an anonymous login
+func isAnonymous(user string) bool {
+	return user == "anonymous" || user == "ftp"
+}
+
+// Causes of the failed logins reported in the audit events
+var (
+	errLoginFailed  = errors.New("invalid credentials")
+	errLoginBlocked = errors.New("too many failed logins")
+)
+
+// loginFailures is the failed login history of a remote host
+type loginFailures struct {
+	count int
+	first time.Time
+}
+
+// loginLimiter limits the number of failed logins per remote host
+type loginLimiter struct {
+	mu          sync.Mutex
+	maxFailures int
+	window      time.Duration
+	failures    map[string]*loginFailures
+}
+
+// newLoginLimiter creates a limiter allowing maxFailures failed logins per window
+func newLoginLimiter(maxFailures int, window time.Duration) *loginLimiter {
+	return &loginLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		failures:    make(map[string]*loginFailures),
+	}
+}
+
+// blocked returns true if the remote host exceeded the failed logins limit
+func (l *loginLimiter) blocked(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[host]
+	if !ok {
+		return false
+	}
+
+	// Forget the history once the window is over
+	if time.Since(f.first) > l.window {
+		delete(l.failures, host)
+		return false
+	}
+	return f.count >= l.maxFailures
+}
+
+// failed records a failed login for the remote host
+func (l *loginLimiter) failed(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[host]
+	if !ok || time.Since(f.first) > l.window {
+		f = &loginFailures{first: time.Now()}
+		l.failures[host] = f
+	}
+	f.count++
+}
+
+// succeeded clears the failed logins history of the remote host
+func (l *loginLimiter) succeeded(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, host)
+}
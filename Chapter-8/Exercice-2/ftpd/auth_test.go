@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileAuthenticator(t *testing.T) {
+	line, err := CredentialsLine("alice", "secret")
+	if err != nil {
+		t.Fatalf("CredentialsLine failed: %v", err)
+	}
+
+	other, err := CredentialsLine("carol", "secret")
+	if err != nil {
+		t.Fatalf("CredentialsLine failed: %v", err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "users")
+	content := "# users\n\n" + line + ":/srv/ftp/alice\n" + other + "::10M::512K\n"
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write credentials: %v", err)
+	}
+
+	auth, err := NewFileAuthenticator(fileName)
+	if err != nil {
+		t.Fatalf("NewFileAuthenticator failed: %v", err)
+	}
+
+	var tests = []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "Secret", false},
+		{"alice", "", false},
+		{"bob", "secret", false},
+	}
+	if got, want := auth.Home("alice"), "/srv/ftp/alice"; got != want {
+		t.Errorf("Home(alice) = %q, want %q", got, want)
+	}
+	if got := auth.Home("bob"); got != "" {
+		t.Errorf("Home(bob) = %q, want \"\"", got)
+	}
+	if got, ok := auth.Quota("carol"); !ok || got != 10<<20 {
+		t.Errorf("Quota(carol) = %d, %v, want %d", got, ok, 10<<20)
+	}
+	if got, ok := auth.Quota("alice"); ok {
+		t.Errorf("Quota(alice) = %d, want no quota", got)
+	}
+	if upload, download := auth.Rates("carol"); upload != -1 || download != 512<<10 {
+		t.Errorf("Rates(carol) = %d, %d, want -1, %d", upload, download, 512<<10)
+	}
+	if upload, download := auth.Rates("alice"); upload != -1 || download != -1 {
+		t.Errorf("Rates(alice) = %d, %d, want -1, -1", upload, download)
+	}
+
+	for _, test := range tests {
+		if got := auth.Authenticate(test.user, test.password); got != test.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", test.user, test.password, got, test.want)
+		}
+	}
+}
+
+func TestFileAuthenticatorInvalid(t *testing.T) {
+	line, err := CredentialsLine("alice", "secret")
+	if err != nil {
+		t.Fatalf("CredentialsLine failed: %v", err)
+	}
+	hash := strings.TrimPrefix(line, "alice:")
+
+	var tests = []string{
+		"alice\n",
+		"alice:\n",
+		"alice:0011\n",
+		"alice:$2a$10$tooshort\n",
+		line + "::10X\n",
+		line + ":::1K:fast\n",
+		":" + hash + "\n",
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(fileName, []byte(test), 0600); err != nil {
+			t.Fatalf("Unable to write credentials: %v", err)
+		}
+		if _, err := NewFileAuthenticator(fileName); err == nil {
+			t.Errorf("NewFileAuthenticator accepted %q", test)
+		}
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	l := newLoginLimiter(2, time.Hour)
+
+	if l.blocked("10.0.0.1") {
+		t.Errorf("host blocked without failure")
+	}
+	l.failed("10.0.0.1")
+	if l.blocked("10.0.0.1") {
+		t.Errorf("host blocked after one failure")
+	}
+	l.failed("10.0.0.1")
+	if !l.blocked("10.0.0.1") {
+		t.Errorf("host not blocked after two failures")
+	}
+	if l.blocked("10.0.0.2") {
+		t.Errorf("other host blocked")
+	}
+	l.succeeded("10.0.0.1")
+	if l.blocked("10.0.0.1") {
+		t.Errorf("host still blocked after success")
+	}
+
+	// Failures are forgotten once the window is over
+	l = newLoginLimiter(1, time.Millisecond)
+	l.failed("10.0.0.1")
+	time.Sleep(5 * time.Millisecond)
+	if l.blocked("10.0.0.1") {
+		t.Errorf("host still blocked after window")
+	}
+}
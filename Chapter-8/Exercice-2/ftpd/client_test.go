@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"GoExercices/Chapter-8/Exercice-2/ftp"
+)
+
+// dialTestClient starts a server on a loopback listener and logs in with the FTP client
+func dialTestClient(t *testing.T, server *FtpServer) *ftp.Client {
+	t.Helper()
+
+	listener := serveTestServer(t, server)
+	client, err := ftp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestClient(t *testing.T) {
+	for _, mode := range []ftp.DataMode{ftp.ExtendedPassive, ftp.Passive, ftp.Active} {
+		t.Run(mode.String(), func(t *testing.T) {
+			server := newTestServer(t)
+			client := dialTestClient(t, server)
+			client.SetMode(mode)
+
+			if err := client.Login("anonymous", "guest@"); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.SetBinary(true); err != nil {
+				t.Fatal(err)
+			}
+
+			// Directories
+			if dir, err := client.MakeDir("dir"); err != nil || dir != "/dir" {
+				t.Fatalf("MakeDir = %q, %v", dir, err)
+			}
+			if err := client.ChangeDir("dir"); err != nil {
+				t.Fatal(err)
+			}
+			if dir, err := client.CurrentDir(); err != nil || dir != "/dir" {
+				t.Errorf("CurrentDir = %q, %v", dir, err)
+			}
+
+			// Upload, resumed upload and append
+			if n, err := client.Store("file", strings.NewReader("0123456789"), 0); err != nil || n != 10 {
+				t.Fatalf("Store = %d, %v", n, err)
+			}
+			if _, err := client.Store("file", strings.NewReader("abcdef"), 4); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Append("file", strings.NewReader("XYZ")); err != nil {
+				t.Fatal(err)
+			}
+			if size, err := client.Size("file"); err != nil || size != 13 {
+				t.Errorf("Size = %d, %v", size, err)
+			}
+
+			// Download and resumed download
+			var buffer bytes.Buffer
+			if _, err := client.Retrieve("file", &buffer, 0); err != nil || buffer.String() != "0123abcdefXYZ" {
+				t.Errorf("Retrieve = %q, %v", buffer.String(), err)
+			}
+			buffer.Reset()
+			if _, err := client.Retrieve("/dir/file", &buffer, 10); err != nil || buffer.String() != "XYZ" {
+				t.Errorf("Retrieve from 10 = %q, %v", buffer.String(), err)
+			}
+
+			// Listings
+			lines, err := client.List("")
+			if err != nil || len(lines) != 1 || !strings.HasSuffix(lines[0], " file") {
+				t.Errorf("List = %q, %v", lines, err)
+			}
+			lines, err = client.List("/dir")
+			if err != nil || len(lines) != 1 || !strings.HasSuffix(lines[0], " file") {
+				t.Errorf("List(/dir) = %q, %v", lines, err)
+			}
+			entries, err := client.MachineList("/")
+			if err != nil || len(entries) != 1 || entries[0].Name != "dir" || !entries[0].IsDir() {
+				t.Errorf("MachineList = %+v, %v", entries, err)
+			}
+			entry, err := client.Stat("file")
+			if err != nil || entry.Type != "file" || entry.Size != 13 {
+				t.Errorf("Stat = %+v, %v", entry, err)
+			}
+
+			// File management
+			if err := client.Rename("file", "renamed"); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Delete("renamed"); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Delete("renamed"); err == nil {
+				t.Error("Delete of a missing file succeeded")
+			}
+			if err := client.ChangeDir("/"); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.RemoveDir("dir"); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Quit(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	server := newTestServer(t)
+	tlsConfig, err := newSelfSignedTLSConfig([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.tlsConfig = tlsConfig
+	server.requireTLS = true
+	if err := os.WriteFile(filepath.Join(server.defaultRoot, "file"), []byte("secret data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := dialTestClient(t, server)
+	if err := client.Login("anonymous", "guest@"); err == nil {
+		t.Fatal("login accepted without TLS")
+	}
+	if err := client.AuthTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Login("anonymous", "guest@"); err != nil {
+		t.Fatal(err)
+	}
+	if features, err := client.Features(); err != nil || !strings.Contains(strings.Join(features, ","), "AUTH TLS") {
+		t.Errorf("Features = %q, %v", features, err)
+	}
+
+	var buffer bytes.Buffer
+	if _, err := client.Retrieve("file", &buffer, 0); err != nil || buffer.String() != "secret data" {
+		t.Errorf("Retrieve = %q, %v", buffer.String(), err)
+	}
+	if _, err := client.Store("new", strings.NewReader("uploaded"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(server.defaultRoot, "new")); string(got) != "uploaded" {
+		t.Errorf("file after Store = %q", got)
+	}
+	if err := client.Quit(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// localFileID returns the identity of a file of the local disk, which is not
+// available on this system
+func localFileID(info os.FileInfo) (string, bool) {
+	return "", false
+}
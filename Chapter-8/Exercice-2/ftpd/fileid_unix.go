@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// localFileID returns the identity of a file of the local disk, made of its
+// device and inode numbers
+func localFileID(info os.FileInfo) (string, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%xg%x", uint64(stat.Dev), uint64(stat.Ino)), true
+}
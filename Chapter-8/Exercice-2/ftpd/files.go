@@ -0,0 +1,297 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// commandDelete manages the DELE FTP command
+func (conn *FtpConnection) commandDelete(args []string) {
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandDelete: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandDelete: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the file name
+	fileName, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil {
+		log.Printf("commandDelete: invalid file name: %v (%v)", args, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Only regular files can be deleted (RMD removes directories)
+	stat, err := conn.fileSystem.Stat(fileName)
+	if err != nil || stat.IsDir() {
+		log.Printf("commandDelete: not a file: %s", fileName)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Delete the file
+	err = conn.fileSystem.Remove(fileName)
+	conn.logEvent("delete", fileName, "", err)
+	if err != nil {
+		log.Printf("commandDelete: unable to delete file: %s (%v)", fileName, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Send the reply
+	conn.writeString("250 Requested file action okay, completed.")
+}
+
+// commandMakeDirectory manages the MKD FTP command
+func (conn *FtpConnection) commandMakeDirectory(args []string) {
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandMakeDirectory: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandMakeDirectory: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the directory name
+	virtual, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil {
+		log.Printf("commandMakeDirectory: invalid directory name: %v (%v)", args, err)
+		conn.writeString("550 Requested action not taken.")
+		return
+	}
+
+	// Create the directory
+	if err := conn.fileSystem.Mkdir(virtual); err != nil {
+		log.Printf("commandMakeDirectory: unable to create directory: %s (%v)", virtual, err)
+		conn.writeString("550 Requested action not taken.")
+		return
+	}
+
+	// Send the reply
+	conn.writeString("257 \"%s\" directory created.", strings.ReplaceAll(virtual, "\"", "\"\""))
+}
+
+// commandRemoveDirectory manages the RMD FTP command
+func (conn *FtpConnection) commandRemoveDirectory(args []string) {
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandRemoveDirectory: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandRemoveDirectory: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the directory name
+	virtual, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil {
+		log.Printf("commandRemoveDirectory: invalid directory name: %v (%v)", args, err)
+		conn.writeString("550 Requested action not taken.")
+		return
+	}
+
+	// The root directory can't be removed
+	if virtual == "/" {
+		log.Printf("commandRemoveDirectory: unable to remove the root directory")
+		conn.writeString("550 Requested action not taken.")
+		return
+	}
+
+	// Only directories can be removed (DELE removes files)
+	stat, err := conn.fileSystem.Stat(virtual)
+	if err != nil || !stat.IsDir() {
+		log.Printf("commandRemoveDirectory: not a directory: %s", virtual)
+		conn.writeString("550 Requested action not taken.")
+		return
+	}
+
+	// Remove the directory (it must be empty)
+	err = conn.fileSystem.Remove(virtual)
+	conn.logEvent("rmdir", virtual, "", err)
+	if err != nil {
+		log.Printf("commandRemoveDirectory: unable to remove directory: %s (%v)", virtual, err)
+		conn.writeString("550 Requested action not taken.")
+		return
+	}
+
+	// Send the reply
+	conn.writeString("250 Requested file action okay, completed.")
+}
+
+// commandRenameFrom manages the RNFR FTP command
+func (conn *FtpConnection) commandRenameFrom(args []string) {
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandRenameFrom: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandRenameFrom: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the file name
+	virtual, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil || virtual == "/" {
+		log.Printf("commandRenameFrom: invalid file name: %v (%v)", args, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Check the file exists
+	if _, err := conn.fileSystem.Stat(virtual); err != nil {
+		log.Printf("commandRenameFrom: file not found: %s", virtual)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Store the file name up to the RNTO command
+	conn.renameFrom = virtual
+
+	// Send the reply
+	conn.writeString("350 Requested file action pending further information.")
+}
+
+// commandRenameTo manages the RNTO FTP command
+func (conn *FtpConnection) commandRenameTo(args []string) {
+	// Get the file name provided by the previous RNFR command
+	renameFrom := conn.renameFrom
+	conn.renameFrom = ""
+
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandRenameTo: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandRenameTo: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Check RNFR was sent just before
+	if renameFrom == "" {
+		log.Printf("commandRenameTo: no previous RNFR command")
+		conn.writeString("503 Bad sequence of commands.")
+		return
+	}
+
+	// Compute the new file name
+	oldName := renameFrom
+	newName, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil || newName == "/" {
+		log.Printf("commandRenameTo: invalid file name: %v (%v)", args, err)
+		conn.writeString("553 Requested action not taken. File name not allowed.")
+		return
+	}
+
+	// Rename the file
+	err = conn.fileSystem.Rename(oldName, newName)
+	conn.logEvent("rename", oldName, newName, err)
+	if err != nil {
+		log.Printf("commandRenameTo: unable to rename file: %s -> %s (%v)", oldName, newName, err)
+		conn.writeString("553 Requested action not taken. File name not allowed.")
+		return
+	}
+
+	// Send the reply
+	conn.writeString("250 Requested file action okay, completed.")
+}
+
+// commandSize manages the SIZE FTP command (RFC 3659)
+func (conn *FtpConnection) commandSize(args []string) {
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandSize: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandSize: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the file name
+	fileName, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil {
+		log.Printf("commandSize: invalid file name: %v (%v)", args, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Only the size of regular files is available
+	stat, err := conn.fileSystem.Stat(fileName)
+	if err != nil || !stat.Mode().IsRegular() {
+		log.Printf("commandSize: not a file: %s", fileName)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Send the reply
+	conn.writeString("213 %d", stat.Size())
+}
+
+// commandModificationTime manages the MDTM FTP command (RFC 3659)
+func (conn *FtpConnection) commandModificationTime(args []string) {
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandModificationTime: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandModificationTime: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the file name
+	fileName, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil {
+		log.Printf("commandModificationTime: invalid file name: %v (%v)", args, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Get the file status
+	stat, err := conn.fileSystem.Stat(fileName)
+	if err != nil || !stat.Mode().IsRegular() {
+		log.Printf("commandModificationTime: not a file: %s", fileName)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Send the reply (time-val format in UTC)
+	conn.writeString("213 %s", stat.ModTime().UTC().Format("20060102150405"))
+}
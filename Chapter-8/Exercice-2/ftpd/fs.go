@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// File is an open file of a FileSystem
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	// Truncate changes the size of the file
+	Truncate(size int64) error
+}
+
+// FileSystem is the storage seen by a FTP session. The names are virtual
+// paths: absolute, clean and using '/' as separator ("/" is the root).
+type FileSystem interface {
+	// Stat returns the description of a file or directory
+	Stat(name string) (os.FileInfo, error)
+
+	// List returns the content of a directory, sorted by name
+	List(name string) ([]os.FileInfo, error)
+
+	// Open opens a file for reading
+	Open(name string) (File, error)
+
+	// Create opens a file for writing, creating it if needed.
+	// flag may contain os.O_TRUNC or os.O_APPEND.
+	Create(name string, flag int) (File, error)
+
+	// Mkdir creates a directory
+	Mkdir(name string) error
+
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+
+	// Rename moves a file or directory
+	Rename(oldName, newName string) error
+}
+
+// FileSystemFactory builds the file system of a user from its root directory
+type FileSystemFactory func(root string) (FileSystem, error)
+
+// LocalFileSystem is a FileSystem confined in a directory of the local disk
+type LocalFileSystem struct {
+	root string
+}
+
+// NewLocalFileSystem creates a file system whose root is a local directory
+func NewLocalFileSystem(root string) (FileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", root)
+	}
+	return &LocalFileSystem{root: root}, nil
+}
+
+// localPath computes the local path of a virtual path
+func (fs *LocalFileSystem) localPath(name string) (string, error) {
+	return realPath(fs.root, name)
+}
+
+// Stat returns the description of a file or directory
+func (fs *LocalFileSystem) Stat(name string) (os.FileInfo, error) {
+	local, err := fs.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(local)
+}
+
+// List returns the content of a directory, sorted by name.
+// Symbolic links are followed, those escaping the root directory are hidden.
+func (fs *LocalFileSystem) List(name string) ([]os.FileInfo, error) {
+	local, err := fs.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(local)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink != 0 {
+			target, err := fs.Stat(path.Join(name, entry.Name()))
+			if err != nil {
+				continue
+			}
+			entry = renamedFileInfo{FileInfo: target, name: entry.Name()}
+		}
+		infos = append(infos, entry)
+	}
+	return infos, nil
+}
+
+// Open opens a file for reading
+func (fs *LocalFileSystem) Open(name string) (File, error) {
+	local, err := fs.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(local)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("not a file: %s", name)
+	}
+	return file, nil
+}
+
+// Create opens a file for writing, creating it if needed
+func (fs *LocalFileSystem) Create(name string, flag int) (File, error) {
+	local, err := fs.localPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(local, os.O_WRONLY|os.O_CREATE|(flag&(os.O_TRUNC|os.O_APPEND)), 0777)
+}
+
+// Mkdir creates a directory
+func (fs *LocalFileSystem) Mkdir(name string) error {
+	local, err := fs.localPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(local, 0755)
+}
+
+// Remove removes a file or an empty directory
+func (fs *LocalFileSystem) Remove(name string) error {
+	local, err := fs.localPath(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(local)
+}
+
+// Rename moves a file or directory
+func (fs *LocalFileSystem) Rename(oldName, newName string) error {
+	oldLocal, err := fs.localPath(oldName)
+	if err != nil {
+		return err
+	}
+	newLocal, err := fs.localPath(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldLocal, newLocal)
+}
+
+// renamedFileInfo is the description of a file seen through a symbolic link
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name returns the name of the symbolic link
+func (info renamedFileInfo) Name() string {
+	return info.name
+}
@@ -3,28 +3,86 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// FtpServer is the configuration shared by all the FTP connections
+type FtpServer struct {
+	authenticator Authenticator // nil if only anonymous logins are allowed
+	anonymous     bool          // true if anonymous logins are allowed
+	limiter       *loginLimiter
+	defaultRoot   string            // Root directory of the users without home
+	anonymousRoot string            // Root directory of the anonymous users
+	fileSystems   FileSystemFactory // Builds the storage of a user from its root directory
+	tlsConfig     *tls.Config       // nil if AUTH TLS is not available
+	requireTLS    bool              // true if the login requires a secured control connection
+	passivePorts  portRange         // Ports of the passive listeners (dynamic if empty)
+	passiveIP     net.IP            // IP V4 address advertised by PASV (e.g. behind a NAT), nil for the local one
+	sessions      *sessionLimiter   // nil if the sessions are not limited
+	idleTimeout   time.Duration     // Maximum time between two commands (0 for no limit)
+	dataTimeout   time.Duration     // Maximum inactivity of a data connection (0 for no limit)
+	draining      chan struct{}     // Closed when the server shuts down
+	active        sync.WaitGroup    // Sessions in progress
+	defaultQuota  int64             // Disk quota of the users without specific quota (0 for no limit)
+	uploadRate    int64             // Default upload bandwidth of a user in bytes per second (0 for no limit)
+	downloadRate  int64             // Default download bandwidth of a user in bytes per second (0 for no limit)
+	ratesMutex    sync.Mutex        // Protects rates
+	rates         map[string]userRates
+	quotasMutex   sync.Mutex               // Protects quotas
+	quotas        map[string]*quotaAccount // Disk usage accounts by user
+	audit         *auditLog                // nil if the transfers and the audit events are not logged
+}
+
+// rootDirectory returns the root directory of a user
+func (server *FtpServer) rootDirectory(user string) string {
+	if isAnonymous(user) {
+		return server.anonymousRoot
+	}
+	if homes, ok := server.authenticator.(HomeProvider); ok {
+		if home := homes.Home(user); home != "" {
+			return home
+		}
+	}
+	return server.defaultRoot
+}
+
 // FtpConnection is the context of a FTP connection
 type FtpConnection struct {
-	tcpConnection      net.Conn
-	user               string
-	authenticated      bool
-	writer             *bufio.Writer
-	binary             bool
-	passive            bool
-	remoteDataEndPoint net.TCPAddr  // Used in active mode
-	listener           net.Listener // Used in passive mode
-	workingDirectory   string
+	server              *FtpServer
+	tcpConnection       net.Conn
+	user                string
+	authenticated       bool
+	writer              *bufio.Writer
+	binary              bool // TYPE I (TYPE A otherwise)
+	recordStructure     bool // STRU R (STRU F otherwise)
+	blockMode           bool // MODE B (MODE S otherwise)
+	passive             bool
+	remoteDataEndPoint  net.TCPAddr   // Used in active mode
+	listener            net.Listener  // Used in passive mode
+	fileSystem          FileSystem    // Storage of the user, whose root is seen as "/" by the client
+	workingDirectory    string        // Virtual working directory (relative to the root directory)
+	renameFrom          string        // Virtual path provided by RNFR, used by RNTO
+	facts               []string      // Facts selected by OPTS MLST (nil for all)
+	restartOffset       int64         // Offset provided by REST for the next transfer
+	transfer            *transfer     // Data transfer in progress (nil if none)
+	writerMutex         sync.Mutex    // Protects the writer (replies are sent by transfers too)
+	upgraded            chan net.Conn // Control connection negotiated by AUTH, for the command reader
+	secured             bool          // true once TLS is negotiated on the control connection
+	protectionBufferSet bool          // true once PBSZ is received
+	protectedData       bool          // true if data connections use TLS (PROT P)
+	extendedPassiveOnly bool          // true after EPSV ALL (other data connection commands are refused)
 }
 
 // initialize initializes the connection context
@@ -45,49 +103,103 @@ func (conn *FtpConnection) initialize() error {
 	// Compute the default port
 	conn.remoteDataEndPoint.Port = conn.remoteDataEndPoint.Port - 1
 
-	conn.workingDirectory = "/tmp"
+	conn.workingDirectory = "/"
 	conn.user = "anonymous"
 	conn.writer = bufio.NewWriter(conn.tcpConnection)
+	conn.upgraded = make(chan net.Conn, 1)
 	return nil
 }
 
 // writeString sends a reply to the client
 func (conn *FtpConnection) writeString(format string, args ...interface{}) {
+	conn.writerMutex.Lock()
+	defer conn.writerMutex.Unlock()
 	conn.writer.WriteString(fmt.Sprintf(format+"\r\n", args...))
 	conn.writer.Flush()
 }
 
-// initialize initializes the connection context
+// getDataConnection establishes the data connection of the current transfer
 func (conn *FtpConnection) getDataConnection() (net.Conn, error) {
+	var cnx net.Conn
 	if conn.passive {
 		conn.passive = false
 		defer conn.listener.Close()
 
+		// Do not wait forever for the client
+		if conn.server.dataTimeout > 0 {
+			if listener, ok := conn.listener.(interface{ SetDeadline(time.Time) error }); ok {
+				listener.SetDeadline(time.Now().Add(conn.server.dataTimeout))
+			}
+		}
+
 		// Manage incoming connection
-		cnx, err := conn.listener.Accept()
+		var err error
+		cnx, err = conn.listener.Accept()
 		if err != nil {
-			log.Printf("commandListPassive: Unable to accept incoming connection: %v", err)
-			conn.writeString("425 Can't open data connection.")
+			log.Printf("getDataConnection: Unable to accept incoming connection: %v", err)
+			if conn.transfer != nil && isTimeout(err) {
+				conn.transfer.timeout()
+			}
+			if conn.transfer != nil && conn.transfer.isAborted() {
+				conn.writeString("426 Connection closed; transfer aborted.")
+			} else {
+				conn.writeString("425 Can't open data connection.")
+			}
 			return nil, fmt.Errorf("unable to accept incoming connection: %v", err)
 		}
-		return cnx, nil
 	} else {
 		remoteAddr := conn.remoteDataEndPoint.String()
 		if remoteAddr == "" {
-			log.Printf("commandListActive: no remote data endpoint")
+			log.Printf("getDataConnection: no remote data endpoint")
 			conn.writeString("451 Requested action aborted: local error in processing.")
 			return nil, fmt.Errorf("no remote data endpoint")
 		}
 
 		// Establish the data connection
-		cnx, err := net.Dial("tcp", remoteAddr)
+		var err error
+		dialer := net.Dialer{Timeout: conn.server.dataTimeout}
+		cnx, err = dialer.Dial("tcp", remoteAddr)
 		if err != nil {
-			log.Printf("commandListActive: unable to establish data connection: %s (%v)", remoteAddr, err)
+			log.Printf("getDataConnection: unable to establish data connection: %s (%v)", remoteAddr, err)
 			conn.writeString("425 Can't open data connection.")
 			return nil, fmt.Errorf("unable to establish connection: %v", err)
 		}
-		return cnx, nil
 	}
+
+	// Close the data connection when it is idle for too long
+	if conn.server.dataTimeout > 0 {
+		onTimeout := func() {}
+		if t := conn.transfer; t != nil {
+			onTimeout = t.timeout
+		}
+		cnx = &idleConn{Conn: cnx, timeout: conn.server.dataTimeout, onTimeout: onTimeout}
+	}
+
+	// Limit the bandwidth of the user
+	if rates := conn.server.userRateLimiters(conn.user); rates.upload != nil || rates.download != nil {
+		cnx = &throttledConn{Conn: cnx, rates: rates}
+	}
+
+	// Negotiate TLS on the data connection (the server is always the TLS server)
+	if conn.protectedData {
+		tlsConnection := tls.Server(cnx, conn.server.tlsConfig)
+		if err := tlsConnection.Handshake(); err != nil {
+			cnx.Close()
+			log.Printf("getDataConnection: TLS handshake failed: %v", err)
+			conn.writeString("522 Data connection requires TLS.")
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		cnx = tlsConnection
+	}
+
+	// Register the data connection so that ABOR can interrupt the transfer
+	if conn.transfer != nil {
+		if err := conn.transfer.setConnection(cnx); err != nil {
+			conn.writeString("426 Connection closed; transfer aborted.")
+			return nil, err
+		}
+	}
+	return cnx, nil
 }
 
 // commandUser manages the USER FTP command
@@ -99,6 +211,13 @@ func (conn *FtpConnection) commandUser(args []string) {
 		return
 	}
 
+	// Credentials can't be sent in clear text if TLS is required
+	if conn.server.requireTLS && !conn.secured {
+		log.Printf("commandUser: TLS required for user %s", args[0])
+		conn.writeString("534 Request denied for policy reasons: use AUTH TLS first.")
+		return
+	}
+
 	// Store the user name
 	conn.user = args[0]
 
@@ -124,10 +243,53 @@ func (conn *FtpConnection) commandPassword(args []string) {
 		return
 	}
 
-	//if conn.user != "anonymous" {
-	// TODO : Check password
-	//}
+	// Credentials can't be sent in clear text if TLS is required
+	if conn.server.requireTLS && !conn.secured {
+		log.Printf("commandPassword: TLS required for user %s", conn.user)
+		conn.writeString("534 Request denied for policy reasons: use AUTH TLS first.")
+		return
+	}
+
+	// Get the remote host
+	remoteHost := remoteHost(conn.tcpConnection)
+
+	// Reject the login if the remote host failed too many times
+	if conn.server.limiter.blocked(remoteHost) {
+		log.Printf("commandPassword: too many failed logins from %s (user %s)", remoteHost, conn.user)
+		conn.logEvent("login", "", "", errLoginBlocked)
+		conn.writeString("530 Too many failed login attempts, try again later.")
+		return
+	}
+
+	// Check the password
+	var ok bool
+	if isAnonymous(conn.user) {
+		ok = conn.server.anonymous
+	} else if conn.server.authenticator != nil {
+		ok = conn.server.authenticator.Authenticate(conn.user, args[0])
+	}
+	if !ok {
+		conn.server.limiter.failed(remoteHost)
+		log.Printf("commandPassword: login failed from %s (user %s)", remoteHost, conn.user)
+		conn.logEvent("login", "", "", errLoginFailed)
+		conn.writeString("530 Not logged in.")
+		return
+	}
+	conn.server.limiter.succeeded(remoteHost)
+
+	// Enter the root directory of the user
+	root := conn.server.rootDirectory(conn.user)
+	fileSystem, err := conn.server.fileSystems(root)
+	if err != nil {
+		log.Printf("commandPassword: unable to open root directory of user %s: %s (%v)", conn.user, root, err)
+		conn.writeString("530 Not logged in.")
+		return
+	}
+	conn.fileSystem = fileSystem
+	conn.workingDirectory = "/"
 	conn.authenticated = true
+	log.Printf("commandPassword: user %s logged in from %s", conn.user, remoteHost)
+	conn.logEvent("login", "", "", nil)
 
 	// Send the reply
 	conn.writeString("230 User logged in, proceed.")
@@ -155,6 +317,13 @@ func (conn *FtpConnection) commandPassive(args []string) {
 		return
 	}
 
+	// Only EPSV is accepted after EPSV ALL (RFC 2428)
+	if conn.extendedPassiveOnly {
+		log.Printf("commandPassive: refused after EPSV ALL")
+		conn.writeString("501 PASV not allowed after EPSV ALL.")
+		return
+	}
+
 	// Get the local address of the connection with remote
 	localAddress := conn.tcpConnection.LocalAddr().String()
 
@@ -166,11 +335,22 @@ func (conn *FtpConnection) commandPassive(args []string) {
 		return
 	}
 
-	// Create the listener (the port is dynamically allocated)
-	listener, err := net.Listen("tcp4", net.JoinHostPort(localHost, ""))
+	// PASV can only advertise IP V4 addresses
+	localIP := net.ParseIP(localHost)
+	if localIP == nil || localIP.To4() == nil {
+		log.Printf("commandPassive: control connection is not an IP V4 one: %s", localAddress)
+		conn.writeString("522 PASV is not available on an IP V6 connection, use EPSV.")
+		return
+	}
+
+	// Release the port of a previous passive command
+	conn.setPassiveListener(nil)
+
+	// Create the listener (the port is allocated in the passive port range)
+	listener, err := conn.server.listenPassive("tcp4", localHost)
 	if err != nil {
 		log.Printf("commandPassive: unable to create listener: %v", err)
-		conn.writeString("451 Requested action aborted: local error in processing.")
+		conn.writeString("425 Can't open passive connection.")
 		return
 	}
 
@@ -180,14 +360,19 @@ func (conn *FtpConnection) commandPassive(args []string) {
 	// Parse the listener address
 	listenerTCPAddr, err := net.ResolveTCPAddr("tcp", listenerAddr)
 	if err != nil {
+		listener.Close()
 		log.Printf("commandPassive: unable to parse endpoint: %s (%v)", listenerAddr, err)
 		conn.writeString("451 Requested action aborted: local error in processing.")
 		return
 	}
 
-	// Get the IP V4 address of the listener
+	// Get the advertised IP V4 address (the external one behind a NAT)
 	ipv4 := listenerTCPAddr.IP.To4()
+	if conn.server.passiveIP != nil {
+		ipv4 = conn.server.passiveIP.To4()
+	}
 	if ipv4 == nil {
+		listener.Close()
 		log.Printf("commandPassive: listener is not an IP V4 endpoint: %s", listenerAddr)
 		conn.writeString("451 Requested action aborted: local error in processing.")
 		return
@@ -198,14 +383,13 @@ func (conn *FtpConnection) commandPassive(args []string) {
 		ipv4[0], ipv4[1], ipv4[2], ipv4[3],
 		listenerTCPAddr.Port/256, listenerTCPAddr.Port%256)
 
-	conn.listener = listener
-	conn.passive = true
+	conn.setPassiveListener(listener)
 }
 
-// commandExtendedPassive manages the EPSV FTP command
+// commandExtendedPassive manages the EPSV FTP command (RFC 2428)
 func (conn *FtpConnection) commandExtendedPassive(args []string) {
 	// Check arguments count
-	if len(args) != 0 {
+	if len(args) > 1 {
 		log.Printf("commandExtendedPassive: bad arguments count: %v", args)
 		conn.writeString("501 Syntax error in parameters or arguments.")
 		return
@@ -217,16 +401,45 @@ func (conn *FtpConnection) commandExtendedPassive(args []string) {
 	// Get the host from the local address
 	localHost, _, err := net.SplitHostPort(localAddress)
 	if err != nil {
-		log.Printf("commandPassive: unable to parse local address: %s (%v)", localAddress, err)
+		log.Printf("commandExtendedPassive: unable to parse local address: %s (%v)", localAddress, err)
 		conn.writeString("451 Requested action aborted: local error in processing.")
 		return
 	}
 
-	// Create the listener (the port is dynamically allocated)
-	listener, err := net.Listen("tcp", net.JoinHostPort(localHost, ""))
+	// Check the optional argument
+	if len(args) == 1 {
+		// Network protocol of the control connection (1: IP V4, 2: IP V6)
+		protocol := "2"
+		if ip := net.ParseIP(localHost); ip != nil && ip.To4() != nil {
+			protocol = "1"
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "ALL":
+			// Only EPSV is accepted from now on
+			conn.extendedPassiveOnly = true
+			conn.writeString("200 EPSV ALL command successful.")
+			return
+		case protocol:
+		case "1", "2":
+			log.Printf("commandExtendedPassive: unsupported network protocol: %s", args[0])
+			conn.writeString("522 Network protocol not supported, use (%s)", protocol)
+			return
+		default:
+			log.Printf("commandExtendedPassive: invalid network protocol: %s", args[0])
+			conn.writeString("501 Syntax error in parameters or arguments.")
+			return
+		}
+	}
+
+	// Release the port of a previous passive command
+	conn.setPassiveListener(nil)
+
+	// Create the listener (the port is allocated in the passive port range)
+	listener, err := conn.server.listenPassive("tcp", localHost)
 	if err != nil {
 		log.Printf("commandExtendedPassive: unable to create listener: %v", err)
-		conn.writeString("451 Requested action aborted: local error in processing.")
+		conn.writeString("425 Can't open passive connection.")
 		return
 	}
 
@@ -236,6 +449,7 @@ func (conn *FtpConnection) commandExtendedPassive(args []string) {
 	// Get the port from the listener address
 	_, port, err := net.SplitHostPort(listenerAddr)
 	if err != nil {
+		listener.Close()
 		log.Printf("commandExtendedPassive: unable to parse listener address: %s (%v)", listenerAddr, err)
 		conn.writeString("451 Requested action aborted: local error in processing.")
 		return
@@ -244,59 +458,58 @@ func (conn *FtpConnection) commandExtendedPassive(args []string) {
 	// Send the reply
 	conn.writeString("229 Entering extended passive mode (|||%s|).", port)
 
-	conn.listener = listener
-	conn.passive = true
+	conn.setPassiveListener(listener)
 }
 
 // commandChangeWorkingDirectory manages the CWD FTP command
 func (conn *FtpConnection) commandChangeWorkingDirectory(args []string) {
 	// Check arguments count
-	if len(args) != 1 {
+	if len(args) < 1 {
 		log.Printf("commandChangeWorkingDirectory: bad arguments count: %v", args)
 		conn.writeString("501 Syntax error in parameters or arguments.")
 		return
 	}
 
 	// Check the new value
-	if args[0] == "" {
+	if strings.Join(args, " ") == "" {
 		log.Printf("commandChangeWorkingDirectory: no new working directory")
 		conn.writeString("501 Syntax error in parameters or arguments.")
 		return
 	}
 
-	// Compute the new working directory
-	var tmpPath string
-	if args[0][0] == '/' {
-		tmpPath = args[0]
-	} else {
-		tmpPath = filepath.Join(conn.workingDirectory, args[0])
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandChangeWorkingDirectory: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
 	}
 
-	// Check the resulting value
-	if tmpPath == "" {
-		log.Printf("commandChangeWorkingDirectory: resulting new working directory is empty")
-		conn.writeString("501 Syntax error in parameters or arguments.")
+	// Compute the new working directory
+	virtual, err := conn.resolvePath(strings.Join(args, " "))
+	if err != nil {
+		log.Printf("commandChangeWorkingDirectory: invalid directory: %s (%v)", args[0], err)
+		conn.writeString("550 No such directory.")
 		return
 	}
 
-	stat, err := os.Stat(tmpPath)
+	stat, err := conn.fileSystem.Stat(virtual)
 	if err != nil {
-		log.Printf("commandChangeWorkingDirectory: new working directory does not exist: %s", tmpPath)
-		conn.writeString("431 No such directory")
+		log.Printf("commandChangeWorkingDirectory: new working directory does not exist: %s", virtual)
+		conn.writeString("550 No such directory.")
 		return
 	}
 
 	if !stat.IsDir() {
-		log.Printf("commandChangeWorkingDirectory: new working directory is not a directory: %s", tmpPath)
-		conn.writeString("431 No such directory")
+		log.Printf("commandChangeWorkingDirectory: new working directory is not a directory: %s", virtual)
+		conn.writeString("550 No such directory.")
 		return
 	}
 
 	// Store the working directory
-	conn.workingDirectory = tmpPath
+	conn.workingDirectory = virtual
 
 	// Send the reply
-	conn.writeString("200 directory changed to %s.", conn.workingDirectory)
+	conn.writeString("250 Directory changed to %s.", conn.workingDirectory)
 }
 
 // commandPrintWorkingDirectory manages the PWD FTP command
@@ -308,129 +521,300 @@ func (conn *FtpConnection) commandPrintWorkingDirectory(args []string) {
 		return
 	}
 
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandPrintWorkingDirectory: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
 	// Send the reply
-	conn.writeString("200 working directory is %s.", conn.workingDirectory)
+	conn.writeString("257 \"%s\" is the working directory.", strings.ReplaceAll(conn.workingDirectory, "\"", "\"\""))
 }
 
 // commandList manages the LIST FTP command
 func (conn *FtpConnection) commandList(args []string) {
-	// Check arguments count
-	if len(args) != 0 {
-		log.Printf("commandList: bad arguments count: %v", args)
-		conn.writeString("501 Syntax error in parameters or arguments.")
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandList: not logged in")
+		conn.writeString("530 Not logged in.")
 		return
 	}
 
-	// Get the directory list
-	dirs, err := ioutil.ReadDir(conn.workingDirectory)
+	// Compute the name to list (the working directory by default), the
+	// options of ls sent by some clients (e.g. -la) are ignored
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+	name := strings.Join(args, " ")
+	if name == "" {
+		name = "."
+	}
+	virtual, err := conn.resolvePath(name)
 	if err != nil {
-		log.Printf("commandList: unable to read directory: %v", err)
-		conn.writeString("553 Requested action not taken.")
+		log.Printf("commandList: invalid file name: %s (%v)", name, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
 		return
 	}
-
-	// Send the preliminary reply
-	conn.writeString("150 Here comes the directory listing.")
-
-	// Get the data connection
-	dataConnection, err := conn.getDataConnection()
+	info, err := conn.fileSystem.Stat(virtual)
 	if err != nil {
-		log.Printf("commandList: Unable to get data connection: %v", err)
+		log.Printf("commandList: file not found: %s", virtual)
+		conn.writeString("550 Requested action not taken. File unavailable.")
 		return
 	}
-	defer dataConnection.Close()
 
-	// Send the directory list
-	for _, dir := range dirs {
-		line := fmt.Sprintf("%s %10d %15s %s\r\n", dir.Mode().String(), dir.Size(), dir.ModTime().Format("2 Jan 2006"), dir.Name())
-		written, err := dataConnection.Write([]byte(line))
+	// Get the directory list, a file is listed alone
+	dirs := []os.FileInfo{info}
+	if info.IsDir() {
+		dirs, err = conn.fileSystem.List(virtual)
 		if err != nil {
-			log.Printf("commandList: Unable to send data: %v", err)
-			conn.writeString("451 Requested action aborted: local error in processing.")
+			log.Printf("commandList: unable to read directory: %v", err)
+			conn.writeString("553 Requested action not taken.")
+			return
+		}
+	}
+
+	conn.startTransfer(func() {
+		// Send the preliminary reply
+		conn.writeString("150 Here comes the directory listing.")
+
+		// Get the data connection
+		dataConnection, err := conn.getDataConnection()
+		if err != nil {
+			log.Printf("commandList: Unable to get data connection: %v", err)
 			return
 		}
-		if written != len(line) {
-			log.Printf("commandList: Unable to send all data: %d/%d", written, len(line))
+		defer dataConnection.Close()
+
+		// Send the directory list
+		writer := conn.newListingWriter(dataConnection)
+		for _, dir := range dirs {
+			line := fmt.Sprintf("%s %10d %15s %s\r\n", dir.Mode().String(), dir.Size(), dir.ModTime().Format("2 Jan 2006"), dir.Name())
+			written, err := writer.Write([]byte(line))
+			if err != nil {
+				log.Printf("commandList: Unable to send data: %v", err)
+				conn.writeString("451 Requested action aborted: local error in processing.")
+				return
+			}
+			if written != len(line) {
+				log.Printf("commandList: Unable to send all data: %d/%d", written, len(line))
+				conn.writeString("451 Requested action aborted: local error in processing.")
+				return
+			}
+		}
+
+		// Signal the end of the listing
+		if err := writer.Close(); err != nil {
+			log.Printf("commandList: Unable to send data: %v", err)
 			conn.writeString("451 Requested action aborted: local error in processing.")
 			return
 		}
-	}
 
-	// Send the completion reply
-	conn.writeString("226 Directory send OK.")
+		// Send the completion reply
+		conn.writeString("226 Directory send OK.")
+	})
 }
 
 // commandStorage manages the STOR FTP command
 func (conn *FtpConnection) commandStorage(args []string) {
+	conn.storeFile("commandStorage", args, false)
+}
+
+// commandAppend manages the APPE FTP command
+func (conn *FtpConnection) commandAppend(args []string) {
+	conn.storeFile("commandAppend", args, true)
+}
+
+// storeFile receives a file from the client (STOR and APPE FTP commands)
+func (conn *FtpConnection) storeFile(name string, args []string, appendMode bool) {
+	// Get the restart offset (it applies to this transfer only)
+	offset := conn.takeRestartOffset()
+
 	// Check arguments count
-	if len(args) != 1 {
-		log.Printf("commandStorage: bad arguments count: %v", args)
+	if len(args) < 1 {
+		log.Printf("%s: bad arguments count: %v", name, args)
 		conn.writeString("501 Syntax error in parameters or arguments.")
 		return
 	}
 
 	// Check a user name is defined
 	if !conn.authenticated {
-		log.Printf("commandStorage: not logged in")
+		log.Printf("%s: not logged in", name)
 		conn.writeString("530 Not logged in.")
 		return
 	}
 
-	// Send the preliminary reply
-	conn.writeString("150 File status okay; about to open data connection.")
-
-	// Establish the data connection
-	dataConnection, err := conn.getDataConnection()
+	// Compute the file name
+	fileName, err := conn.resolvePath(strings.Join(args, " "))
 	if err != nil {
-		log.Printf("commandStorage: unable to get data connection: %v", err)
+		log.Printf("%s: invalid file name: %s (%v)", name, args[0], err)
+		conn.writeString("550 Requested action not taken.")
 		return
 	}
-	defer dataConnection.Close()
 
-	// Receive the data
-	var data []byte
-	for {
-		tmp := make([]byte, 4096)
-		read, err := dataConnection.Read(tmp)
-		if err != nil {
-			break
-		}
-		if read == 0 {
-			break
+	// Open the file: APPE appends to the end of the file, STOR overwrites
+	// the file from the restart offset. Under a quota, a STOR replacing the
+	// whole file stores the data in a temporary file, renamed once the
+	// upload is successful, so that the file survives an upload exceeding
+	// the quota.
+	flag := 0
+	if appendMode {
+		flag = os.O_APPEND
+	} else if offset == 0 {
+		flag = os.O_TRUNC
+	}
+	quota := conn.server.userQuota(conn.user)
+	target := fileName
+	var replaced int64 // Size of the file replaced, given back to the quota
+	if quota > 0 && !appendMode && offset == 0 {
+		if info, err := conn.fileSystem.Stat(fileName); err == nil && info.Mode().IsRegular() {
+			replaced = info.Size()
 		}
-		data = append(data, tmp...)
+		target = fmt.Sprintf("%s.%d.part", fileName, time.Now().UnixNano())
 	}
-
-	// Convert data into local format
-	if !conn.binary {
-		var tmp []byte
-		for _, b := range data {
-			switch b {
-			case '\r':
-			default:
-				tmp = append(tmp, b)
-			}
+	file, err := conn.fileSystem.Create(target, flag)
+	if err != nil {
+		log.Printf("%s: unable to open file: %s (%v)", name, fileName, err)
+		conn.writeString("550 Requested action not taken.")
+		return
+	}
+	if !appendMode && offset > 0 {
+		if err := file.Truncate(offset); err == nil {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+			log.Printf("%s: unable to restart at %d: %s (%v)", name, offset, fileName, err)
+			conn.writeString("554 Requested action not taken: invalid REST parameter.")
+			return
 		}
-		data = tmp
 	}
 
-	// Store the data into the file
-	fullName := filepath.Join(conn.workingDirectory, args[0])
-	err = ioutil.WriteFile(fullName, data, 0777)
+	// Get the offset of the first byte received
+	base, err := file.Seek(0, io.SeekCurrent)
+	if appendMode && err == nil {
+		base, err = file.Seek(0, io.SeekEnd)
+	}
 	if err != nil {
-		log.Printf("commandStorage: unable to store data: %s (%v)", fullName, err)
-		conn.writeString("552 Requested file action aborted.")
+		file.Close()
+		log.Printf("%s: unable to get file offset: %s (%v)", name, fileName, err)
+		conn.writeString("451 Requested action aborted: local error in processing.")
 		return
 	}
 
-	// Send the completion reply
-	conn.writeString("226 Closing data connection, file transfer successful.")
+	// discard removes the data received: the temporary file is removed, the
+	// other files get back their size before the upload
+	var limited *quotaWriter
+	discard := func() {
+		if limited != nil {
+			limited.discard()
+		}
+		var err error
+		if target != fileName {
+			file.Close()
+			err = conn.fileSystem.Remove(target)
+		} else {
+			err = file.Truncate(base)
+		}
+		if err != nil {
+			log.Printf("%s: unable to discard data: %s (%v)", name, fileName, err)
+		}
+	}
+
+	// Limit the data stored to the remaining quota, shared by the uploads
+	// in progress of the user. The file replaced doesn't count.
+	var destination io.Writer = file
+	if quota > 0 {
+		account := conn.server.quotaAccount(conn.user)
+		if err := account.begin(conn.fileSystem); err != nil {
+			discard()
+			file.Close()
+			log.Printf("%s: unable to compute disk usage: %v", name, err)
+			conn.writeString("451 Requested action aborted: local error in processing.")
+			return
+		}
+		limited = &quotaWriter{w: file, account: account, quota: quota + replaced}
+		destination = limited
+
+		// No upload is accepted once the quota is reached
+		if account.exhausted(limited.quota) {
+			account.end()
+			discard()
+			file.Close()
+			log.Printf("%s: quota of user %s exceeded", name, conn.user)
+			conn.writeString("552 Requested file action aborted. Exceeded storage allocation.")
+			return
+		}
+	}
+
+	conn.startTransfer(func() {
+		defer file.Close()
+		if limited != nil {
+			defer limited.account.end()
+		}
+
+		// Send the preliminary reply
+		conn.writeString("150 File status okay; about to open data connection.")
+
+		// Establish the data connection
+		dataConnection, err := conn.getDataConnection()
+		if err != nil {
+			if target != fileName {
+				discard()
+			}
+			log.Printf("%s: unable to get data connection: %v", name, err)
+			return
+		}
+		defer dataConnection.Close()
+		start := time.Now()
+
+		// Receive the data, reporting the restart markers of the block mode
+		reader := conn.newDataReader(dataConnection, base, func(marker string, offset int64) {
+			conn.writeString("110 MARK %s = %d", marker, offset)
+		})
+
+		// Store the data into the file, replacing the file by the temporary
+		// one once complete
+		size, err := io.Copy(destination, reader)
+		if err == nil && target != fileName {
+			file.Close()
+			if err = conn.fileSystem.Rename(target, fileName); err == nil {
+				limited.account.release(replaced)
+			}
+		}
+		conn.logTransfer(start, fileName, size, true, err == nil)
+		if err == errQuotaExceeded {
+			discard()
+			log.Printf("%s: quota of user %s exceeded: %s", name, conn.user, fileName)
+			conn.writeString("552 Requested file action aborted. Exceeded storage allocation.")
+			return
+		}
+		if err != nil && target != fileName {
+			discard()
+		}
+		if err != nil && conn.transfer.isAborted() {
+			log.Printf("%s: transfer aborted: %s", name, fileName)
+			conn.writeString("426 Connection closed; transfer aborted.")
+			return
+		}
+		if err != nil {
+			log.Printf("%s: unable to store data: %s (%v)", name, fileName, err)
+			conn.writeString("552 Requested file action aborted.")
+			return
+		}
+
+		// Send the completion reply
+		conn.writeString("226 Closing data connection, file transfer successful.")
+	})
 }
 
 // commandRetreive manages the RETR FTP command
 func (conn *FtpConnection) commandRetrieve(args []string) {
+	// Get the restart offset (it applies to this transfer only)
+	offset := conn.takeRestartOffset()
+
 	// Check arguments count
-	if len(args) != 1 {
+	if len(args) < 1 {
 		log.Printf("commandRetrieve: bad arguments count: %v", args)
 		conn.writeString("501 Syntax error in parameters or arguments.")
 		return
@@ -443,72 +827,68 @@ func (conn *FtpConnection) commandRetrieve(args []string) {
 		return
 	}
 
-	// Read the file
-	fullName := filepath.Join(conn.workingDirectory, args[0])
-	data, err := ioutil.ReadFile(fullName)
+	// Compute the file name
+	fileName, err := conn.resolvePath(strings.Join(args, " "))
 	if err != nil {
-		log.Printf("commandRetrieve: unable to read file: %s (%v)", fullName, err)
+		log.Printf("commandRetrieve: invalid file name: %s (%v)", args[0], err)
 		conn.writeString("550 Requested action not taken. File not found.")
 		return
 	}
 
-	// Convert data into network format
-	if !conn.binary {
-		var tmp []byte
-		var prevCR bool
-		var prevCRLF bool
-		for _, b := range data {
-			switch b {
-			case '\n':
-				if !prevCR {
-					tmp = append(tmp, '\r')
-				}
-				tmp = append(tmp, b)
-				prevCR = false
-				prevCRLF = true
-			case '\r':
-				prevCR = true
-				prevCRLF = false
-				tmp = append(tmp, b)
-			default:
-				if prevCR && !prevCRLF {
-					tmp = append(tmp, '\n')
-				}
-				prevCR = false
-				prevCRLF = false
-				tmp = append(tmp, b)
-			}
-		}
-		data = tmp
-	}
-
-	// Send the preliminary reply
-	conn.writeString("150 File status okay; about to open data connection.")
-
-	// Establish the data connection
-	dataConnection, err := conn.getDataConnection()
+	// Open the file
+	file, err := conn.fileSystem.Open(fileName)
 	if err != nil {
-		log.Printf("commandRetreive: unable to get data connection: %v", err)
+		log.Printf("commandRetrieve: unable to open file: %s (%v)", fileName, err)
+		conn.writeString("550 Requested action not taken. File not found.")
 		return
 	}
-	defer dataConnection.Close()
 
-	// Send data
-	written, err := dataConnection.Write(data)
-	if err != nil {
-		log.Printf("commandRetrieve: unable to send data: %v", err)
-		conn.writeString("426 Connection closed; transfer aborted.")
+	// Move to the restart offset
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil || offset > size {
+		file.Close()
+		log.Printf("commandRetrieve: restart offset beyond end of file: %d", offset)
+		conn.writeString("554 Requested action not taken: invalid REST parameter.")
 		return
 	}
-
-	if written != len(data) {
-		log.Printf("commandRetrieve: Unable to send all data: %d/%d", written, len(data))
-		conn.writeString("426 Connection closed; transfer aborted.")
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		log.Printf("commandRetrieve: unable to restart at %d: %s (%v)", offset, fileName, err)
+		conn.writeString("554 Requested action not taken: invalid REST parameter.")
 		return
 	}
 
-	// Send the completion reply
-	conn.writeString("226 Closing data connection, file transfer successful.")
+	conn.startTransfer(func() {
+		defer file.Close()
+
+		// Send the preliminary reply
+		conn.writeString("150 File status okay; about to open data connection.")
+
+		// Establish the data connection
+		dataConnection, err := conn.getDataConnection()
+		if err != nil {
+			log.Printf("commandRetreive: unable to get data connection: %v", err)
+			return
+		}
+		defer dataConnection.Close()
+		start := time.Now()
+
+		// Send data
+		writer := conn.newDataWriter(dataConnection, offset)
+		size, err := io.Copy(writer, file)
+		if err == nil {
+			err = writer.Close()
+		}
+		conn.logTransfer(start, fileName, size, false, err == nil)
+		if err != nil {
+			log.Printf("commandRetrieve: unable to send data: %v", err)
+			conn.writeString("426 Connection closed; transfer aborted.")
+			return
+		}
+
+		// Send the completion reply
+		conn.writeString("226 Closing data connection, file transfer successful.")
+	})
 }
 
 // commandPort manages the PORT FTP command
@@ -520,6 +900,13 @@ func (conn *FtpConnection) commandPort(args []string) {
 		return
 	}
 
+	// Only EPSV is accepted after EPSV ALL (RFC 2428)
+	if conn.extendedPassiveOnly {
+		log.Printf("commandPort: refused after EPSV ALL")
+		conn.writeString("501 PORT not allowed after EPSV ALL.")
+		return
+	}
+
 	// Split parameters
 	params := strings.Split(args[0], ",")
 	if len(params) != 6 {
@@ -565,6 +952,7 @@ func (conn *FtpConnection) commandPort(args []string) {
 		conn.remoteDataEndPoint.IP[i] = a[i]
 	}
 	conn.remoteDataEndPoint.Port = port
+	conn.setPassiveListener(nil)
 
 	// Send the reply
 	conn.writeString("200 Command okay.")
@@ -579,6 +967,13 @@ func (conn *FtpConnection) commandExtendedPort(args []string) {
 		return
 	}
 
+	// Only EPSV is accepted after EPSV ALL (RFC 2428)
+	if conn.extendedPassiveOnly {
+		log.Printf("commandExtendedPort: refused after EPSV ALL")
+		conn.writeString("501 EPRT not allowed after EPSV ALL.")
+		return
+	}
+
 	// Parse the argument
 	delim := args[0][0]
 	params := strings.Split(args[0], string(delim))
@@ -601,6 +996,7 @@ func (conn *FtpConnection) commandExtendedPort(args []string) {
 
 	// Store the remote address
 	conn.remoteDataEndPoint = *tcpAddr
+	conn.setPassiveListener(nil)
 
 	// Send the reply
 	conn.writeString("200 Command okay.")
@@ -615,16 +1011,17 @@ func (conn *FtpConnection) commandType(args []string) {
 		return
 	}
 
-	switch args[0] {
+	switch strings.ToUpper(args[0]) {
 	case "A": // ASCII
 		switch len(args) {
 		case 1:
 			conn.writeString("200 Command okay.")
 			conn.binary = false
 		case 2:
-			switch args[1] {
+			switch strings.ToUpper(args[1]) {
 			case "N":
 				conn.writeString("200 Command okay.")
+				conn.binary = false
 			case "T":
 				conn.writeString("504 Command not implemented for that parameter.")
 			case "C":
@@ -642,8 +1039,13 @@ func (conn *FtpConnection) commandType(args []string) {
 	case "I": // IMAGE
 		conn.writeString("200 Command okay.")
 		conn.binary = true
-	case "L": // LOCAL
-		conn.writeString("504 Command not implemented for that parameter.")
+	case "L": // LOCAL (only 8 bits bytes, the same as IMAGE)
+		if len(args) == 2 && args[1] == "8" {
+			conn.writeString("200 Command okay.")
+			conn.binary = true
+		} else {
+			conn.writeString("504 Command not implemented for that parameter.")
+		}
 	default:
 		log.Printf("commandType: unknown type: %s", args[0])
 		conn.writeString("501 Syntax error in parameters or arguments.")
@@ -659,11 +1061,13 @@ func (conn *FtpConnection) commandStructure(args []string) {
 		return
 	}
 
-	switch args[0] {
+	switch strings.ToUpper(args[0]) {
 	case "F": // File (no record structure)
 		conn.writeString("200 Command okay.")
-	case "R": // Record structure
-		conn.writeString("504 Command not implemented for that parameter.")
+		conn.recordStructure = false
+	case "R": // Record structure (each local line is a record)
+		conn.writeString("200 Command okay.")
+		conn.recordStructure = true
 	case "P": // Page structure
 		conn.writeString("504 Command not implemented for that parameter.")
 	default:
@@ -681,11 +1085,13 @@ func (conn *FtpConnection) commandMode(args []string) {
 		return
 	}
 
-	switch args[0] {
+	switch strings.ToUpper(args[0]) {
 	case "S": // Stream
 		conn.writeString("200 Command okay.")
+		conn.blockMode = false
 	case "B": // Block
-		conn.writeString("504 Command not implemented for that parameter.")
+		conn.writeString("200 Command okay.")
+		conn.blockMode = true
 	case "C": // Compressed
 		conn.writeString("504 Command not implemented for that parameter.")
 	default:
@@ -694,6 +1100,130 @@ func (conn *FtpConnection) commandMode(args []string) {
 	}
 }
 
+// readCommands is a go routine reading the command lines of the client.
+// The lines channel is closed when the control connection is closed.
+func (conn *FtpConnection) readCommands(cnx net.Conn, lines chan<- string, quit <-chan struct{}) {
+	defer close(lines)
+
+	scanner := bufio.NewScanner(cnx)
+	for scanner.Scan() {
+		line := scanner.Text()
+		select {
+		case lines <- line:
+		case <-quit:
+			return
+		}
+
+		// Wait for the TLS negotiation before reading the next command
+		if isAuthCommand(line) {
+			select {
+			case upgraded := <-conn.upgraded:
+				if upgraded != nil {
+					scanner = bufio.NewScanner(upgraded)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}
+}
+
+// dispatch runs a command line. It returns false if the connection must be closed.
+func (conn *FtpConnection) dispatch(line string) bool {
+	log.Printf("CMD: %s\n", maskPassword(line))
+
+	// Split the command line
+	tokens := strings.Split(line, " ")
+	if len(tokens) == 0 {
+		return true
+	}
+
+	// RNTO must immediately follow RNFR
+	command := strings.ToUpper(tokens[0])
+	if command != "RNTO" {
+		conn.renameFrom = ""
+	}
+
+	// Dispatch according to the command
+	switch command {
+	case "AUTH":
+		conn.commandAuth(tokens[1:])
+	case "PBSZ":
+		conn.commandProtectionBufferSize(tokens[1:])
+	case "PROT":
+		conn.commandProtection(tokens[1:])
+	case "USER":
+		conn.commandUser(tokens[1:])
+	case "PASS":
+		conn.commandPassword(tokens[1:])
+	case "SYST":
+		conn.commandSystem(tokens[1:])
+	case "PASV":
+		conn.commandPassive(tokens[1:])
+	case "EPSV":
+		conn.commandExtendedPassive(tokens[1:])
+	case "CWD":
+		conn.commandChangeWorkingDirectory(tokens[1:])
+	case "PWD":
+		conn.commandPrintWorkingDirectory(tokens[1:])
+	case "LIST":
+		conn.commandList(tokens[1:])
+	case "STOR":
+		conn.commandStorage(tokens[1:])
+	case "APPE":
+		conn.commandAppend(tokens[1:])
+	case "RETR":
+		conn.commandRetrieve(tokens[1:])
+	case "DELE":
+		conn.commandDelete(tokens[1:])
+	case "MKD", "XMKD":
+		conn.commandMakeDirectory(tokens[1:])
+	case "RMD", "XRMD":
+		conn.commandRemoveDirectory(tokens[1:])
+	case "RNFR":
+		conn.commandRenameFrom(tokens[1:])
+	case "RNTO":
+		conn.commandRenameTo(tokens[1:])
+	case "SIZE":
+		conn.commandSize(tokens[1:])
+	case "MDTM":
+		conn.commandModificationTime(tokens[1:])
+	case "FEAT":
+		conn.commandFeatures(tokens[1:])
+	case "OPTS":
+		conn.commandOptions(tokens[1:])
+	case "MLST":
+		conn.commandMachineListSingle(tokens[1:])
+	case "MLSD":
+		conn.commandMachineListDirectory(tokens[1:])
+	case "PORT":
+		conn.commandPort(tokens[1:])
+	case "EPRT":
+		conn.commandExtendedPort(tokens[1:])
+	case "TYPE":
+		conn.commandType(tokens[1:])
+	case "STRU":
+		conn.commandStructure(tokens[1:])
+	case "MODE":
+		conn.commandMode(tokens[1:])
+	case "REST":
+		conn.commandRestart(tokens[1:])
+	case "ABOR":
+		conn.commandAbort(tokens[1:])
+	case "QUIT":
+		conn.writeString("221 Service closing control connection. Logged out if appropriate.")
+		return false
+	case "SITE":
+		conn.commandSite(tokens[1:])
+	case "NOOP":
+		conn.writeString("200 Command okay.")
+	default:
+		log.Printf("Unknown command: %s", line)
+		conn.writeString("502 Command not implemented.")
+	}
+	return true
+}
+
 // handle manages a ftp connection
 func (conn *FtpConnection) handle() {
 	defer conn.tcpConnection.Close()
@@ -705,93 +1235,300 @@ func (conn *FtpConnection) handle() {
 		return
 	}
 
-	// Create the input scanner
-	scanner := bufio.NewScanner(conn.tcpConnection)
+	// Check the sessions limits
+	if conn.server.sessions != nil {
+		host := remoteHost(conn.tcpConnection)
+		if err := conn.server.sessions.acquire(host); err != nil {
+			log.Printf("Connection from %s refused: %v", host, err)
+			if err == errTooManyHostSessions {
+				conn.writeString("421 Too many connections from your host, closing control connection.")
+			} else {
+				conn.writeString("421 Too many users, closing control connection.")
+			}
+			return
+		}
+		defer conn.server.sessions.release(host)
+	}
 
-	conn.writeString("220 Service ready.")
+	// Release the listener of a passive command not followed by a transfer
+	defer conn.setPassiveListener(nil)
 
-	for scanner.Scan() {
+	// Read the commands concurrently with the data transfers
+	lines := make(chan string)
+	quit := make(chan struct{})
+	defer close(quit)
+	go conn.readCommands(conn.tcpConnection, lines, quit)
 
-		// Get the command line
-		line := scanner.Text()
+	conn.writeString("220 Service ready.")
 
-		log.Printf("CMD: %s\n", line)
+	for {
+		// Wait for the next command, or for the end of the current transfer.
+		// When idle, the session also ends on timeout or on server shutdown.
+		var done <-chan struct{}
+		var draining <-chan struct{}
+		var idle <-chan time.Time
+		var timer *time.Timer
+		if conn.transfer != nil {
+			done = conn.transfer.done
+		} else {
+			draining = conn.server.draining
+			if conn.server.idleTimeout > 0 {
+				timer = time.NewTimer(conn.server.idleTimeout)
+				idle = timer.C
+			}
+		}
+
+		// The shutdown has priority over the pending commands
+		select {
+		case <-draining:
+			conn.writeString("421 Service not available, closing control connection.")
+			return
+		default:
+		}
 
-		// Split the command line
-		tokens := strings.Split(line, " ")
-		if len(tokens) == 0 {
+		var line string
+		var ok bool
+		select {
+		case <-done:
+			if !conn.endTransfer() {
+				return
+			}
 			continue
+		case <-draining:
+			conn.writeString("421 Service not available, closing control connection.")
+			return
+		case <-idle:
+			log.Printf("Control connection idle for %v, closing it", conn.server.idleTimeout)
+			conn.writeString("421 Timeout, closing control connection.")
+			return
+		case line, ok = <-lines:
+		}
+		if timer != nil {
+			timer.Stop()
 		}
 
-		// Dispatch according to the command
-		switch strings.ToUpper(tokens[0]) {
-		case "USER":
-			conn.commandUser(tokens[1:])
-		case "PASS":
-			conn.commandPassword(tokens[1:])
-		case "SYST":
-			conn.commandSystem(tokens[1:])
-		case "PASV":
-			conn.commandPassive(tokens[1:])
-		case "EPSV":
-			conn.commandExtendedPassive(tokens[1:])
-		case "CWD":
-			conn.commandChangeWorkingDirectory(tokens[1:])
-		case "PWD":
-			conn.commandPrintWorkingDirectory(tokens[1:])
-		case "LIST":
-			conn.commandList(tokens[1:])
-		case "STOR":
-			conn.commandStorage(tokens[1:])
-		case "RETR":
-			conn.commandRetrieve(tokens[1:])
-		case "PORT":
-			conn.commandPort(tokens[1:])
-		case "EPRT":
-			conn.commandExtendedPort(tokens[1:])
-		case "TYPE":
-			conn.commandType(tokens[1:])
-		case "STRU":
-			conn.commandStructure(tokens[1:])
-		case "MODE":
-			conn.commandMode(tokens[1:])
-		case "QUIT":
-			conn.writeString("221 Service closing control connection. Logged out if appropriate.")
+		// Interrupt the current transfer if the control connection is closed
+		if !ok {
+			if conn.transfer != nil {
+				conn.transfer.abort()
+			}
+			return
+		}
+
+		// Only ABOR is processed during a transfer, the other commands wait
+		// for its end (QUIT closes the session once the transfer is
+		// completed and its reply sent, RFC 959 section 4.1.1)
+		if conn.transfer != nil {
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			if command != "ABOR" {
+				<-conn.transfer.done
+				if !conn.endTransfer() {
+					return
+				}
+			}
+		}
+
+		if !conn.dispatch(line) {
 			return
-		case "NOOP":
-			conn.writeString("200 Command okay.")
-		default:
-			log.Printf("Unknown command: %s", line)
-			conn.writeString("502 Command not implemented.")
 		}
 	}
 }
 
+// endTransfer clears the finished transfer. It returns false if the session
+// must be closed because the data connection timed out.
+func (conn *FtpConnection) endTransfer() bool {
+	timedOut := conn.transfer.isTimedOut()
+	conn.transfer = nil
+	if timedOut {
+		log.Printf("Data connection idle for %v, closing the session", conn.server.dataTimeout)
+		conn.writeString("421 Data connection timed out, closing control connection.")
+		return false
+	}
+	return true
+}
+
 // main is the entry point of the program
 func main() {
 	// Get parameters
 	port := flag.Int("port", 21, "Listen port")
+	usersFile := flag.String("users", "", "Credentials file (lines formatted as user:hash[:home[:quota[:uploadrate[:downloadrate]]]], see -adduser)")
+	anonymous := flag.Bool("anonymous", false, "Allow anonymous logins")
+	maxFailures := flag.Int("maxfailures", 5, "Failed logins allowed per remote host before blocking it")
+	root := flag.String("root", "/tmp", "Root directory of the users without home directory")
+	anonymousRoot := flag.String("anonroot", "/tmp", "Root directory of the anonymous users")
+	memory := flag.Bool("memory", false, "Store the files in memory instead of the local disk")
+	blockDelay := flag.Duration("blockdelay", 5*time.Minute, "Duration of the failed logins window")
+	certFile := flag.String("cert", "", "TLS certificate file (enables AUTH TLS)")
+	keyFile := flag.String("key", "", "TLS private key file")
+	selfSigned := flag.Bool("selfsigned", false, "Generate a self-signed TLS certificate (for testing)")
+	requireTLS := flag.Bool("requiretls", false, "Require AUTH TLS before login")
+	addUser := flag.String("adduser", "", "Print the credentials line of user:password and exit")
+	passivePorts := flag.String("pasvports", "", "Port range of the passive data connections (e.g. 50000-50100)")
+	passiveAddress := flag.String("pasvaddress", "", "IP V4 address or host name advertised by PASV (e.g. the external address of a NAT)")
+	maxSessions := flag.Int("maxsessions", 0, "Maximum number of sessions (0 for no limit)")
+	maxPerHost := flag.Int("maxperhost", 0, "Maximum number of sessions per remote host (0 for no limit)")
+	idleTimeout := flag.Duration("idletimeout", 5*time.Minute, "Maximum time between two commands (0 for no limit)")
+	dataTimeout := flag.Duration("datatimeout", time.Minute, "Maximum inactivity of a data connection (0 for no limit)")
+	quota := flag.String("quota", "0", "Disk quota of the users without specific quota, e.g. 100M (0 for no limit)")
+	uploadRate := flag.String("uploadrate", "0", "Upload bandwidth of the users without specific rate in bytes per second, e.g. 512K (0 for no limit)")
+	downloadRate := flag.String("downloadrate", "0", "Download bandwidth of the users without specific rate in bytes per second, e.g. 1M (0 for no limit)")
+	xferFile := flag.String("xferlog", "", "Transfer log in xferlog format: file name, - for stdout or tcp://host:port")
+	auditFile := flag.String("auditlog", "", "JSON audit events log: file name, - for stdout or tcp://host:port")
+	drainTimeout := flag.Duration("draintimeout", time.Minute, "Maximum time waiting for the transfers in progress on SIGTERM")
 	flag.Parse()
 
+	// Generate a credentials line
+	if *addUser != "" {
+		user, password, ok := strings.Cut(*addUser, ":")
+		if !ok {
+			log.Fatalf("Invalid user:password value: %s", *addUser)
+		}
+		line, err := CredentialsLine(user, password)
+		if err != nil {
+			log.Fatalf("Unable to build credentials: %v", err)
+		}
+		fmt.Println(line)
+		return
+	}
+
 	if *port < 1 || *port > 65535 {
 		log.Fatalf("Invalid port: %d", *port)
 	}
 
+	if *maxFailures < 1 {
+		log.Fatalf("Invalid failed logins count: %d", *maxFailures)
+	}
+
+	if *maxSessions < 0 || *maxPerHost < 0 {
+		log.Fatalf("Invalid sessions limit: %d/%d", *maxSessions, *maxPerHost)
+	}
+
+	// Build the server configuration
+	server := &FtpServer{
+		anonymous:     *anonymous,
+		limiter:       newLoginLimiter(*maxFailures, *blockDelay),
+		defaultRoot:   *root,
+		anonymousRoot: *anonymousRoot,
+		fileSystems:   NewLocalFileSystem,
+		idleTimeout:   *idleTimeout,
+		dataTimeout:   *dataTimeout,
+		draining:      make(chan struct{}),
+	}
+	if *usersFile != "" {
+		auth, err := NewFileAuthenticator(*usersFile)
+		if err != nil {
+			log.Fatalf("Unable to load credentials: %v", err)
+		}
+		server.authenticator = auth
+	} else if !*anonymous {
+		log.Printf("No credentials file and anonymous logins disabled: nobody can log in")
+	}
+
+	// Limit the disk usage and the bandwidth of the users
+	for _, limit := range []struct {
+		name  string
+		value string
+		field *int64
+	}{
+		{"quota", *quota, &server.defaultQuota},
+		{"upload rate", *uploadRate, &server.uploadRate},
+		{"download rate", *downloadRate, &server.downloadRate},
+	} {
+		size, err := parseSize(limit.value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", limit.name, err)
+		}
+		*limit.field = size
+	}
+
+	// Open the logs
+	if *xferFile != "" || *auditFile != "" {
+		server.audit = &auditLog{}
+	}
+	if *xferFile != "" {
+		sink, err := openSink(*xferFile)
+		if err != nil {
+			log.Fatalf("Unable to open transfer log: %v", err)
+		}
+		server.audit.xfer = sink
+	}
+	if *auditFile != "" {
+		sink, err := openSink(*auditFile)
+		if err != nil {
+			log.Fatalf("Unable to open audit log: %v", err)
+		}
+		server.audit.events = sink
+	}
+
+	// Limit the number of sessions
+	if *maxSessions > 0 || *maxPerHost > 0 {
+		server.sessions = newSessionLimiter(*maxSessions, *maxPerHost)
+	}
+
+	// Store the files in memory (one subtree per root directory)
+	if *memory {
+		server.fileSystems = NewMemoryFileSystem().Factory()
+	}
+
+	// Configure the passive mode
+	if *passivePorts != "" {
+		ports, err := parsePortRange(*passivePorts)
+		if err != nil {
+			log.Fatalf("Invalid passive port range: %v", err)
+		}
+		server.passivePorts = ports
+	}
+	if *passiveAddress != "" {
+		ip, err := resolveIPv4(*passiveAddress)
+		if err != nil {
+			log.Fatalf("Invalid passive address: %v", err)
+		}
+		server.passiveIP = ip
+	}
+
+	// Build the TLS configuration
+	if *certFile != "" || *keyFile != "" {
+		tlsConfig, err := newTLSConfig(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Unable to load TLS certificate: %v", err)
+		}
+		server.tlsConfig = tlsConfig
+	} else if *selfSigned {
+		hostName, _ := os.Hostname()
+		tlsConfig, err := newSelfSignedTLSConfig([]string{"localhost", "127.0.0.1", "::1", hostName})
+		if err != nil {
+			log.Fatalf("Unable to generate TLS certificate: %v", err)
+		}
+		server.tlsConfig = tlsConfig
+	}
+	if *requireTLS {
+		if server.tlsConfig == nil {
+			log.Fatalf("TLS required but no certificate provided")
+		}
+		server.requireTLS = true
+	}
+
 	// Listen incoming connections
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
-		log.Fatalf("Unable to listen on port %d: %v", port, err)
+		log.Fatalf("Unable to listen on port %d: %v", *port, err)
 	}
 	defer listener.Close()
 
+	// Stop accepting sessions on SIGTERM (or Ctrl-C)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, waiting for the transfers in progress", sig)
+		listener.Close()
+	}()
+
 	// Manage incoming connections
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Unable to accept incoming connection: %v", err)
-			continue
-		}
-		ftpConnection := &FtpConnection{tcpConnection: conn}
-		go ftpConnection.handle()
+	server.serve(listener)
+
+	// Let the sessions finish their transfer
+	if !server.shutdown(*drainTimeout) {
+		log.Printf("Transfers still in progress after %v, exiting anyway", *drainTimeout)
 	}
 }
@@ -0,0 +1,1123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSession is a control connection to a test server
+type testSession struct {
+	t       *testing.T
+	raw     net.Conn
+	conn    *textproto.Conn
+	root    string
+	tlsData bool // true if the data connections use TLS
+}
+
+// newTestServer builds a server configuration accepting anonymous logins
+func newTestServer(t *testing.T) *FtpServer {
+	t.Helper()
+
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &FtpServer{
+		anonymous:     true,
+		limiter:       newLoginLimiter(5, time.Minute),
+		defaultRoot:   root,
+		anonymousRoot: root,
+		fileSystems:   NewLocalFileSystem,
+	}
+}
+
+// newTestSession starts a server accepting anonymous logins on a loopback
+// listener and connects to it
+func newTestSession(t *testing.T) *testSession {
+	t.Helper()
+	return startTestSession(t, newTestServer(t))
+}
+
+// startTestSession starts a server on a loopback listener and connects to it
+func startTestSession(t *testing.T, server *FtpServer) *testSession {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startTestSessionOn(t, server, listener)
+}
+
+// startTestSessionOn starts a server on a listener and connects to it
+func startTestSessionOn(t *testing.T, server *FtpServer, listener net.Listener) *testSession {
+	t.Helper()
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		ftpConnection := &FtpConnection{server: server, tcpConnection: conn}
+		ftpConnection.handle()
+	}()
+
+	s := dialTestSession(t, server, listener.Addr().String())
+	s.expect(220)
+	return s
+}
+
+// dialTestSession connects to a running server (the greeting is not read)
+func dialTestSession(t *testing.T, server *FtpServer, address string) *testSession {
+	t.Helper()
+
+	raw, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+
+	return &testSession{t: t, raw: raw, conn: textproto.NewConn(raw), root: server.defaultRoot}
+}
+
+// expect reads a reply and checks its code
+func (s *testSession) expect(code int) string {
+	s.t.Helper()
+	_, message, err := s.conn.ReadResponse(code)
+	if err != nil {
+		s.t.Fatalf("expected %d, got %v", code, err)
+	}
+	return message
+}
+
+// command sends a command and checks the code of the reply
+func (s *testSession) command(code int, format string, args ...interface{}) string {
+	s.t.Helper()
+	if err := s.conn.PrintfLine(format, args...); err != nil {
+		s.t.Fatal(err)
+	}
+	return s.expect(code)
+}
+
+// login logs in as anonymous
+func (s *testSession) login() {
+	s.t.Helper()
+	s.command(331, "USER anonymous")
+	s.command(230, "PASS guest@")
+}
+
+// passive enters the extended passive mode and opens the data connection
+func (s *testSession) passive() net.Conn {
+	s.t.Helper()
+	message := s.command(229, "EPSV")
+	start := strings.Index(message, "(|||")
+	end := strings.LastIndex(message, "|)")
+	if start < 0 || end < start {
+		s.t.Fatalf("invalid EPSV reply: %s", message)
+	}
+	port := message[start+4 : end]
+	data, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if s.tlsData {
+		return tls.Client(data, &tls.Config{InsecureSkipVerify: true})
+	}
+	return data
+}
+
+// receive runs a command returning data through a passive data connection
+func (s *testSession) receive(format string, args ...interface{}) string {
+	s.t.Helper()
+	data := s.passive()
+	defer data.Close()
+	s.command(150, format, args...)
+	content, err := io.ReadAll(data)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.expect(226)
+	return string(content)
+}
+
+// send runs a command sending data through a passive data connection
+func (s *testSession) send(content string, format string, args ...interface{}) {
+	s.t.Helper()
+	data := s.passive()
+	s.command(150, format, args...)
+	if _, err := data.Write([]byte(content)); err != nil {
+		s.t.Fatal(err)
+	}
+	data.Close()
+	s.expect(226)
+}
+
+func TestNotLoggedIn(t *testing.T) {
+	s := newTestSession(t)
+	for _, command := range []string{"CWD /", "PWD", "DELE a", "MKD a", "RMD a", "RNFR a", "SIZE a", "MDTM a", "MLST", "MLSD"} {
+		s.command(530, command)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	line, err := CredentialsLine("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(fileName, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewFileAuthenticator(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t)
+	server.anonymous = false
+	server.authenticator = auth
+	server.limiter = newLoginLimiter(3, time.Minute)
+	listener := serveTestServer(t, server)
+
+	// Invalid credentials are refused
+	s := dialTestSession(t, server, listener.Addr().String())
+	s.expect(220)
+	s.command(331, "USER anonymous")
+	s.command(530, "PASS guest@")
+	s.command(331, "USER alice")
+	if message := s.command(530, "PASS wrong"); message != "Not logged in." {
+		t.Errorf("PASS wrong: got %q", message)
+	}
+
+	// A successful login clears the failures
+	s.command(331, "USER alice")
+	s.command(230, "PASS secret")
+	s.command(221, "QUIT")
+
+	// The host is blocked after three failures, even with valid credentials
+	s = dialTestSession(t, server, listener.Addr().String())
+	s.expect(220)
+	for i := 0; i < 3; i++ {
+		s.command(331, "USER alice")
+		s.command(530, "PASS wrong")
+	}
+	s.command(331, "USER alice")
+	if message := s.command(530, "PASS secret"); !strings.Contains(message, "Too many failed login attempts") {
+		t.Errorf("PASS after lockout: got %q", message)
+	}
+	s.command(530, "PWD")
+}
+
+func TestFileManagement(t *testing.T) {
+	s := newTestSession(t)
+	s.login()
+
+	if err := os.WriteFile(filepath.Join(s.root, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(s.root, "file"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// SIZE and MDTM
+	if got := s.command(213, "SIZE file"); got != "5" {
+		t.Errorf("SIZE = %q, want 5", got)
+	}
+	if got := s.command(213, "MDTM file"); got != "20200102030405" {
+		t.Errorf("MDTM = %q, want 20200102030405", got)
+	}
+	s.command(550, "SIZE missing")
+	s.command(550, "MDTM ../file")
+
+	// LIST of a directory, of a file and with options of ls
+	for _, command := range []string{"LIST", "LIST /", "LIST file", "LIST -la ."} {
+		if got := s.receive(command); !strings.HasSuffix(got, " file\r\n") || strings.Count(got, "\n") != 1 {
+			t.Errorf("%s = %q", command, got)
+		}
+	}
+	s.command(550, "LIST missing")
+	s.command(550, "LIST ../..")
+
+	// MKD and RMD
+	if got := s.command(257, "MKD my dir"); got != `"/my dir" directory created.` {
+		t.Errorf("MKD = %q", got)
+	}
+	s.command(550, "MKD my dir")
+	s.command(250, "CWD my dir")
+	s.command(257, "PWD")
+	s.command(550, "RMD /")
+	s.command(550, "RMD ../..")
+	s.command(250, "CWD /")
+	s.command(550, "RMD file")
+	s.command(250, "RMD my dir")
+	if _, err := os.Stat(filepath.Join(s.root, "my dir")); !os.IsNotExist(err) {
+		t.Errorf("directory still exists after RMD: %v", err)
+	}
+
+	// RNFR and RNTO
+	s.command(503, "RNTO other")
+	s.command(550, "RNFR missing")
+	s.command(350, "RNFR file")
+	s.command(200, "NOOP")
+	s.command(503, "RNTO other")
+	s.command(350, "RNFR file")
+	s.command(553, "RNTO ../other")
+	s.command(350, "RNFR file")
+	s.command(250, "RNTO other")
+	if _, err := os.Stat(filepath.Join(s.root, "other")); err != nil {
+		t.Errorf("renamed file not found: %v", err)
+	}
+
+	// DELE
+	s.command(550, "DELE file")
+	s.command(257, "MKD dir")
+	s.command(550, "DELE dir")
+	s.command(250, "DELE other")
+	if _, err := os.Stat(filepath.Join(s.root, "other")); !os.IsNotExist(err) {
+		t.Errorf("file still exists after DELE: %v", err)
+	}
+}
+
+func TestMachineListing(t *testing.T) {
+	s := newTestSession(t)
+	s.login()
+
+	if err := os.WriteFile(filepath.Join(s.root, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(s.root, "file"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(s.root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(s.root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	// FEAT advertises all the facts selected by default
+	features := s.command(211, "FEAT")
+	for _, feature := range []string{"MLST type*;size*;modify*;perm*;unique*;", "UTF8", "SIZE", "MDTM"} {
+		if !strings.Contains(features, feature) {
+			t.Errorf("FEAT does not advertise %q: %s", feature, features)
+		}
+	}
+
+	// MLST
+	got := s.command(250, "MLST file")
+	if !strings.Contains(got, " type=file;size=5;modify=20200102030405;perm=rawdf;unique=") || !strings.Contains(got, "; /file\n") {
+		t.Errorf("MLST file = %q", got)
+	}
+	s.command(550, "MLST missing")
+	s.command(550, "MLST ../etc")
+
+	// MLSD
+	listing := s.receive("MLSD")
+	lines := strings.Split(strings.TrimSuffix(listing, "\r\n"), "\r\n")
+	if len(lines) != 3 {
+		t.Fatalf("MLSD returned %d lines, want 3: %q", len(lines), listing)
+	}
+	if !strings.HasPrefix(lines[0], "type=cdir;") || !strings.HasSuffix(lines[0], " /") {
+		t.Errorf("MLSD cdir line = %q", lines[0])
+	}
+	if !strings.Contains(listing, "type=dir;") || strings.Contains(listing, "escape") {
+		t.Errorf("MLSD = %q", listing)
+	}
+	s.command(501, "MLSD file")
+
+	// OPTS selects the facts
+	if got := s.command(200, "OPTS MLST size;Type;bogus;"); got != "MLST OPTS type;size;" {
+		t.Errorf("OPTS MLST = %q", got)
+	}
+	if got := s.command(250, "MLST file"); !strings.Contains(got, " type=file;size=5; /file") {
+		t.Errorf("MLST file = %q", got)
+	}
+	features = s.command(211, "FEAT")
+	if !strings.Contains(features, "MLST type*;size*;modify;perm;unique;") {
+		t.Errorf("FEAT does not reflect OPTS: %s", features)
+	}
+	s.command(200, "OPTS UTF8 ON")
+	s.command(501, "OPTS BOGUS")
+}
+
+func TestUniqueFact(t *testing.T) {
+	for _, memory := range []bool{false, true} {
+		server := newTestServer(t)
+		if memory {
+			server.fileSystems = NewMemoryFileSystem().Factory()
+		}
+		s := startTestSession(t, server)
+		s.login()
+		s.send("first", "STOR first")
+		s.send("second", "STOR second")
+
+		// unique returns the unique fact of a file
+		unique := func(name string) string {
+			_, facts, _ := strings.Cut(s.command(250, "MLST "+name), "unique=")
+			value, _, _ := strings.Cut(facts, ";")
+			return value
+		}
+
+		// The unique fact identifies the file, whatever its name
+		first := unique("first")
+		if first == "" || first == unique("second") {
+			t.Errorf("memory %v: unique facts of first and second: %q and %q", memory, first, unique("second"))
+		}
+		s.command(350, "RNFR first")
+		s.command(250, "RNTO renamed")
+		if renamed := unique("renamed"); renamed != first {
+			t.Errorf("memory %v: unique fact after RNTO = %q, want %q", memory, renamed, first)
+		}
+	}
+}
+
+func TestRestartAndAppend(t *testing.T) {
+	s := newTestSession(t)
+	s.login()
+	s.command(200, "TYPE I")
+
+	if err := os.WriteFile(filepath.Join(s.root, "file"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// REST applies to the next RETR only
+	s.command(350, "REST 4")
+	if got := s.receive("RETR file"); got != "456789" {
+		t.Errorf("RETR after REST 4 = %q", got)
+	}
+	if got := s.receive("RETR file"); got != "0123456789" {
+		t.Errorf("RETR = %q", got)
+	}
+	s.command(501, "REST -1")
+	s.command(501, "REST abc")
+	s.command(350, "REST 11")
+	s.command(554, "RETR file")
+
+	// REST then STOR overwrites the file from the offset
+	s.command(350, "REST 6")
+	s.send("abc", "STOR file")
+	if got, _ := os.ReadFile(filepath.Join(s.root, "file")); string(got) != "012345abc" {
+		t.Errorf("file after REST 6 and STOR = %q", got)
+	}
+
+	// APPE appends to the end of the file (and creates it if needed)
+	s.send("def", "APPE file")
+	if got, _ := os.ReadFile(filepath.Join(s.root, "file")); string(got) != "012345abcdef" {
+		t.Errorf("file after APPE = %q", got)
+	}
+	s.send("new", "APPE new")
+	if got, _ := os.ReadFile(filepath.Join(s.root, "new")); string(got) != "new" {
+		t.Errorf("new file after APPE = %q", got)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	s := newTestSession(t)
+	s.login()
+	s.command(200, "TYPE I")
+
+	// No transfer in progress
+	s.command(225, "ABOR")
+
+	// Abort an upload in progress
+	data := s.passive()
+	defer data.Close()
+	s.command(150, "STOR file")
+	if _, err := data.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if stat, err := os.Stat(filepath.Join(s.root, "file")); err == nil && stat.Size() == 7 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.command(426, "ABOR")
+	s.expect(226)
+
+	// The session is still usable and the partial file can be resumed
+	if got := s.command(213, "SIZE file"); got != "7" {
+		t.Errorf("SIZE after ABOR = %q, want 7", got)
+	}
+
+	// Abort a transfer waiting for its data connection
+	s.command(229, "EPSV")
+	s.command(150, "RETR file")
+	s.command(426, "ABOR")
+	s.expect(226)
+	s.command(200, "NOOP")
+}
+
+func TestTLS(t *testing.T) {
+	server := newTestServer(t)
+	tlsConfig, err := newSelfSignedTLSConfig([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.tlsConfig = tlsConfig
+	server.requireTLS = true
+	s := startTestSession(t, server)
+
+	if err := os.WriteFile(filepath.Join(s.root, "file"), []byte("secret data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Login is refused in clear text
+	s.command(534, "USER anonymous")
+	s.command(503, "PBSZ 0")
+	s.command(504, "AUTH KERBEROS_V4")
+	if features := s.command(211, "FEAT"); !strings.Contains(features, "AUTH TLS") {
+		t.Errorf("FEAT does not advertise AUTH TLS: %s", features)
+	}
+
+	// Negotiate TLS on the control connection
+	s.command(234, "AUTH TLS")
+	secured := tls.Client(s.raw, &tls.Config{InsecureSkipVerify: true})
+	if err := secured.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	s.conn = textproto.NewConn(secured)
+	s.command(503, "AUTH TLS")
+	s.command(503, "PROT P")
+	s.command(200, "PBSZ 0")
+	s.command(536, "PROT S")
+	s.command(200, "PROT P")
+	s.login()
+	s.command(200, "TYPE I")
+
+	// Data connections are protected
+	s.tlsData = true
+	if got := s.receive("RETR file"); got != "secret data" {
+		t.Errorf("RETR over TLS = %q", got)
+	}
+	s.send("uploaded", "STOR new")
+	if got, _ := os.ReadFile(filepath.Join(s.root, "new")); string(got) != "uploaded" {
+		t.Errorf("file after STOR over TLS = %q", got)
+	}
+
+	// Back to clear data connections
+	s.command(200, "PROT C")
+	s.tlsData = false
+	if got := s.receive("RETR file"); got != "secret data" {
+		t.Errorf("RETR after PROT C = %q", got)
+	}
+}
+
+func TestNoTLS(t *testing.T) {
+	s := newTestSession(t)
+	s.command(534, "AUTH TLS")
+	s.login()
+	if features := s.command(211, "FEAT"); strings.Contains(features, "AUTH TLS") {
+		t.Errorf("FEAT advertises AUTH TLS without certificate: %s", features)
+	}
+}
+
+func TestQuitDuringTransfer(t *testing.T) {
+	s := newTestSession(t)
+	s.login()
+	s.command(200, "TYPE I")
+
+	// QUIT waits for the end of the transfer, then closes the session
+	data := s.passive()
+	defer data.Close()
+	s.command(150, "STOR file")
+	if _, err := data.Write([]byte("first ")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.conn.PrintfLine("QUIT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	data.Close()
+	s.expect(226)
+	s.expect(221)
+	if line, err := s.conn.ReadLine(); err != io.EOF {
+		t.Errorf("after QUIT: got %q (%v), want the connection closed", line, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(s.root, "file")); string(got) != "first second" {
+		t.Errorf("file = %q", got)
+	}
+}
+
+func TestMemoryFileSystem(t *testing.T) {
+	server := newTestServer(t)
+	fs := NewMemoryFileSystem()
+	server.fileSystems = fs.Factory()
+	s := startTestSession(t, server)
+	s.login()
+	s.command(200, "TYPE I")
+
+	// Create a tree
+	s.command(257, "MKD dir")
+	s.command(250, "CWD dir")
+	s.send("0123456789", "STOR file")
+	s.command(350, "REST 5")
+	s.send("abc", "STOR file")
+	s.send("def", "APPE file")
+	if got := s.command(213, "SIZE file"); got != "11" {
+		t.Errorf("SIZE = %q, want 11", got)
+	}
+	if got := s.receive("RETR /dir/file"); got != "01234abcdef" {
+		t.Errorf("RETR = %q", got)
+	}
+
+	// Rename the directory with its content
+	s.command(250, "CWD /")
+	s.command(350, "RNFR dir")
+	s.command(250, "RNTO other")
+	if got := s.receive("RETR other/file"); got != "01234abcdef" {
+		t.Errorf("RETR after RNTO = %q", got)
+	}
+	listing := s.receive("MLSD other")
+	if !strings.Contains(listing, "type=file;size=11;") || !strings.HasSuffix(listing, " file\r\n") {
+		t.Errorf("MLSD = %q", listing)
+	}
+
+	// Remove the tree
+	s.command(550, "RMD other")
+	s.command(250, "DELE other/file")
+	s.command(250, "RMD other")
+	s.command(550, "CWD other")
+	if entries, err := fs.List(server.defaultRoot); err != nil || len(entries) != 0 {
+		t.Errorf("root directory not empty: %v (%v)", entries, err)
+	}
+}
+
+func TestMemoryFileSystemRoots(t *testing.T) {
+	factory := NewMemoryFileSystem().Factory()
+	alice, err := factory("/home/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := factory("/home/bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each root directory has its own tree
+	file, err := alice.Create("/file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("alice"))
+	file.Close()
+	if _, err := bob.Stat("/file"); !os.IsNotExist(err) {
+		t.Errorf("bob sees the file of alice: %v", err)
+	}
+	if usage, err := diskUsage(bob, "/"); err != nil || usage != 0 {
+		t.Errorf("diskUsage(bob) = %d, %v, want 0", usage, err)
+	}
+	if usage, err := diskUsage(alice, "/"); err != nil || usage != 5 {
+		t.Errorf("diskUsage(alice) = %d, %v, want 5", usage, err)
+	}
+
+	// The sessions of a user share its tree
+	again, err := factory("/home/alice/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := again.Stat("/file"); err != nil || info.Size() != 5 {
+		t.Errorf("Stat(/file) = %v, %v", info, err)
+	}
+	if err := again.Remove("/"); err == nil {
+		t.Error("the root directory was removed")
+	}
+}
+
+func TestTransferParameters(t *testing.T) {
+	s := newTestSession(t)
+	s.login()
+
+	// Unsupported parameters are rejected
+	s.command(504, "TYPE E")
+	s.command(504, "TYPE A T")
+	s.command(504, "TYPE L 7")
+	s.command(504, "MODE C")
+	s.command(504, "STRU P")
+	s.command(501, "MODE X")
+
+	// TYPE A converts the end of lines
+	s.command(200, "TYPE A N")
+	s.send("line 1\r\nline 2\r\n", "STOR text")
+	if got, _ := os.ReadFile(filepath.Join(s.root, "text")); string(got) != "line 1\nline 2\n" {
+		t.Errorf("file stored in ASCII = %q", got)
+	}
+	if got := s.receive("RETR text"); got != "line 1\r\nline 2\r\n" {
+		t.Errorf("RETR in ASCII = %q", got)
+	}
+
+	// STRU R sends each line as a record
+	s.command(200, "STRU R")
+	if got := s.receive("RETR text"); got != "line 1\xff\x01line 2\xff\x01\xff\x02" {
+		t.Errorf("RETR with STRU R = %q", got)
+	}
+	s.command(200, "STRU F")
+
+	// MODE B sends blocks
+	s.command(200, "TYPE L 8")
+	s.command(200, "MODE B")
+	if got := s.receive("RETR text"); got != "\x00\x00\x0eline 1\nline 2\n\x40\x00\x00" {
+		t.Errorf("RETR in block mode = %q", got)
+	}
+
+	// Restart markers received in block mode are acknowledged
+	data := s.passive()
+	s.command(150, "STOR block")
+	if _, err := data.Write([]byte("\x00\x00\x03abc\x10\x00\x01M\x40\x00\x03def")); err != nil {
+		t.Fatal(err)
+	}
+	data.Close()
+	if got := s.expect(110); got != "MARK M = 3" {
+		t.Errorf("restart marker reply = %q", got)
+	}
+	s.expect(226)
+	if got, _ := os.ReadFile(filepath.Join(s.root, "block")); string(got) != "abcdef" {
+		t.Errorf("file stored in block mode = %q", got)
+	}
+}
+
+func TestPassiveMode(t *testing.T) {
+	// Find a free port for the passive range
+	probe, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	server := newTestServer(t)
+	server.passivePorts = portRange{min: port, max: port}
+	server.passiveIP = net.ParseIP("203.0.113.7")
+	s := startTestSession(t, server)
+	s.login()
+
+	// The external address and the port of the range are advertised
+	expected := fmt.Sprintf("Entering passive mode (203,0,113,7,%d,%d).", port/256, port%256)
+	if message := s.command(227, "PASV"); message != expected {
+		t.Errorf("PASV: got %q, want %q", message, expected)
+	}
+
+	// A second PASV releases the port of the first one
+	s.command(227, "PASV")
+	data, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.command(150, "LIST")
+	io.Copy(io.Discard, data)
+	data.Close()
+	s.expect(226)
+
+	// EPSV uses the range too
+	expected = fmt.Sprintf("Entering extended passive mode (|||%d|).", port)
+	if message := s.command(229, "EPSV 1"); message != expected {
+		t.Errorf("EPSV: got %q, want %q", message, expected)
+	}
+	s.command(522, "EPSV 2")
+	s.command(501, "EPSV 3")
+
+	// Only EPSV is accepted after EPSV ALL
+	s.command(200, "EPSV ALL")
+	s.command(501, "PASV")
+	s.command(501, "PORT 127,0,0,1,4,1")
+	s.command(501, "EPRT |1|127.0.0.1|1025|")
+	if content := s.receive("LIST"); content != "" {
+		t.Errorf("LIST: got %q", content)
+	}
+}
+
+func TestPassiveModeIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IP V6 not available: %v", err)
+	}
+	s := startTestSessionOn(t, newTestServer(t), listener)
+	s.login()
+
+	// PASV can't describe an IP V6 address
+	if message := s.command(522, "PASV"); !strings.Contains(message, "EPSV") {
+		t.Errorf("PASV: got %q", message)
+	}
+	if message := s.command(522, "EPSV 1"); !strings.Contains(message, "(2)") {
+		t.Errorf("EPSV 1: got %q", message)
+	}
+	s.command(229, "EPSV 2")
+}
+
+// serveTestServer runs a server on a loopback listener up to the end of the test
+func serveTestServer(t *testing.T, server *FtpServer) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.serve(listener)
+	return listener
+}
+
+func TestSessionLimits(t *testing.T) {
+	server := newTestServer(t)
+	server.sessions = newSessionLimiter(0, 1)
+	listener := serveTestServer(t, server)
+
+	first := dialTestSession(t, server, listener.Addr().String())
+	first.expect(220)
+	first.login()
+
+	// A second session from the same host is refused
+	second := dialTestSession(t, server, listener.Addr().String())
+	second.expect(421)
+
+	// The host can connect again once the first session is over
+	first.command(221, "QUIT")
+	first.raw.Close()
+	for i := 0; ; i++ {
+		third := dialTestSession(t, server, listener.Addr().String())
+		code, _, err := third.conn.ReadResponse(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code == 220 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("session still refused: %d", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server := newTestServer(t)
+	server.idleTimeout = 100 * time.Millisecond
+	s := startTestSession(t, server)
+	s.login()
+
+	// The timer is restarted by each command
+	time.Sleep(60 * time.Millisecond)
+	s.command(200, "NOOP")
+	time.Sleep(60 * time.Millisecond)
+	s.command(200, "NOOP")
+
+	s.expect(421)
+	if _, err := s.conn.ReadLine(); err != io.EOF {
+		t.Errorf("control connection not closed: %v", err)
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+	server := newTestServer(t)
+	server.dataTimeout = 100 * time.Millisecond
+	s := startTestSession(t, server)
+	s.login()
+
+	// The client opens the data connection but sends nothing
+	data := s.passive()
+	defer data.Close()
+	s.command(150, "STOR stalled")
+	if _, _, err := s.conn.ReadResponse(5); err != nil {
+		t.Errorf("expected a transfer failure, got %v", err)
+	}
+	s.expect(421)
+
+	// The client does not open the data connection
+	s = startTestSession(t, server)
+	s.login()
+	s.command(229, "EPSV")
+	s.command(150, "LIST")
+	s.expect(425)
+	s.expect(421)
+}
+
+func TestShutdown(t *testing.T) {
+	server := newTestServer(t)
+	server.draining = make(chan struct{})
+	listener := serveTestServer(t, server)
+
+	idle := dialTestSession(t, server, listener.Addr().String())
+	idle.expect(220)
+	idle.login()
+
+	// Start an upload left in progress
+	busy := dialTestSession(t, server, listener.Addr().String())
+	busy.expect(220)
+	busy.login()
+	data := busy.passive()
+	busy.command(150, "STOR upload")
+	if _, err := data.Write([]byte("first part, ")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop the server
+	listener.Close()
+	stopped := make(chan bool)
+	go func() { stopped <- server.shutdown(5 * time.Second) }()
+
+	// The idle session is closed at once
+	idle.expect(421)
+
+	// The upload is completed before closing the session
+	if _, err := data.Write([]byte("last part")); err != nil {
+		t.Fatal(err)
+	}
+	data.Close()
+	busy.expect(226)
+	busy.expect(421)
+	if !<-stopped {
+		t.Error("shutdown timed out")
+	}
+
+	content, err := os.ReadFile(filepath.Join(server.defaultRoot, "upload"))
+	if err != nil || string(content) != "first part, last part" {
+		t.Errorf("upload: got %q (%v)", content, err)
+	}
+
+	// New sessions are refused
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("connection accepted after shutdown")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	server := newTestServer(t)
+	server.defaultQuota = 10
+	s := startTestSession(t, server)
+	s.login()
+
+	s.send("123456", "STOR first")
+	if message := s.command(200, "SITE QUOTA"); !strings.Contains(message, "6 of 10 bytes") {
+		t.Errorf("SITE QUOTA: got %q", message)
+	}
+
+	// The data of an upload exceeding the quota are removed
+	data := s.passive()
+	s.command(150, "STOR second")
+	data.Write([]byte("abcdef"))
+	data.Close()
+	s.expect(552)
+	if _, err := os.Stat(filepath.Join(s.root, "second")); !os.IsNotExist(err) {
+		t.Errorf("second: not removed (%v)", err)
+	}
+	data = s.passive()
+	s.command(150, "APPE first")
+	data.Write([]byte("abcdef"))
+	data.Close()
+	s.expect(552)
+	if content, err := os.ReadFile(filepath.Join(s.root, "first")); err != nil || string(content) != "123456" {
+		t.Errorf("first: got %q (%v)", content, err)
+	}
+
+	// No upload is accepted once the quota is reached
+	s.send("abcd", "APPE first")
+	s.command(552, "APPE first")
+	s.command(552, "STOR second")
+	if _, err := os.Stat(filepath.Join(s.root, "second")); !os.IsNotExist(err) {
+		t.Errorf("second: not removed (%v)", err)
+	}
+
+	// Overwriting a file releases its space
+	s.send("abc", "STOR first")
+	if message := s.command(200, "SITE QUOTA"); !strings.Contains(message, "3 of 10 bytes") {
+		t.Errorf("SITE QUOTA: got %q", message)
+	}
+	s.command(504, "SITE UNKNOWN")
+}
+
+func TestQuotaOverwrite(t *testing.T) {
+	server := newTestServer(t)
+	server.defaultQuota = 10
+	s := startTestSession(t, server)
+	s.login()
+	s.send("0123456789", "STOR file")
+
+	// A file replaced by an upload exceeding the quota survives
+	data := s.passive()
+	s.command(150, "STOR file")
+	data.Write([]byte("abcdefghijkl"))
+	data.Close()
+	s.expect(552)
+	if content, err := os.ReadFile(filepath.Join(s.root, "file")); err != nil || string(content) != "0123456789" {
+		t.Errorf("file: got %q (%v)", content, err)
+	}
+	if entries, err := os.ReadDir(s.root); err != nil || len(entries) != 1 {
+		t.Errorf("root directory: got %d entries (%v), want the file only", len(entries), err)
+	}
+
+	// Its space is available to replace it
+	s.send("abcdefghij", "STOR file")
+	if content, err := os.ReadFile(filepath.Join(s.root, "file")); err != nil || string(content) != "abcdefghij" {
+		t.Errorf("file: got %q (%v)", content, err)
+	}
+	if message := s.command(200, "SITE QUOTA"); !strings.Contains(message, "10 of 10 bytes") {
+		t.Errorf("SITE QUOTA: got %q", message)
+	}
+}
+
+func TestQuotaConcurrentUploads(t *testing.T) {
+	server := newTestServer(t)
+	server.defaultQuota = 10
+	first := startTestSession(t, server)
+	first.login()
+	second := startTestSession(t, server)
+	second.login()
+
+	// Both uploads start before any data is stored, they share the quota
+	data1 := first.passive()
+	first.command(150, "STOR first")
+	data2 := second.passive()
+	second.command(150, "STOR second")
+	data1.Write([]byte("123456"))
+	data1.Close()
+	first.expect(226)
+	data2.Write([]byte("abcdef"))
+	data2.Close()
+	second.expect(552)
+
+	if message := first.command(200, "SITE QUOTA"); !strings.Contains(message, "6 of 10 bytes") {
+		t.Errorf("SITE QUOTA: got %q", message)
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	server := newTestServer(t)
+	server.downloadRate = 10 << 10
+	server.uploadRate = 10 << 10
+	s := startTestSession(t, server)
+	s.login()
+
+	// 5 KB at 10 KB/s take about half a second in each direction
+	content := strings.Repeat("0123456789", 512)
+	start := time.Now()
+	s.send(content, "STOR file")
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("upload not throttled: %v", elapsed)
+	}
+
+	start = time.Now()
+	if received := s.receive("RETR file"); received != content {
+		t.Errorf("RETR: got %d bytes, want %d", len(received), len(content))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("download not throttled: %v", elapsed)
+	}
+}
+
+func TestUserRates(t *testing.T) {
+	line, err := CredentialsLine("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(fileName, []byte(line+"::0:2K:0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewFileAuthenticator(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t)
+	server.authenticator = auth
+	server.uploadRate = 1 << 10
+	server.downloadRate = 1 << 10
+
+	// The rates of the credentials file replace the server settings
+	for _, test := range []struct {
+		user             string
+		upload, download int64
+	}{
+		{"alice", 2 << 10, 0},
+		{"bob", 1 << 10, 1 << 10},
+		{"anonymous", 1 << 10, 1 << 10},
+	} {
+		rates := server.userRateLimiters(test.user)
+		upload, download := int64(0), int64(0)
+		if rates.upload != nil {
+			upload = rates.upload.rate
+		}
+		if rates.download != nil {
+			download = rates.download.rate
+		}
+		if upload != test.upload || download != test.download {
+			t.Errorf("rates of %s: got %d, %d, want %d, %d", test.user, upload, download, test.upload, test.download)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var xfer, events bytes.Buffer
+	server := newTestServer(t)
+	server.audit = &auditLog{xfer: &xfer, events: &events}
+	s := startTestSession(t, server)
+
+	s.command(331, "USER alice")
+	s.command(530, "PASS wrong")
+	s.login()
+	s.command(200, "TYPE I")
+	s.send("hello", "STOR file")
+	s.receive("RETR file")
+	s.command(350, "RNFR file")
+	s.command(250, "RNTO renamed")
+	s.command(250, "DELE renamed")
+
+	server.audit.mu.Lock()
+	defer server.audit.mu.Unlock()
+
+	// One xferlog record per transfer
+	lines := strings.Split(strings.TrimSuffix(xfer.String(), "\n"), "\n")
+	expected := []string{
+		"127.0.0.1 5 /file b _ i a anonymous ftp 0 * c",
+		"127.0.0.1 5 /file b _ o a anonymous ftp 0 * c",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("xferlog: got %q", xfer.String())
+	}
+	for i, line := range lines {
+		// Skip the current time and the transfer time
+		fields := strings.SplitN(line, " ", 7)
+		if len(fields) != 7 || fields[6] != expected[i] {
+			t.Errorf("xferlog: got %q, want %q", line, expected[i])
+		}
+	}
+
+	// One JSON object per audit event
+	var got []string
+	decoder := json.NewDecoder(&events)
+	for decoder.More() {
+		var ev auditEvent
+		if err := decoder.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %s %s %s %v %s", ev.Event, ev.User, ev.Host, ev.Path, ev.NewPath, ev.Success, ev.Reason))
+	}
+	want := []string{
+		"login alice 127.0.0.1   false invalid credentials",
+		"login anonymous 127.0.0.1   true ",
+		"rename anonymous 127.0.0.1 /file /renamed true ",
+		"delete anonymous 127.0.0.1 /renamed  true ",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("events: got %q", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// errTooManySessions is returned when the server is full
+var errTooManySessions = errors.New("too many sessions")
+
+// errTooManyHostSessions is returned when a remote host has too many sessions
+var errTooManyHostSessions = errors.New("too many sessions from the remote host")
+
+// sessionLimiter limits the number of concurrent sessions, overall and per remote host
+type sessionLimiter struct {
+	mu          sync.Mutex
+	maxSessions int // 0 for no limit
+	maxPerHost  int // 0 for no limit
+	count       int
+	hosts       map[string]int
+}
+
+// newSessionLimiter creates a limiter allowing maxSessions sessions,
+// including maxPerHost ones per remote host (0 for no limit)
+func newSessionLimiter(maxSessions, maxPerHost int) *sessionLimiter {
+	return &sessionLimiter{
+		maxSessions: maxSessions,
+		maxPerHost:  maxPerHost,
+		hosts:       make(map[string]int),
+	}
+}
+
+// acquire records a new session of the remote host if the limits allow it
+func (l *sessionLimiter) acquire(host string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSessions > 0 && l.count >= l.maxSessions {
+		return errTooManySessions
+	}
+	if l.maxPerHost > 0 && l.hosts[host] >= l.maxPerHost {
+		return errTooManyHostSessions
+	}
+	l.count++
+	l.hosts[host]++
+	return nil
+}
+
+// release records the end of a session of the remote host
+func (l *sessionLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count--
+	l.hosts[host]--
+	if l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+}
+
+// remoteHost returns the host of the remote end of a connection
+func remoteHost(cnx net.Conn) string {
+	remoteAddr := cnx.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// isTimeout returns true if err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// idleConn is a data connection closed when it is idle for too long.
+// The deadline is pushed back before each read or write.
+type idleConn struct {
+	net.Conn
+	timeout   time.Duration
+	onTimeout func() // Called when the connection times out
+}
+
+// Read reads data, failing if nothing is received before the timeout
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Read(p)
+	if isTimeout(err) {
+		c.onTimeout()
+	}
+	return n, err
+}
+
+// Write writes data, failing if they are not sent before the timeout
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(p)
+	if isTimeout(err) {
+		c.onTimeout()
+	}
+	return n, err
+}
+
+// serve accepts the sessions up to the closing of the listener
+func (server *FtpServer) serve(listener net.Listener) {
+	for {
+		cnx, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Unable to accept incoming connection: %v", err)
+			continue
+		}
+
+		server.active.Add(1)
+		go func() {
+			defer server.active.Done()
+			ftpConnection := &FtpConnection{server: server, tcpConnection: cnx}
+			ftpConnection.handle()
+		}()
+	}
+}
+
+// shutdown asks the sessions to end once their transfer is over and waits
+// for them up to the timeout. It returns false if sessions are still active.
+func (server *FtpServer) shutdown(timeout time.Duration) bool {
+	close(server.draining)
+
+	done := make(chan struct{})
+	go func() {
+		server.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
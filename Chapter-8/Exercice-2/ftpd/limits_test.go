@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestSessionLimiter(t *testing.T) {
+	l := newSessionLimiter(3, 2)
+
+	for _, host := range []string{"a", "a", "b"} {
+		if err := l.acquire(host); err != nil {
+			t.Fatalf("acquire(%s): %v", host, err)
+		}
+	}
+	if err := l.acquire("c"); err != errTooManySessions {
+		t.Errorf("acquire(c): got %v, want %v", err, errTooManySessions)
+	}
+
+	l.release("b")
+	if err := l.acquire("a"); err != errTooManyHostSessions {
+		t.Errorf("acquire(a): got %v, want %v", err, errTooManyHostSessions)
+	}
+	if err := l.acquire("c"); err != nil {
+		t.Errorf("acquire(c): %v", err)
+	}
+
+	l.release("a")
+	l.release("a")
+	l.release("c")
+	if l.count != 0 || len(l.hosts) != 0 {
+		t.Errorf("sessions not released: %d %v", l.count, l.hosts)
+	}
+
+	// No limit
+	l = newSessionLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if err := l.acquire("a"); err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryNodeID identifies a node of a MemoryFileSystem, as an inode does
+// on a local disk. It is the Sys() of the node descriptions.
+type memoryNodeID uint64
+
+// memoryNode is a file or a directory of a MemoryFileSystem
+type memoryNode struct {
+	id      memoryNodeID // Kept when the node is renamed
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+// MemoryFileSystem is a FileSystem kept in memory (e.g. for tests).
+// It is safe for concurrent use by several sessions.
+type MemoryFileSystem struct {
+	mu     sync.Mutex
+	nodes  map[string]*memoryNode // Indexed by virtual path
+	lastID memoryNodeID           // Identifier of the last node created
+}
+
+// NewMemoryFileSystem creates an empty file system
+func NewMemoryFileSystem() *MemoryFileSystem {
+	fs := &MemoryFileSystem{nodes: make(map[string]*memoryNode)}
+	fs.nodes["/"] = fs.newNode(true)
+	return fs
+}
+
+// newNode creates a file or a directory node. The caller must hold the lock.
+func (fs *MemoryFileSystem) newNode(dir bool) *memoryNode {
+	fs.lastID++
+	return &memoryNode{id: fs.lastID, dir: dir, modTime: time.Now()}
+}
+
+// Factory returns a FileSystemFactory giving each root directory its own
+// subtree of this file system, as the directories of a local disk do
+func (fs *MemoryFileSystem) Factory() FileSystemFactory {
+	return func(root string) (FileSystem, error) {
+		prefix := path.Clean("/" + filepath.ToSlash(root))
+		if err := fs.mkdirAll(prefix); err != nil {
+			return nil, err
+		}
+		if prefix == "/" {
+			return fs, nil
+		}
+		return &memorySubtree{fs: fs, prefix: prefix}, nil
+	}
+}
+
+// mkdirAll creates a directory and its missing parents
+func (fs *MemoryFileSystem) mkdirAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for dir := name; ; dir = path.Dir(dir) {
+		node, ok := fs.nodes[dir]
+		if ok && !node.dir {
+			return pathError("mkdir", dir, errors.New("not a directory"))
+		}
+		if ok {
+			break
+		}
+		fs.nodes[dir] = fs.newNode(true)
+	}
+	return nil
+}
+
+// pathError builds the error of an operation
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// parentDirectory checks the parent of a path is an existing directory.
+// The caller must hold the lock.
+func (fs *MemoryFileSystem) parentDirectory(op, name string) error {
+	parent, ok := fs.nodes[path.Dir(name)]
+	if !ok || !parent.dir {
+		return pathError(op, name, os.ErrNotExist)
+	}
+	return nil
+}
+
+// Stat returns the description of a file or directory
+func (fs *MemoryFileSystem) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.nodes[name]
+	if !ok {
+		return nil, pathError("stat", name, os.ErrNotExist)
+	}
+	return newMemoryFileInfo(name, node), nil
+}
+
+// List returns the content of a directory, sorted by name
+func (fs *MemoryFileSystem) List(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.nodes[name]
+	if !ok {
+		return nil, pathError("list", name, os.ErrNotExist)
+	}
+	if !node.dir {
+		return nil, pathError("list", name, errors.New("not a directory"))
+	}
+
+	var infos []os.FileInfo
+	for childName, child := range fs.nodes {
+		if childName != "/" && path.Dir(childName) == name {
+			infos = append(infos, newMemoryFileInfo(childName, child))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Open opens a file for reading
+func (fs *MemoryFileSystem) Open(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.nodes[name]
+	if !ok {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	if node.dir {
+		return nil, pathError("open", name, errors.New("is a directory"))
+	}
+	return &memoryFile{fs: fs, node: node, readOnly: true}, nil
+}
+
+// Create opens a file for writing, creating it if needed
+func (fs *MemoryFileSystem) Create(name string, flag int) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.nodes[name]
+	if ok && node.dir {
+		return nil, pathError("create", name, errors.New("is a directory"))
+	}
+	if !ok {
+		if err := fs.parentDirectory("create", name); err != nil {
+			return nil, err
+		}
+		node = fs.newNode(false)
+		fs.nodes[name] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memoryFile{fs: fs, node: node, appendMode: flag&os.O_APPEND != 0}, nil
+}
+
+// Mkdir creates a directory
+func (fs *MemoryFileSystem) Mkdir(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.nodes[name]; ok {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+	if err := fs.parentDirectory("mkdir", name); err != nil {
+		return err
+	}
+	fs.nodes[name] = fs.newNode(true)
+	return nil
+}
+
+// Remove removes a file or an empty directory
+func (fs *MemoryFileSystem) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.nodes[name]
+	if !ok || name == "/" {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	if node.dir {
+		for childName := range fs.nodes {
+			if strings.HasPrefix(childName, name+"/") {
+				return pathError("remove", name, errors.New("directory not empty"))
+			}
+		}
+	}
+	delete(fs.nodes, name)
+	return nil
+}
+
+// Rename moves a file or directory
+func (fs *MemoryFileSystem) Rename(oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	node, ok := fs.nodes[oldName]
+	if !ok || oldName == "/" {
+		return pathError("rename", oldName, os.ErrNotExist)
+	}
+	if err := fs.parentDirectory("rename", newName); err != nil {
+		return err
+	}
+	if newName == oldName || strings.HasPrefix(newName, oldName+"/") {
+		return pathError("rename", newName, errors.New("invalid argument"))
+	}
+	if target, ok := fs.nodes[newName]; ok && (target.dir || node.dir) {
+		return pathError("rename", newName, os.ErrExist)
+	}
+
+	// Move the node and its descendants
+	fs.nodes[newName] = node
+	delete(fs.nodes, oldName)
+	if node.dir {
+		for childName, child := range fs.nodes {
+			if strings.HasPrefix(childName, oldName+"/") {
+				fs.nodes[newName+strings.TrimPrefix(childName, oldName)] = child
+				delete(fs.nodes, childName)
+			}
+		}
+	}
+	return nil
+}
+
+// memorySubtree is the FileSystem of a user whose root is a directory of a
+// MemoryFileSystem
+type memorySubtree struct {
+	fs     *MemoryFileSystem
+	prefix string // path of the root directory in fs
+}
+
+// fullPath computes the path in the MemoryFileSystem of a virtual path
+func (sub *memorySubtree) fullPath(name string) string {
+	if name == "/" {
+		return sub.prefix
+	}
+	return sub.prefix + name
+}
+
+// Stat returns the description of a file or directory
+func (sub *memorySubtree) Stat(name string) (os.FileInfo, error) {
+	return sub.fs.Stat(sub.fullPath(name))
+}
+
+// List returns the content of a directory, sorted by name
+func (sub *memorySubtree) List(name string) ([]os.FileInfo, error) {
+	return sub.fs.List(sub.fullPath(name))
+}
+
+// Open opens a file for reading
+func (sub *memorySubtree) Open(name string) (File, error) {
+	return sub.fs.Open(sub.fullPath(name))
+}
+
+// Create opens a file for writing, creating it if needed
+func (sub *memorySubtree) Create(name string, flag int) (File, error) {
+	return sub.fs.Create(sub.fullPath(name), flag)
+}
+
+// Mkdir creates a directory
+func (sub *memorySubtree) Mkdir(name string) error {
+	return sub.fs.Mkdir(sub.fullPath(name))
+}
+
+// Remove removes a file or an empty directory (not the root directory)
+func (sub *memorySubtree) Remove(name string) error {
+	if name == "/" {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	return sub.fs.Remove(sub.fullPath(name))
+}
+
+// Rename moves a file or directory (not the root directory)
+func (sub *memorySubtree) Rename(oldName, newName string) error {
+	if oldName == "/" {
+		return pathError("rename", oldName, os.ErrNotExist)
+	}
+	return sub.fs.Rename(sub.fullPath(oldName), sub.fullPath(newName))
+}
+
+// memoryFile is an open file of a MemoryFileSystem
+type memoryFile struct {
+	fs         *MemoryFileSystem
+	node       *memoryNode
+	offset     int64
+	readOnly   bool
+	appendMode bool
+}
+
+// Read reads data from the current offset
+func (f *memoryFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// Write writes data at the current offset (at the end in append mode)
+func (f *memoryFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.readOnly {
+		return 0, errors.New("file opened for reading")
+	}
+	if f.appendMode {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+// Seek sets the offset of the next Read or Write
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Truncate changes the size of the file
+func (f *memoryFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.readOnly {
+		return errors.New("file opened for reading")
+	}
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	data := make([]byte, size)
+	copy(data, f.node.data)
+	f.node.data = data
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// Close closes the file
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+// memoryFileInfo is the description of a memoryNode
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+	id      memoryNodeID
+}
+
+// newMemoryFileInfo builds the description of a node. The caller must hold the lock.
+func newMemoryFileInfo(name string, node *memoryNode) os.FileInfo {
+	return &memoryFileInfo{
+		name:    path.Base(name),
+		size:    int64(len(node.data)),
+		dir:     node.dir,
+		modTime: node.modTime,
+		id:      node.id,
+	}
+}
+
+func (info *memoryFileInfo) Name() string       { return info.name }
+func (info *memoryFileInfo) Size() int64        { return info.size }
+func (info *memoryFileInfo) ModTime() time.Time { return info.modTime }
+func (info *memoryFileInfo) IsDir() bool        { return info.dir }
+func (info *memoryFileInfo) Sys() interface{}   { return info.id }
+
+// Mode returns the permissions of the node (all nodes are readable and writable)
+func (info *memoryFileInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// mlsxFacts is the list of the facts supported by MLST and MLSD (RFC 3659)
+var mlsxFacts = []string{"type", "size", "modify", "perm", "unique"}
+
+// features is the list of the extensions advertised by FEAT
+var features = []string{
+	"UTF8",
+	"SIZE",
+	"MDTM",
+	"REST STREAM",
+}
+
+// selectedFacts returns the facts to provide in MLST and MLSD replies
+func (conn *FtpConnection) selectedFacts() []string {
+	if conn.facts == nil {
+		return mlsxFacts
+	}
+	return conn.facts
+}
+
+// factsLine builds the facts of a file followed by its name
+func (conn *FtpConnection) factsLine(info os.FileInfo, fileType, name string) string {
+	var b strings.Builder
+	for _, fact := range conn.selectedFacts() {
+		switch fact {
+		case "type":
+			fmt.Fprintf(&b, "type=%s;", fileType)
+		case "size":
+			if !info.IsDir() {
+				fmt.Fprintf(&b, "size=%d;", info.Size())
+			}
+		case "modify":
+			fmt.Fprintf(&b, "modify=%s;", info.ModTime().UTC().Format("20060102150405"))
+		case "perm":
+			fmt.Fprintf(&b, "perm=%s;", permFact(info))
+		case "unique":
+			if unique, ok := uniqueFact(info); ok {
+				fmt.Fprintf(&b, "unique=%s;", unique)
+			}
+		}
+	}
+	b.WriteString(" ")
+	b.WriteString(name)
+	return b.String()
+}
+
+// uniqueFact computes the unique fact of a file from its identity in its file
+// system, so that it is kept when the file is renamed or reached through
+// several paths. ok is false if the file system gives no identity.
+func uniqueFact(info os.FileInfo) (unique string, ok bool) {
+	if id, ok := info.Sys().(memoryNodeID); ok {
+		return fmt.Sprintf("m%x", uint64(id)), true
+	}
+	return localFileID(info)
+}
+
+// permFact computes the perm fact of a file from its owner permissions
+func permFact(info os.FileInfo) string {
+	mode := info.Mode().Perm()
+	var perm string
+	if info.IsDir() {
+		if mode&0500 == 0500 {
+			perm += "el"
+		}
+		if mode&0200 != 0 {
+			perm += "cmpdf"
+		}
+	} else {
+		if mode&0400 != 0 {
+			perm += "r"
+		}
+		if mode&0200 != 0 {
+			perm += "awdf"
+		}
+	}
+	return perm
+}
+
+// fileType returns the type fact of a file
+func fileType(info os.FileInfo) string {
+	if info.IsDir() {
+		return "dir"
+	}
+	return "file"
+}
+
+// commandFeatures manages the FEAT FTP command (RFC 2389)
+func (conn *FtpConnection) commandFeatures(args []string) {
+	// Check arguments count
+	if len(args) != 0 {
+		log.Printf("commandFeatures: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Build the MLST feature with the selected facts marked by '*'
+	selected := make(map[string]bool)
+	for _, fact := range conn.selectedFacts() {
+		selected[fact] = true
+	}
+	var mlst strings.Builder
+	mlst.WriteString("MLST ")
+	for _, fact := range mlsxFacts {
+		mlst.WriteString(fact)
+		if selected[fact] {
+			mlst.WriteString("*")
+		}
+		mlst.WriteString(";")
+	}
+
+	// Send the reply
+	conn.writeString("211-Extensions supported:")
+	conn.writeString(" %s", mlst.String())
+	for _, feature := range features {
+		conn.writeString(" %s", feature)
+	}
+	if conn.server.tlsConfig != nil {
+		conn.writeString(" AUTH TLS")
+		conn.writeString(" PBSZ")
+		conn.writeString(" PROT")
+	}
+	conn.writeString("211 End.")
+}
+
+// commandOptions manages the OPTS FTP command (RFC 2389)
+func (conn *FtpConnection) commandOptions(args []string) {
+	// Check arguments count
+	if len(args) < 1 || len(args) > 2 {
+		log.Printf("commandOptions: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "UTF8": // File names are always UTF-8 encoded
+		if len(args) == 2 && strings.ToUpper(args[1]) != "ON" {
+			conn.writeString("504 Command not implemented for that parameter.")
+			return
+		}
+		conn.writeString("200 UTF8 mode enabled.")
+	case "MLST":
+		// Select the supported facts among the requested ones
+		facts := []string{}
+		if len(args) == 2 {
+			for _, fact := range mlsxFacts {
+				for _, requested := range strings.Split(args[1], ";") {
+					if strings.EqualFold(requested, fact) {
+						facts = append(facts, fact)
+						break
+					}
+				}
+			}
+		}
+		conn.facts = facts
+
+		// Send the reply with the selected facts
+		var reply strings.Builder
+		for _, fact := range facts {
+			reply.WriteString(fact)
+			reply.WriteString(";")
+		}
+		conn.writeString("200 MLST OPTS %s", reply.String())
+	default:
+		log.Printf("commandOptions: unknown option: %s", args[0])
+		conn.writeString("501 Syntax error in parameters or arguments.")
+	}
+}
+
+// commandMachineListSingle manages the MLST FTP command (RFC 3659)
+func (conn *FtpConnection) commandMachineListSingle(args []string) {
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandMachineListSingle: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the file name (the working directory by default)
+	name := strings.Join(args, " ")
+	if name == "" {
+		name = "."
+	}
+	virtual, err := conn.resolvePath(name)
+	if err != nil {
+		log.Printf("commandMachineListSingle: invalid file name: %s (%v)", name, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Get the file status
+	info, err := conn.fileSystem.Stat(virtual)
+	if err != nil {
+		log.Printf("commandMachineListSingle: file not found: %s", virtual)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Send the reply
+	conn.writeString("250-Listing %s", virtual)
+	conn.writeString(" %s", conn.factsLine(info, fileType(info), virtual))
+	conn.writeString("250 End.")
+}
+
+// commandMachineListDirectory manages the MLSD FTP command (RFC 3659)
+func (conn *FtpConnection) commandMachineListDirectory(args []string) {
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandMachineListDirectory: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the directory name (the working directory by default)
+	name := strings.Join(args, " ")
+	if name == "" {
+		name = "."
+	}
+	virtual, err := conn.resolvePath(name)
+	if err != nil {
+		log.Printf("commandMachineListDirectory: invalid directory name: %s (%v)", name, err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Check the directory
+	info, err := conn.fileSystem.Stat(virtual)
+	if err != nil {
+		log.Printf("commandMachineListDirectory: directory not found: %s", virtual)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+	if !info.IsDir() {
+		log.Printf("commandMachineListDirectory: not a directory: %s", virtual)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Get the directory list
+	entries, err := conn.fileSystem.List(virtual)
+	if err != nil {
+		log.Printf("commandMachineListDirectory: unable to read directory: %v", err)
+		conn.writeString("550 Requested action not taken. File unavailable.")
+		return
+	}
+
+	// Build the listing (the directory itself first)
+	lines := []string{conn.factsLine(info, "cdir", virtual)}
+	for _, entry := range entries {
+		lines = append(lines, conn.factsLine(entry, fileType(entry), entry.Name()))
+	}
+
+	conn.startTransfer(func() {
+		// Send the preliminary reply
+		conn.writeString("150 Here comes the directory listing.")
+
+		// Get the data connection
+		dataConnection, err := conn.getDataConnection()
+		if err != nil {
+			log.Printf("commandMachineListDirectory: Unable to get data connection: %v", err)
+			return
+		}
+		defer dataConnection.Close()
+
+		// Send the directory list
+		writer := conn.newListingWriter(dataConnection)
+		for _, line := range lines {
+			line += "\r\n"
+			written, err := writer.Write([]byte(line))
+			if err != nil {
+				log.Printf("commandMachineListDirectory: Unable to send data: %v", err)
+				conn.writeString("426 Connection closed; transfer aborted.")
+				return
+			}
+			if written != len(line) {
+				log.Printf("commandMachineListDirectory: Unable to send all data: %d/%d", written, len(line))
+				conn.writeString("426 Connection closed; transfer aborted.")
+				return
+			}
+		}
+
+		// Signal the end of the listing
+		if err := writer.Close(); err != nil {
+			log.Printf("commandMachineListDirectory: Unable to send data: %v", err)
+			conn.writeString("426 Connection closed; transfer aborted.")
+			return
+		}
+
+		// Send the completion reply
+		conn.writeString("226 Directory send OK.")
+	})
+}
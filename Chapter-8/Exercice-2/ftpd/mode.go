@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Block mode descriptor codes (RFC 959, 3.4.2)
+const (
+	blockEndOfRecord   = 0x80
+	blockEndOfFile     = 0x40
+	blockRestartMarker = 0x10
+)
+
+// Escape sequences of the record structure in stream mode (RFC 959, 3.4.1)
+const (
+	streamEscape      = 0xFF
+	streamEndOfRecord = 0x01
+	streamEndOfFile   = 0x02
+)
+
+// maxBlockSize is the maximum size of the data of a block
+const maxBlockSize = 0xFFFF
+
+// restartMarkerInterval is the number of bytes between two restart markers
+// sent in block mode
+var restartMarkerInterval int64 = 1 << 20
+
+// dataWriter encodes the data sent on a data connection according to
+// the representation type, the file structure and the transmission mode
+type dataWriter struct {
+	w          io.Writer
+	ascii      bool  // Local end of lines are sent as CRLF
+	record     bool  // Local lines are sent as records
+	block      bool  // Data are sent as blocks
+	offset     int64 // Offset in the local file of the next byte
+	nextMarker int64 // Offset of the next restart marker (block mode)
+	inRecord   bool  // true if a record is started and not ended
+	lastCR     bool  // true if the last local byte is CR
+}
+
+// newDataWriter builds the writer used to send a file from the given offset
+func (conn *FtpConnection) newDataWriter(w io.Writer, offset int64) *dataWriter {
+	return &dataWriter{
+		w:          w,
+		ascii:      !conn.binary,
+		record:     conn.recordStructure,
+		block:      conn.blockMode,
+		offset:     offset,
+		nextMarker: offset + restartMarkerInterval,
+	}
+}
+
+// newListingWriter builds the writer used to send a directory listing
+// (the listing lines are already formatted for the network)
+func (conn *FtpConnection) newListingWriter(w io.Writer) *dataWriter {
+	return &dataWriter{w: w, block: conn.blockMode, nextMarker: -1}
+}
+
+// Write encodes local data
+func (dw *dataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Get the next chunk up to an end of line
+		n := len(p)
+		newLine := false
+		if dw.ascii || dw.record {
+			for i, b := range p {
+				if b == '\n' {
+					n = i
+					newLine = true
+					break
+				}
+			}
+		}
+
+		// Send the chunk
+		if n > 0 {
+			if err := dw.sendData(p[:n]); err != nil {
+				return written, err
+			}
+			dw.inRecord = dw.record
+			dw.lastCR = p[n-1] == '\r'
+		}
+
+		// Send the end of line
+		if newLine {
+			var err error
+			switch {
+			case dw.record:
+				err = dw.endRecord()
+			case dw.lastCR:
+				err = dw.sendData([]byte{'\n'})
+			default:
+				err = dw.sendData([]byte{'\r', '\n'})
+			}
+			if err != nil {
+				return written, err
+			}
+			dw.lastCR = false
+			n++
+		}
+
+		written += n
+		dw.offset += int64(n)
+		p = p[n:]
+	}
+
+	// Send a restart marker once in a while
+	if dw.block && dw.nextMarker >= 0 && dw.offset >= dw.nextMarker {
+		marker := strconv.FormatInt(dw.offset, 10)
+		if err := dw.sendBlock(blockRestartMarker, []byte(marker)); err != nil {
+			return written, err
+		}
+		dw.nextMarker = dw.offset + restartMarkerInterval
+	}
+	return written, nil
+}
+
+// Close signals the end of the file (the data connection is not closed)
+func (dw *dataWriter) Close() error {
+	// End the last record
+	if dw.inRecord {
+		if err := dw.endRecord(); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case dw.block:
+		return dw.sendBlock(blockEndOfFile, nil)
+	case dw.record:
+		_, err := dw.w.Write([]byte{streamEscape, streamEndOfFile})
+		return err
+	}
+	return nil
+}
+
+// endRecord sends an end of record
+func (dw *dataWriter) endRecord() error {
+	dw.inRecord = false
+	if dw.block {
+		return dw.sendBlock(blockEndOfRecord, nil)
+	}
+	_, err := dw.w.Write([]byte{streamEscape, streamEndOfRecord})
+	return err
+}
+
+// sendData sends data according to the transmission mode
+func (dw *dataWriter) sendData(data []byte) error {
+	if dw.block {
+		for len(data) > 0 {
+			n := len(data)
+			if n > maxBlockSize {
+				n = maxBlockSize
+			}
+			if err := dw.sendBlock(0, data[:n]); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	}
+
+	// The escape byte is doubled in the records
+	if dw.record {
+		escaped := make([]byte, 0, len(data))
+		for _, b := range data {
+			if b == streamEscape {
+				escaped = append(escaped, streamEscape)
+			}
+			escaped = append(escaped, b)
+		}
+		data = escaped
+	}
+	_, err := dw.w.Write(data)
+	return err
+}
+
+// sendBlock sends a block with its header
+func (dw *dataWriter) sendBlock(descriptor byte, data []byte) error {
+	block := make([]byte, 3, 3+len(data))
+	block[0] = descriptor
+	binary.BigEndian.PutUint16(block[1:], uint16(len(data)))
+	block = append(block, data...)
+	_, err := dw.w.Write(block)
+	return err
+}
+
+// dataReader decodes the data received on a data connection according to
+// the representation type, the file structure and the transmission mode
+type dataReader struct {
+	r         *bufio.Reader
+	ascii     bool                              // CRLF are stored as local end of lines
+	record    bool                              // Records are stored as local lines
+	block     bool                              // Data are received as blocks
+	onMarker  func(marker string, offset int64) // Called for each restart marker (block mode)
+	offset    int64                             // Offset in the local file of the next byte
+	pending   []byte                            // Decoded data not returned yet
+	pendingCR bool                              // true if a CR is held up to the next byte
+	eof       bool                              // true once the end of file is received
+}
+
+// newDataReader builds the reader used to receive a file from the given offset
+func (conn *FtpConnection) newDataReader(r io.Reader, offset int64, onMarker func(marker string, offset int64)) *dataReader {
+	return &dataReader{
+		r:        bufio.NewReader(r),
+		ascii:    !conn.binary,
+		record:   conn.recordStructure,
+		block:    conn.blockMode,
+		onMarker: onMarker,
+		offset:   offset,
+	}
+}
+
+// Read returns decoded data
+func (dr *dataReader) Read(p []byte) (int, error) {
+	for len(dr.pending) == 0 {
+		if dr.eof {
+			return 0, io.EOF
+		}
+		if err := dr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.pending)
+	dr.pending = dr.pending[n:]
+	dr.offset += int64(n)
+	return n, nil
+}
+
+// fill decodes the next data received
+func (dr *dataReader) fill() error {
+	if dr.block {
+		return dr.fillBlock()
+	}
+	return dr.fillStream()
+}
+
+// fillBlock decodes the next block
+func (dr *dataReader) fillBlock() error {
+	// Read the header
+	var header [3]byte
+	if _, err := io.ReadFull(dr.r, header[:]); err != nil {
+		if err == io.EOF {
+			return errors.New("data connection closed before end of file")
+		}
+		return err
+	}
+	descriptor := header[0]
+	data := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(dr.r, data); err != nil {
+		return err
+	}
+
+	// Restart markers are not part of the file
+	if descriptor&blockRestartMarker != 0 {
+		if dr.onMarker != nil {
+			dr.onMarker(string(data), dr.offset)
+		}
+	} else {
+		dr.decode(data)
+	}
+
+	if descriptor&blockEndOfRecord != 0 {
+		dr.endRecord()
+	}
+	if descriptor&blockEndOfFile != 0 {
+		dr.endOfFile()
+	}
+	return nil
+}
+
+// fillStream decodes the next data in stream mode
+func (dr *dataReader) fillStream() error {
+	buffer := make([]byte, 32*1024)
+	n, err := dr.r.Read(buffer)
+	if n == 0 && err == io.EOF {
+		dr.endOfFile()
+		return nil
+	}
+	if n == 0 {
+		return err
+	}
+	buffer = buffer[:n]
+
+	if !dr.record {
+		dr.decode(buffer)
+		return nil
+	}
+
+	// Process the escape sequences of the records
+	var data []byte
+	for i := 0; i < len(buffer); i++ {
+		if buffer[i] != streamEscape {
+			data = append(data, buffer[i])
+			continue
+		}
+
+		// Get the byte following the escape one
+		var code byte
+		if i+1 < len(buffer) {
+			i++
+			code = buffer[i]
+		} else if code, err = dr.r.ReadByte(); err != nil {
+			return errors.New("truncated escape sequence")
+		}
+
+		if code == streamEscape {
+			data = append(data, streamEscape)
+			continue
+		}
+		dr.decode(data)
+		data = nil
+		if code&streamEndOfRecord != 0 {
+			dr.endRecord()
+		}
+		if code&streamEndOfFile != 0 {
+			dr.endOfFile()
+			return nil
+		}
+	}
+	dr.decode(data)
+	return nil
+}
+
+// decode converts received data into local format
+func (dr *dataReader) decode(data []byte) {
+	if !dr.ascii {
+		dr.pending = append(dr.pending, data...)
+		return
+	}
+
+	// Convert CRLF into LF
+	for _, b := range data {
+		if dr.pendingCR {
+			dr.pendingCR = false
+			if b == '\n' {
+				dr.pending = append(dr.pending, '\n')
+				continue
+			}
+			dr.pending = append(dr.pending, '\r')
+		}
+		if b == '\r' {
+			dr.pendingCR = true
+			continue
+		}
+		dr.pending = append(dr.pending, b)
+	}
+}
+
+// endRecord stores an end of record as a local end of line
+func (dr *dataReader) endRecord() {
+	if dr.pendingCR {
+		dr.pending = append(dr.pending, '\r')
+		dr.pendingCR = false
+	}
+	if dr.record {
+		dr.pending = append(dr.pending, '\n')
+	}
+}
+
+// endOfFile flushes the held data at the end of the file
+func (dr *dataReader) endOfFile() {
+	if dr.pendingCR {
+		dr.pending = append(dr.pending, '\r')
+		dr.pendingCR = false
+	}
+	dr.eof = true
+}
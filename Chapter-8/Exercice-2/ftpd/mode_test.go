@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// encode encodes data with a dataWriter
+func encode(t *testing.T, conn *FtpConnection, data string) string {
+	t.Helper()
+	var b bytes.Buffer
+	writer := conn.newDataWriter(&b, 0)
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// decode decodes data with a dataReader
+func decode(t *testing.T, conn *FtpConnection, data string) string {
+	t.Helper()
+	reader := conn.newDataReader(bytes.NewReader([]byte(data)), 0, nil)
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestDataEncoding(t *testing.T) {
+	var tests = []struct {
+		binary, record, block bool
+		local                 string
+		network               string
+	}{
+		// TYPE I
+		{true, false, false, "a\nb\r\n\xff", "a\nb\r\n\xff"},
+		// TYPE A
+		{false, false, false, "a\nb\nc", "a\r\nb\r\nc"},
+		// STRU R
+		{false, true, false, "a\n\xffb\n", "a\xff\x01\xff\xffb\xff\x01\xff\x02"},
+		// MODE B
+		{true, false, true, "abc", "\x00\x00\x03abc\x40\x00\x00"},
+		{false, false, true, "a\n", "\x00\x00\x01a\x00\x00\x02\r\n\x40\x00\x00"},
+		{false, true, true, "a\nb\n", "\x00\x00\x01a\x80\x00\x00\x00\x00\x01b\x80\x00\x00\x40\x00\x00"},
+	}
+	for _, test := range tests {
+		conn := &FtpConnection{binary: test.binary, recordStructure: test.record, blockMode: test.block}
+		if got := encode(t, conn, test.local); got != test.network {
+			t.Errorf("encode(%q) with binary=%v record=%v block=%v = %q, want %q", test.local, test.binary, test.record, test.block, got, test.network)
+		}
+		if got := decode(t, conn, test.network); got != test.local {
+			t.Errorf("decode(%q) with binary=%v record=%v block=%v = %q, want %q", test.network, test.binary, test.record, test.block, got, test.local)
+		}
+	}
+}
+
+func TestDataEncodingOneWay(t *testing.T) {
+	var tests = []struct {
+		binary, record, block bool
+		local                 string
+		network               string
+	}{
+		// Local CRLF are kept in ASCII
+		{false, false, false, "a\r\nb", "a\r\nb"},
+		// The last line is a record even without end of line
+		{false, true, false, "a\nb", "a\xff\x01b\xff\x01\xff\x02"},
+	}
+	for _, test := range tests {
+		conn := &FtpConnection{binary: test.binary, recordStructure: test.record, blockMode: test.block}
+		if got := encode(t, conn, test.local); got != test.network {
+			t.Errorf("encode(%q) = %q, want %q", test.local, got, test.network)
+		}
+	}
+}
+
+func TestDataDecoding(t *testing.T) {
+	var tests = []struct {
+		binary, record, block bool
+		network               string
+		local                 string
+	}{
+		// A lone CR is kept in ASCII
+		{false, false, false, "a\rb\r", "a\rb\r"},
+		// Data after the end of file are ignored
+		{false, true, false, "a\xff\x03b", "a\n"},
+		// Blocks with several descriptors
+		{true, false, true, "\xc0\x00\x02ab", "ab"},
+	}
+	for _, test := range tests {
+		conn := &FtpConnection{binary: test.binary, recordStructure: test.record, blockMode: test.block}
+		if got := decode(t, conn, test.network); got != test.local {
+			t.Errorf("decode(%q) = %q, want %q", test.network, got, test.local)
+		}
+	}
+
+	// A block mode transfer must end with an end of file block
+	conn := &FtpConnection{binary: true, blockMode: true}
+	reader := conn.newDataReader(bytes.NewReader([]byte("\x00\x00\x01a")), 0, nil)
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Errorf("truncated block mode transfer accepted")
+	}
+}
+
+func TestRestartMarkers(t *testing.T) {
+	saved := restartMarkerInterval
+	restartMarkerInterval = 4
+	defer func() { restartMarkerInterval = saved }()
+
+	conn := &FtpConnection{binary: true, blockMode: true}
+
+	// Markers are sent every 4 bytes with the offset in the local file
+	var b bytes.Buffer
+	writer := conn.newDataWriter(&b, 10)
+	for _, chunk := range []string{"ab", "cd", "ef"} {
+		if _, err := writer.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := "\x00\x00\x02ab\x00\x00\x02cd\x10\x00\x0214\x00\x00\x02ef\x40\x00\x00"
+	if got := b.String(); got != want {
+		t.Errorf("block mode with markers = %q, want %q", got, want)
+	}
+
+	// Markers are reported with the offset of the local file
+	var markers []string
+	var offsets []int64
+	reader := conn.newDataReader(&b, 10, func(marker string, offset int64) {
+		markers = append(markers, marker)
+		offsets = append(offsets, offset)
+	})
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdef" {
+		t.Errorf("decoded data = %q, want abcdef", got)
+	}
+	if len(markers) != 1 || markers[0] != "14" || offsets[0] != 14 {
+		t.Errorf("markers = %v at %v, want [14] at [14]", markers, offsets)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange is a range of TCP ports (both bounds included).
+// The zero value means the ports are allocated by the system.
+type portRange struct {
+	min, max int
+}
+
+// parsePortRange parses a range formatted as "min-max" (or a single port)
+func parsePortRange(s string) (portRange, error) {
+	minText, maxText, ok := strings.Cut(s, "-")
+	if !ok {
+		maxText = minText
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(minText))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", minText)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(maxText))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port: %s", maxText)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return portRange{}, fmt.Errorf("invalid range: %s", s)
+	}
+	return portRange{min: min, max: max}, nil
+}
+
+// resolveIPv4 returns the IP V4 address of a literal address or a host name
+func resolveIPv4(host string) (net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4, nil
+		}
+	}
+	return nil, fmt.Errorf("no IP V4 address for %s", host)
+}
+
+// errNoPassivePort is returned when all the ports of the passive range are in use
+var errNoPassivePort = errors.New("no free port in the passive port range")
+
+// listenPassive creates the listener of a passive data connection on a port
+// of the configured range. The ports are tried from a random one so that
+// concurrent sessions do not compete for the same ports.
+func (server *FtpServer) listenPassive(network, host string) (net.Listener, error) {
+	ports := server.passivePorts
+	if ports.min == 0 {
+		return net.Listen(network, net.JoinHostPort(host, "0"))
+	}
+
+	count := ports.max - ports.min + 1
+	start := rand.Intn(count)
+	for i := 0; i < count; i++ {
+		port := ports.min + (start+i)%count
+		listener, err := net.Listen(network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, errNoPassivePort
+}
+
+// setPassiveListener stores the listener of the next data connection
+// (nil for the active mode), closing the one of a previous passive command
+// not followed by a transfer
+func (conn *FtpConnection) setPassiveListener(listener net.Listener) {
+	if conn.passive {
+		conn.listener.Close()
+	}
+	conn.listener = listener
+	conn.passive = listener != nil
+}
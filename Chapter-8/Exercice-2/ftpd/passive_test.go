@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected portRange
+		valid    bool
+	}{
+		{"50000-50100", portRange{50000, 50100}, true},
+		{"2121", portRange{2121, 2121}, true},
+		{" 1 - 65535 ", portRange{1, 65535}, true},
+		{"50100-50000", portRange{}, false},
+		{"0-10", portRange{}, false},
+		{"1-65536", portRange{}, false},
+		{"a-b", portRange{}, false},
+		{"", portRange{}, false},
+	}
+
+	for _, test := range tests {
+		ports, err := parsePortRange(test.s)
+		if test.valid && (err != nil || ports != test.expected) {
+			t.Errorf("parsePortRange(%q) = %v, %v, want %v", test.s, ports, err, test.expected)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("parsePortRange(%q) = %v, want an error", test.s, ports)
+		}
+	}
+}
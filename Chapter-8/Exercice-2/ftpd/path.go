@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errPathEscape is returned when a path resolves outside of the user root directory
+var errPathEscape = errors.New("path escapes the root directory")
+
+// virtualPath computes the virtual path designated by name, relative to the
+// virtual working directory cwd. The result is a clean absolute path
+// using '/' as separator. An error is returned if the path goes above the root.
+func virtualPath(cwd, name string) (string, error) {
+	if !strings.HasPrefix(name, "/") {
+		name = cwd + "/" + name
+	}
+
+	// Walk through the components to detect escapes through ".."
+	depth := 0
+	for _, elem := range strings.Split(name, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", errPathEscape
+			}
+		default:
+			depth++
+		}
+	}
+
+	return path.Clean("/" + name), nil
+}
+
+// errTooManyLinks is returned when the symbolic links of a path form a loop
+var errTooManyLinks = errors.New("too many levels of symbolic links")
+
+// maxLinks is the number of symbolic links followed to resolve a path
+const maxLinks = 40
+
+// realPath computes the local path of a virtual path inside the root directory.
+// Symbolic links are followed and the resulting path must stay inside the root.
+// The last components of the path do not need to exist (e.g. for a new file),
+// but a symbolic link is followed even if its target doesn't exist.
+func realPath(root, virtual string) (string, error) {
+	// Resolve the symbolic links of the root directory
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	// Resolve the components one by one: os.Lstat detects the links,
+	// including those whose target doesn't exist
+	resolved := realRoot
+	pending := strings.Split(virtual, "/")
+	links := 0
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, elem)
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			// Nothing exists below, so there is no link left to follow
+			resolved = filepath.Join(append([]string{next}, pending...)...)
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		// Replace the link by its target
+		links++
+		if links > maxLinks {
+			return "", errTooManyLinks
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			volume := filepath.VolumeName(target)
+			resolved = volume + string(filepath.Separator)
+			target = target[len(volume):]
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+
+	// Check the result is inside the root directory
+	rel, err := filepath.Rel(realRoot, resolved)
+	if err != nil {
+		return "", errPathEscape
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errPathEscape
+	}
+
+	return resolved, nil
+}
+
+// resolvePath computes the virtual path of a name sent by the client
+func (conn *FtpConnection) resolvePath(name string) (string, error) {
+	return virtualPath(conn.workingDirectory, name)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVirtualPath(t *testing.T) {
+	var tests = []struct {
+		cwd  string
+		name string
+		want string
+		err  bool
+	}{
+		{"/", "dir", "/dir", false},
+		{"/", "/dir/", "/dir", false},
+		{"/a/b", "c", "/a/b/c", false},
+		{"/a/b", "..", "/a", false},
+		{"/a/b", "../..", "/", false},
+		{"/a/b", "./c/../d", "/a/b/d", false},
+		{"/a/b", "/x", "/x", false},
+		{"/", "..", "", true},
+		{"/", "../../etc", "", true},
+		{"/a/b", "../../../etc", "", true},
+		{"/a", "/../etc", "", true},
+		{"/", "a/../../etc", "", true},
+	}
+	for _, test := range tests {
+		got, err := virtualPath(test.cwd, test.name)
+		if test.err {
+			if err == nil {
+				t.Errorf("virtualPath(%q, %q) = %q, want an error", test.cwd, test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("virtualPath(%q, %q) failed: %v", test.cwd, test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("virtualPath(%q, %q) = %q, want %q", test.cwd, test.name, got, test.want)
+		}
+	}
+}
+
+func TestRealPath(t *testing.T) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "dir"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Links inside and outside of the root directory
+	links := map[string]string{
+		filepath.Join(root, "inside"):      filepath.Join(root, "dir"),
+		filepath.Join(root, "escape"):      outside,
+		filepath.Join(root, "dir", "etc"):  "/etc",
+		filepath.Join(root, "relative"):    "../outside",
+		filepath.Join(root, "dangling"):    filepath.Join(outside, "newfile"),
+		filepath.Join(root, "reldangling"): "../outside/new/file",
+		filepath.Join(root, "newlink"):     "dir/new",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Skipf("symbolic links not supported: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		virtual string
+		want    string
+		err     bool
+	}{
+		{"/", root, false},
+		{"/dir", filepath.Join(root, "dir"), false},
+		{"/newfile", filepath.Join(root, "newfile"), false},
+		{"/dir/new/file", filepath.Join(root, "dir", "new", "file"), false},
+		{"/inside", filepath.Join(root, "dir"), false},
+		{"/inside/newfile", filepath.Join(root, "dir", "newfile"), false},
+		{"/escape", "", true},
+		{"/escape/newfile", "", true},
+		{"/dir/etc/passwd", "", true},
+		{"/relative", "", true},
+		{"/dangling", "", true},
+		{"/reldangling", "", true},
+		{"/newlink", filepath.Join(root, "dir", "new"), false},
+	}
+	for _, test := range tests {
+		got, err := realPath(root, test.virtual)
+		if test.err {
+			if err != errPathEscape {
+				t.Errorf("realPath(%q) = %q, %v, want %v", test.virtual, got, err, errPathEscape)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("realPath(%q) failed: %v", test.virtual, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("realPath(%q) = %q, want %q", test.virtual, got, test.want)
+		}
+	}
+}
+
+func TestRealPathLoop(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("loop", filepath.Join(root, "loop")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	if got, err := realPath(root, "/loop/file"); err != errTooManyLinks {
+		t.Errorf("realPath(/loop/file) = %q, %v, want %v", got, err, errTooManyLinks)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errQuotaExceeded is returned when an upload exceeds the quota of the user
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaProvider is implemented by the authenticators knowing the disk quota of users
+type QuotaProvider interface {
+	// Quota returns the maximum size of the files of the user in bytes
+	// (0 for no limit), ok is false if the user has no specific quota
+	Quota(user string) (quota int64, ok bool)
+}
+
+// userQuota returns the disk quota of a user (0 for no limit)
+func (server *FtpServer) userQuota(user string) int64 {
+	if quotas, ok := server.authenticator.(QuotaProvider); ok && !isAnonymous(user) {
+		if quota, ok := quotas.Quota(user); ok {
+			return quota
+		}
+	}
+	return server.defaultQuota
+}
+
+// parseSize parses a size in bytes with an optional K, M or G suffix (powers of 1024)
+func parseSize(s string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(number, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		number = number[:len(number)-1]
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > (1<<62)/unit {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return size * unit, nil
+}
+
+// diskUsage computes the total size of the files of a directory tree
+func diskUsage(fileSystem FileSystem, name string) (int64, error) {
+	infos, err := fileSystem.List(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var usage int64
+	for _, info := range infos {
+		if info.IsDir() {
+			size, err := diskUsage(fileSystem, path.Join(name, info.Name()))
+			if err != nil {
+				return 0, err
+			}
+			usage += size
+		} else {
+			usage += info.Size()
+		}
+	}
+	return usage, nil
+}
+
+// quotaAccount is the disk usage shared by the sessions of a user.
+// The uploads reserve their bytes under its lock, so that concurrent uploads
+// can't exceed the quota together.
+type quotaAccount struct {
+	mu      sync.Mutex
+	uploads int   // Uploads in progress
+	used    int64 // Disk usage, including the bytes reserved by the uploads in progress
+}
+
+// quotaAccount returns the disk usage account of a user. The anonymous
+// users share the same account.
+func (server *FtpServer) quotaAccount(user string) *quotaAccount {
+	server.quotasMutex.Lock()
+	defer server.quotasMutex.Unlock()
+
+	if isAnonymous(user) {
+		user = "anonymous"
+	}
+	if server.quotas == nil {
+		server.quotas = make(map[string]*quotaAccount)
+	}
+	account, ok := server.quotas[user]
+	if !ok {
+		account = &quotaAccount{}
+		server.quotas[user] = account
+	}
+	return account
+}
+
+// begin starts an upload. The usage is read from the disk when no other
+// upload is in progress, it follows the reservations otherwise.
+func (a *quotaAccount) begin(fileSystem FileSystem) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.uploads == 0 {
+		usage, err := diskUsage(fileSystem, "/")
+		if err != nil {
+			return err
+		}
+		a.used = usage
+	}
+	a.uploads++
+	return nil
+}
+
+// end ends an upload
+func (a *quotaAccount) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.uploads--
+}
+
+// exhausted returns true if no byte remains in the quota
+func (a *quotaAccount) exhausted(quota int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.used >= quota
+}
+
+// reserve reserves up to n bytes in the quota and returns the number of
+// bytes reserved
+func (a *quotaAccount) reserve(n, quota int64) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if remaining := quota - a.used; n > remaining {
+		n = remaining
+	}
+	if n < 0 {
+		n = 0
+	}
+	a.used += n
+	return n
+}
+
+// release gives back reserved bytes which were not stored
+func (a *quotaAccount) release(n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.used -= n
+}
+
+// quotaWriter fails once the quota is exhausted.
+// The data fitting in the quota are written.
+type quotaWriter struct {
+	w       io.Writer
+	account *quotaAccount
+	quota   int64 // Limit of the account usage
+	written int64 // Bytes written, thus reserved in the account
+}
+
+// Write reserves the bytes in the quota and writes the data fitting in it
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	reserved := qw.account.reserve(int64(len(p)), qw.quota)
+	exceeded := reserved < int64(len(p))
+	n, err := qw.w.Write(p[:reserved])
+	qw.account.release(reserved - int64(n))
+	qw.written += int64(n)
+	if err == nil && exceeded {
+		err = errQuotaExceeded
+	}
+	return n, err
+}
+
+// discard gives back the bytes written to the quota
+func (qw *quotaWriter) discard() {
+	qw.account.release(qw.written)
+	qw.written = 0
+}
+
+// commandSite manages the SITE FTP command
+func (conn *FtpConnection) commandSite(args []string) {
+	// Check arguments count
+	if len(args) < 1 {
+		log.Printf("commandSite: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "QUOTA":
+		conn.commandSiteQuota(args[1:])
+	default:
+		log.Printf("commandSite: unknown command: %s", args[0])
+		conn.writeString("504 Command not implemented for that parameter.")
+	}
+}
+
+// commandSiteQuota manages the SITE QUOTA FTP command
+func (conn *FtpConnection) commandSiteQuota(args []string) {
+	// Check arguments count
+	if len(args) != 0 {
+		log.Printf("commandSiteQuota: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check the user is logged in
+	if !conn.authenticated {
+		log.Printf("commandSiteQuota: not logged in")
+		conn.writeString("530 Not logged in.")
+		return
+	}
+
+	// Compute the current usage
+	usage, err := diskUsage(conn.fileSystem, "/")
+	if err != nil {
+		log.Printf("commandSiteQuota: unable to compute disk usage: %v", err)
+		conn.writeString("451 Requested action aborted: local error in processing.")
+		return
+	}
+
+	// Send the reply
+	quota := conn.server.userQuota(conn.user)
+	if quota == 0 {
+		conn.writeString("200 Quota of %s: %d bytes used, no limit.", conn.user, usage)
+		return
+	}
+	conn.writeString("200 Quota of %s: %d of %d bytes used (%.1f%%).",
+		conn.user, usage, quota, float64(usage)*100/float64(quota))
+}
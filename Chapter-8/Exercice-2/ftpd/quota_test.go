@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int64
+		valid    bool
+	}{
+		{"0", 0, true},
+		{"1234", 1234, true},
+		{"512k", 512 << 10, true},
+		{" 10M ", 10 << 20, true},
+		{"2G", 2 << 30, true},
+		{"", 0, false},
+		{"M", 0, false},
+		{"-1", 0, false},
+		{"10T", 0, false},
+	}
+
+	for _, test := range tests {
+		size, err := parseSize(test.s)
+		if test.valid && (err != nil || size != test.expected) {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", test.s, size, err, test.expected)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", test.s, size)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	fs := NewMemoryFileSystem()
+	fs.Mkdir("/dir")
+	for name, content := range map[string]string{"/a": "12345", "/dir/b": "123", "/dir/c": ""} {
+		file, err := fs.Create(name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(content))
+		file.Close()
+	}
+
+	if usage, err := diskUsage(fs, "/"); err != nil || usage != 8 {
+		t.Errorf("diskUsage(/) = %d, %v, want 8", usage, err)
+	}
+	if usage, err := diskUsage(fs, "/dir"); err != nil || usage != 3 {
+		t.Errorf("diskUsage(/dir) = %d, %v, want 3", usage, err)
+	}
+}
+
+func TestQuotaWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	account := &quotaAccount{used: 3}
+	qw := &quotaWriter{w: &buffer, account: account, quota: 8}
+
+	if n, err := qw.Write([]byte("abc")); n != 3 || err != nil {
+		t.Errorf("Write = %d, %v, want 3, nil", n, err)
+	}
+	if n, err := qw.Write([]byte("defg")); n != 2 || err != errQuotaExceeded {
+		t.Errorf("Write = %d, %v, want 2, %v", n, err, errQuotaExceeded)
+	}
+	if buffer.String() != "abcde" {
+		t.Errorf("got %q, want %q", buffer.String(), "abcde")
+	}
+	if !account.exhausted(8) {
+		t.Errorf("quota not exhausted: %d/8 bytes used", account.used)
+	}
+
+	// The bytes reserved by a second writer are shared with the first one
+	account.release(2)
+	other := &quotaWriter{w: &buffer, account: account, quota: 8}
+	if n, err := other.Write([]byte("xyz")); n != 2 || err != errQuotaExceeded {
+		t.Errorf("Write = %d, %v, want 2, %v", n, err, errQuotaExceeded)
+	}
+	if n, err := qw.Write([]byte("h")); n != 0 || err != errQuotaExceeded {
+		t.Errorf("Write = %d, %v, want 0, %v", n, err, errQuotaExceeded)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits a bandwidth in bytes per second. It is shared by the
+// data connections of all the sessions of a user.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64     // Bytes per second
+	next time.Time // Time when the bytes already allowed are sent
+}
+
+// maxChunk returns the maximum size of a single read or write, so that the
+// waits stay short (about 100 ms)
+func (l *rateLimiter) maxChunk() int {
+	if chunk := l.rate / 10; chunk > 0 {
+		return int(chunk)
+	}
+	return 1
+}
+
+// wait blocks up to the time when n more bytes can be sent
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// RateProvider is implemented by the authenticators knowing the bandwidths of users
+type RateProvider interface {
+	// Rates returns the upload and download bandwidths of the user in bytes
+	// per second (0 for no limit, -1 if the user has no specific rate)
+	Rates(user string) (upload, download int64)
+}
+
+// userRates are the bandwidth limiters of a user
+type userRates struct {
+	upload   *rateLimiter // nil for no limit
+	download *rateLimiter // nil for no limit
+}
+
+// userRateLimiters returns the bandwidth limiters shared by the sessions of a user
+func (server *FtpServer) userRateLimiters(user string) userRates {
+	server.ratesMutex.Lock()
+	defer server.ratesMutex.Unlock()
+
+	if server.rates == nil {
+		server.rates = make(map[string]userRates)
+	}
+	rates, ok := server.rates[user]
+	if !ok {
+		upload, download := server.userRates(user)
+		if upload > 0 {
+			rates.upload = &rateLimiter{rate: upload}
+		}
+		if download > 0 {
+			rates.download = &rateLimiter{rate: download}
+		}
+		server.rates[user] = rates
+	}
+	return rates
+}
+
+// userRates returns the upload and download bandwidths of a user in bytes
+// per second (0 for no limit)
+func (server *FtpServer) userRates(user string) (upload, download int64) {
+	upload, download = server.uploadRate, server.downloadRate
+	if provider, ok := server.authenticator.(RateProvider); ok && !isAnonymous(user) {
+		userUpload, userDownload := provider.Rates(user)
+		if userUpload >= 0 {
+			upload = userUpload
+		}
+		if userDownload >= 0 {
+			download = userDownload
+		}
+	}
+	return upload, download
+}
+
+// throttledConn is a data connection whose bandwidth is limited.
+// Reads receive uploaded data, writes send downloaded data.
+type throttledConn struct {
+	net.Conn
+	rates userRates
+}
+
+// Read receives data at the upload rate
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if c.rates.upload == nil {
+		return c.Conn.Read(p)
+	}
+	if chunk := c.rates.upload.maxChunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := c.Conn.Read(p)
+	c.rates.upload.wait(n)
+	return n, err
+}
+
+// Write sends data at the download rate
+func (c *throttledConn) Write(p []byte) (int, error) {
+	if c.rates.download == nil {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if chunk := c.rates.download.maxChunk(); n > chunk {
+			n = chunk
+		}
+		c.rates.download.wait(n)
+		n, err := c.Conn.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// newTLSConfig builds the TLS configuration from certificate and key files
+func newTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// newSelfSignedTLSConfig builds a TLS configuration with a self-signed certificate
+// generated for the given host names and addresses (for testing purpose)
+func newSelfSignedTLSConfig(hosts []string) (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"ftpd self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// isAuthCommand returns true if the command line is an AUTH command
+// (the reading of the commands must then wait for the TLS negotiation)
+func isAuthCommand(line string) bool {
+	return strings.ToUpper(strings.SplitN(line, " ", 2)[0]) == "AUTH"
+}
+
+// commandAuth manages the AUTH FTP command (RFC 4217)
+func (conn *FtpConnection) commandAuth(args []string) {
+	// The command reader waits for the new control connection (nil if unchanged)
+	var upgraded net.Conn
+	defer func() { conn.upgraded <- upgraded }()
+
+	// Check arguments count
+	if len(args) != 1 {
+		log.Printf("commandAuth: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check TLS is available
+	if conn.server.tlsConfig == nil {
+		log.Printf("commandAuth: TLS is not configured")
+		conn.writeString("534 Request denied for policy reasons.")
+		return
+	}
+
+	// Check the security mechanism
+	switch strings.ToUpper(args[0]) {
+	case "TLS", "TLS-C", "SSL":
+	default:
+		log.Printf("commandAuth: unknown security mechanism: %s", args[0])
+		conn.writeString("504 Command not implemented for that parameter.")
+		return
+	}
+
+	// Check TLS is not already negotiated
+	if conn.secured {
+		log.Printf("commandAuth: TLS already negotiated")
+		conn.writeString("503 Bad sequence of commands.")
+		return
+	}
+
+	// Send the reply (in clear text)
+	conn.writeString("234 AUTH TLS successful.")
+
+	// Negotiate TLS on the control connection
+	tlsConnection := tls.Server(conn.tcpConnection, conn.server.tlsConfig)
+	if err := tlsConnection.Handshake(); err != nil {
+		log.Printf("commandAuth: TLS handshake failed: %v", err)
+		// The control connection is unusable: closing it ends the session
+		conn.tcpConnection.Close()
+		return
+	}
+
+	// Use the TLS connection from now on
+	conn.writerMutex.Lock()
+	conn.tcpConnection = tlsConnection
+	conn.writer.Reset(tlsConnection)
+	conn.writerMutex.Unlock()
+	conn.secured = true
+	upgraded = tlsConnection
+}
+
+// commandProtectionBufferSize manages the PBSZ FTP command (RFC 4217)
+func (conn *FtpConnection) commandProtectionBufferSize(args []string) {
+	// Check arguments count
+	if len(args) != 1 {
+		log.Printf("commandProtectionBufferSize: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// PBSZ is only valid on a secured control connection
+	if !conn.secured {
+		log.Printf("commandProtectionBufferSize: TLS not negotiated")
+		conn.writeString("503 Bad sequence of commands.")
+		return
+	}
+
+	// The buffer size is always 0 with TLS
+	conn.protectionBufferSet = true
+	conn.writeString("200 PBSZ=0")
+}
+
+// commandProtection manages the PROT FTP command (RFC 4217)
+func (conn *FtpConnection) commandProtection(args []string) {
+	// Check arguments count
+	if len(args) != 1 {
+		log.Printf("commandProtection: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// PROT must follow PBSZ
+	if !conn.protectionBufferSet {
+		log.Printf("commandProtection: PBSZ not sent")
+		conn.writeString("503 Bad sequence of commands.")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "C": // Clear
+		conn.protectedData = false
+		conn.writeString("200 Command okay.")
+	case "P": // Private
+		conn.protectedData = true
+		conn.writeString("200 Command okay.")
+	case "S", "E": // Safe, Confidential
+		conn.writeString("536 Requested PROT level not supported by mechanism.")
+	default:
+		log.Printf("commandProtection: unknown level: %s", args[0])
+		conn.writeString("504 Command not implemented for that parameter.")
+	}
+}
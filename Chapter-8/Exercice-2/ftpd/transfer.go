@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// errTransferAborted is returned when a data connection is established after ABOR
+var errTransferAborted = errors.New("transfer aborted")
+
+// transfer is a data transfer running concurrently with the command reading
+type transfer struct {
+	done           chan struct{} // Closed when the transfer is over
+	mu             sync.Mutex    // Protects the fields below
+	aborted        bool
+	timedOut       bool         // true if the data connection was idle for too long
+	listener       net.Listener // Passive listener waiting for the data connection
+	dataConnection net.Conn
+}
+
+// setConnection registers the data connection of the transfer
+func (t *transfer) setConnection(cnx net.Conn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.aborted {
+		cnx.Close()
+		return errTransferAborted
+	}
+	t.dataConnection = cnx
+	return nil
+}
+
+// isAborted returns true if the transfer was aborted by ABOR
+func (t *transfer) isAborted() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.aborted
+}
+
+// timeout records that the data connection was idle for too long
+func (t *transfer) timeout() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timedOut = true
+}
+
+// isTimedOut returns true if the data connection was idle for too long
+func (t *transfer) isTimedOut() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timedOut
+}
+
+// abort interrupts the transfer and waits for its end
+func (t *transfer) abort() {
+	t.mu.Lock()
+	t.aborted = true
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	if t.dataConnection != nil {
+		t.dataConnection.Close()
+	}
+	t.mu.Unlock()
+
+	<-t.done
+}
+
+// startTransfer runs a data transfer concurrently with the command reading.
+// The function run owns the data connection and sends the replies
+// related to the transfer.
+func (conn *FtpConnection) startTransfer(run func()) {
+	t := &transfer{done: make(chan struct{})}
+	if conn.passive {
+		t.listener = conn.listener
+	}
+	conn.transfer = t
+
+	go func() {
+		defer close(t.done)
+		run()
+	}()
+}
+
+// takeRestartOffset returns the offset provided by REST and clears it
+func (conn *FtpConnection) takeRestartOffset() int64 {
+	offset := conn.restartOffset
+	conn.restartOffset = 0
+	return offset
+}
+
+// commandRestart manages the REST FTP command (RFC 3659, stream mode)
+func (conn *FtpConnection) commandRestart(args []string) {
+	// Check arguments count
+	if len(args) != 1 {
+		log.Printf("commandRestart: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Parse the offset
+	offset, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || offset < 0 {
+		log.Printf("commandRestart: invalid offset: %s", args[0])
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Store the offset up to the next transfer
+	conn.restartOffset = offset
+
+	// Send the reply
+	conn.writeString("350 Restarting at %d. Send STORE or RETRIEVE to initiate transfer.", offset)
+}
+
+// commandAbort manages the ABOR FTP command
+func (conn *FtpConnection) commandAbort(args []string) {
+	// Check arguments count
+	if len(args) != 0 {
+		log.Printf("commandAbort: bad arguments count: %v", args)
+		conn.writeString("501 Syntax error in parameters or arguments.")
+		return
+	}
+
+	// Check a transfer is in progress
+	if conn.transfer == nil {
+		conn.writeString("225 Data connection open; no transfer in progress.")
+		return
+	}
+
+	// Interrupt the transfer (its replies are sent before the ABOR one)
+	conn.transfer.abort()
+	conn.transfer = nil
+
+	// Send the reply
+	conn.writeString("226 Abort successful.")
+}
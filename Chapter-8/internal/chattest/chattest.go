@@ -0,0 +1,76 @@
+// Package chattest drives the clients of the chat servers of the exercises in
+// their tests.
+package chattest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Timeout is the time a client waits for an expected line
+const Timeout = 2 * time.Second
+
+// Client is a line based chat client driven by a test
+type Client struct {
+	Name  string // address of the client, as seen by the server
+	t     testing.TB
+	conn  net.Conn
+	input *bufio.Reader
+}
+
+// Dial connects a client to a server until the end of the test
+func Dial(t testing.TB, addr string) *Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &Client{Name: conn.LocalAddr().String(), t: t, conn: conn, input: bufio.NewReader(conn)}
+}
+
+// Send sends a line
+func (c *Client) Send(line string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintln(c.conn, line); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Expect checks the next line received
+func (c *Client) Expect(want string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(Timeout))
+	line, err := c.input.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("waiting for %q: %v", want, err)
+	}
+	if line = strings.TrimSuffix(line, "\n"); line != want {
+		c.t.Fatalf("received %q, want %q", line, want)
+	}
+}
+
+// ExpectClosed checks the server closes the connection within timeout without
+// sending more lines
+func (c *Client) ExpectClosed(timeout time.Duration) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := c.input.ReadString('\n')
+	if err == nil {
+		c.t.Fatalf("received %q, want the connection closed", line)
+	}
+	if !errors.Is(err, io.EOF) {
+		c.t.Fatalf("%v, want the connection closed", err)
+	}
+}
+
+// Close closes the connection of the client
+func (c *Client) Close() {
+	c.conn.Close()
+}
@@ -2,4 +2,10 @@ module GoExercices
 
 go 1.19
 
-require golang.org/x/net v0.0.0-20220812174116-3211cb980234
+require (
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.10.0
+	golang.org/x/term v0.13.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect